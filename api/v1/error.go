@@ -2,6 +2,7 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
@@ -37,3 +38,117 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrRelativeOffsetOutOfRange is returned when an offset relative to the end
+// of the log reaches before its first record
+type ErrRelativeOffsetOutOfRange struct {
+	Offset int64
+}
+
+func (e ErrRelativeOffsetOutOfRange) GRPCStatus() *status.Status {
+	return status.New(
+		codes.NotFound, fmt.Sprintf("relative offset out of range: %d", e.Offset),
+	)
+}
+
+func (e ErrRelativeOffsetOutOfRange) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotReplicatedYet is returned when reading an offset a server's raft log
+// holds but that hasn't been applied to its log yet. clients retry the read
+// rather than treat the offset as nonexistent
+type ErrNotReplicatedYet struct {
+	Offset uint64
+}
+
+func (e ErrNotReplicatedYet) GRPCStatus() *status.Status {
+	return status.New(
+		codes.Unavailable, fmt.Sprintf("offset not replicated yet: %d", e.Offset),
+	)
+}
+
+func (e ErrNotReplicatedYet) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotLeader is returned when a write reaches a server that isn't the
+// cluster's leader. clients retry against the leader's address, which is empty
+// while no leader is known
+type ErrNotLeader struct {
+	LeaderAddr string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition, fmt.Sprintf("not the leader, leader is at %q", e.LeaderAddr),
+	)
+	// carry the leader address for clients to redirect to
+	details := &errdetails.ErrorInfo{
+		Reason:   "NOT_LEADER",
+		Domain:   "gumlog",
+		Metadata: map[string]string{"leader_addr": e.LeaderAddr},
+	}
+	std, err := st.WithDetails(details)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrProduceStreamAborted is returned when a produce stream fails part way
+// through. Committed records were appended before the failure, so clients
+// resume from the record after them instead of producing duplicates
+type ErrProduceStreamAborted struct {
+	Committed uint64
+	Err       error
+}
+
+func (e ErrProduceStreamAborted) GRPCStatus() *status.Status {
+	// keep the code of the failure so clients know whether to retry
+	st := status.New(
+		status.Code(e.Err),
+		fmt.Sprintf("produce stream aborted after %d committed records: %s", e.Committed, status.Convert(e.Err).Message()),
+	)
+	details := &errdetails.ErrorInfo{
+		Reason:   "PRODUCE_STREAM_ABORTED",
+		Domain:   "gumlog",
+		Metadata: map[string]string{"committed": strconv.FormatUint(e.Committed, 10)},
+	}
+	std, err := st.WithDetails(details)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrProduceStreamAborted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrProduceStreamAborted) Unwrap() error {
+	return e.Err
+}
+
+// ProduceStreamCommitted returns the number of records a produce stream
+// committed before failing with err. ok is false for errors that don't
+// report it
+func ProduceStreamCommitted(err error) (committed uint64, ok bool) {
+	st, isStatus := status.FromError(err)
+	if !isStatus {
+		return 0, false
+	}
+	for _, detail := range st.Details() {
+		info, isInfo := detail.(*errdetails.ErrorInfo)
+		if !isInfo || info.Reason != "PRODUCE_STREAM_ABORTED" {
+			continue
+		}
+		committed, err := strconv.ParseUint(info.Metadata["committed"], 10, 64)
+		return committed, err == nil
+	}
+	return 0, false
+}
@@ -9,6 +9,7 @@ package log_v1
 import (
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	reflect "reflect"
 	sync "sync"
 	unsafe "unsafe"
@@ -21,12 +22,227 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type Compression int32
+
+const (
+	Compression_UNCOMPRESSED Compression = 0
+	Compression_GZIP         Compression = 1
+	Compression_SNAPPY       Compression = 2
+)
+
+// Enum value maps for Compression.
+var (
+	Compression_name = map[int32]string{
+		0: "UNCOMPRESSED",
+		1: "GZIP",
+		2: "SNAPPY",
+	}
+	Compression_value = map[string]int32{
+		"UNCOMPRESSED": 0,
+		"GZIP":         1,
+		"SNAPPY":       2,
+	}
+)
+
+func (x Compression) Enum() *Compression {
+	p := new(Compression)
+	*p = x
+	return p
+}
+
+func (x Compression) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Compression) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_v1_log_proto_enumTypes[0].Descriptor()
+}
+
+func (Compression) Type() protoreflect.EnumType {
+	return &file_api_v1_log_proto_enumTypes[0]
+}
+
+func (x Compression) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Compression.Descriptor instead.
+func (Compression) EnumDescriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{0}
+}
+
+// acknowledgement levels for produced records
+type Acks int32
+
+const (
+	// once the leader has appended the record to its log
+	Acks_LEADER Acks = 0
+	// once a quorum of the cluster has stored the record
+	Acks_ALL Acks = 1
+	// as soon as the record is submitted, without waiting for it to be
+	// stored. the offset of the record isn't known
+	Acks_NONE Acks = 2
+)
+
+// Enum value maps for Acks.
+var (
+	Acks_name = map[int32]string{
+		0: "LEADER",
+		1: "ALL",
+		2: "NONE",
+	}
+	Acks_value = map[string]int32{
+		"LEADER": 0,
+		"ALL":    1,
+		"NONE":   2,
+	}
+)
+
+func (x Acks) Enum() *Acks {
+	p := new(Acks)
+	*p = x
+	return p
+}
+
+func (x Acks) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Acks) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_v1_log_proto_enumTypes[1].Descriptor()
+}
+
+func (Acks) Type() protoreflect.EnumType {
+	return &file_api_v1_log_proto_enumTypes[1]
+}
+
+func (x Acks) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Acks.Descriptor instead.
+func (Acks) EnumDescriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{1}
+}
+
+// end of log behaviour for a consume stream
+type ConsumeMode int32
+
+const (
+	// keep waiting for new records
+	ConsumeMode_FOLLOW ConsumeMode = 0
+	// close the stream after the latest offset when the stream was opened
+	ConsumeMode_UNTIL_LATEST ConsumeMode = 1
+	// start with the latest records, as many as the request's tail, then
+	// keep waiting for new records like FOLLOW
+	ConsumeMode_TAIL ConsumeMode = 2
+)
+
+// Enum value maps for ConsumeMode.
+var (
+	ConsumeMode_name = map[int32]string{
+		0: "FOLLOW",
+		1: "UNTIL_LATEST",
+		2: "TAIL",
+	}
+	ConsumeMode_value = map[string]int32{
+		"FOLLOW":       0,
+		"UNTIL_LATEST": 1,
+		"TAIL":         2,
+	}
+)
+
+func (x ConsumeMode) Enum() *ConsumeMode {
+	p := new(ConsumeMode)
+	*p = x
+	return p
+}
+
+func (x ConsumeMode) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ConsumeMode) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_v1_log_proto_enumTypes[2].Descriptor()
+}
+
+func (ConsumeMode) Type() protoreflect.EnumType {
+	return &file_api_v1_log_proto_enumTypes[2]
+}
+
+func (x ConsumeMode) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ConsumeMode.Descriptor instead.
+func (ConsumeMode) EnumDescriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{2}
+}
+
+// position in the log to look up an offset for
+type OffsetPosition int32
+
+const (
+	OffsetPosition_EARLIEST OffsetPosition = 0
+	OffsetPosition_LATEST   OffsetPosition = 1
+)
+
+// Enum value maps for OffsetPosition.
+var (
+	OffsetPosition_name = map[int32]string{
+		0: "EARLIEST",
+		1: "LATEST",
+	}
+	OffsetPosition_value = map[string]int32{
+		"EARLIEST": 0,
+		"LATEST":   1,
+	}
+)
+
+func (x OffsetPosition) Enum() *OffsetPosition {
+	p := new(OffsetPosition)
+	*p = x
+	return p
+}
+
+func (x OffsetPosition) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (OffsetPosition) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_v1_log_proto_enumTypes[3].Descriptor()
+}
+
+func (OffsetPosition) Type() protoreflect.EnumType {
+	return &file_api_v1_log_proto_enumTypes[3]
+}
+
+func (x OffsetPosition) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use OffsetPosition.Descriptor instead.
+func (OffsetPosition) EnumDescriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{3}
+}
+
 type Record struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Value         []byte                 `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
-	Offset        uint64                 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
-	Term          uint64                 `protobuf:"varint,3,opt,name=term,proto3" json:"term,omitempty"`
-	Type          uint32                 `protobuf:"varint,4,opt,name=type,proto3" json:"type,omitempty"`
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Value  []byte                 `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+	Offset uint64                 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	Term   uint64                 `protobuf:"varint,3,opt,name=term,proto3" json:"term,omitempty"`
+	Type   uint32                 `protobuf:"varint,4,opt,name=type,proto3" json:"type,omitempty"`
+	// arbitrary key-value metadata attached to the record
+	Headers map[string]string `protobuf:"bytes,5,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// codec the producer compressed the value with. the value is stored and
+	// returned as produced, consumers decompress it
+	Compression Compression `protobuf:"varint,6,opt,name=compression,proto3,enum=log.v1.Compression" json:"compression,omitempty"`
+	// id of the request that produced the record, stored when the server
+	// records request ids
+	RequestId string `protobuf:"bytes,7,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	// time the record was first appended. assigned by the log unless set,
+	// such as on records replicated from another server
+	Timestamp     *timestamppb.Timestamp `protobuf:"bytes,8,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -89,9 +305,47 @@ func (x *Record) GetType() uint32 {
 	return 0
 }
 
+func (x *Record) GetHeaders() map[string]string {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *Record) GetCompression() Compression {
+	if x != nil {
+		return x.Compression
+	}
+	return Compression_UNCOMPRESSED
+}
+
+func (x *Record) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *Record) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
 type ProduceRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Record        *Record                `protobuf:"bytes,1,opt,name=record,proto3" json:"record,omitempty"`
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Record *Record                `protobuf:"bytes,1,opt,name=record,proto3" json:"record,omitempty"`
+	// optional producer identity and per-producer sequence number. retries of
+	// a request with the same pair return the originally assigned offset
+	ProducerId string `protobuf:"bytes,2,opt,name=producer_id,json=producerId,proto3" json:"producer_id,omitempty"`
+	Sequence   uint64 `protobuf:"varint,3,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	// when the record is acknowledged by a replicated log
+	Acks Acks `protobuf:"varint,4,opt,name=acks,proto3,enum=log.v1.Acks" json:"acks,omitempty"`
+	// return only once the record is durable: flushed and synced to disk, or
+	// committed through raft for a replicated log, which needs acks LEADER
+	// or ALL
+	WaitDurable   bool `protobuf:"varint,5,opt,name=wait_durable,json=waitDurable,proto3" json:"wait_durable,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -133,9 +387,45 @@ func (x *ProduceRequest) GetRecord() *Record {
 	return nil
 }
 
+func (x *ProduceRequest) GetProducerId() string {
+	if x != nil {
+		return x.ProducerId
+	}
+	return ""
+}
+
+func (x *ProduceRequest) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *ProduceRequest) GetAcks() Acks {
+	if x != nil {
+		return x.Acks
+	}
+	return Acks_LEADER
+}
+
+func (x *ProduceRequest) GetWaitDurable() bool {
+	if x != nil {
+		return x.WaitDurable
+	}
+	return false
+}
+
 type ProduceResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Offset        uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Offset uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	// whether the record was durable when the response was sent
+	Durable bool `protobuf:"varint,2,opt,name=durable,proto3" json:"durable,omitempty"`
+	// time the log assigned to the record
+	Timestamp *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// set when the record was produced with acks NONE to a replicated log,
+	// which returns before the record is assigned an offset. the offset is
+	// 0 then
+	OffsetUnknown bool `protobuf:"varint,4,opt,name=offset_unknown,json=offsetUnknown,proto3" json:"offset_unknown,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -177,9 +467,37 @@ func (x *ProduceResponse) GetOffset() uint64 {
 	return 0
 }
 
+func (x *ProduceResponse) GetDurable() bool {
+	if x != nil {
+		return x.Durable
+	}
+	return false
+}
+
+func (x *ProduceResponse) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *ProduceResponse) GetOffsetUnknown() bool {
+	if x != nil {
+		return x.OffsetUnknown
+	}
+	return false
+}
+
 type ConsumeRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Offset        uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Offset uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	// how ConsumeStream behaves once it reaches the end of the log
+	Mode ConsumeMode `protobuf:"varint,2,opt,name=mode,proto3,enum=log.v1.ConsumeMode" json:"mode,omitempty"`
+	// when negative, the offset counting back from the latest record is read
+	// instead: -1 is the latest record, -2 the one before it and so on
+	RelativeOffset int64 `protobuf:"zigzag64,3,opt,name=relative_offset,json=relativeOffset,proto3" json:"relative_offset,omitempty"`
+	// number of latest records a TAIL stream starts with
+	Tail          uint64 `protobuf:"varint,4,opt,name=tail,proto3" json:"tail,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -221,9 +539,33 @@ func (x *ConsumeRequest) GetOffset() uint64 {
 	return 0
 }
 
+func (x *ConsumeRequest) GetMode() ConsumeMode {
+	if x != nil {
+		return x.Mode
+	}
+	return ConsumeMode_FOLLOW
+}
+
+func (x *ConsumeRequest) GetRelativeOffset() int64 {
+	if x != nil {
+		return x.RelativeOffset
+	}
+	return 0
+}
+
+func (x *ConsumeRequest) GetTail() uint64 {
+	if x != nil {
+		return x.Tail
+	}
+	return 0
+}
+
 type ConsumeResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Record        *Record                `protobuf:"bytes,2,opt,name=record,proto3" json:"record,omitempty"`
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Record *Record                `protobuf:"bytes,2,opt,name=record,proto3" json:"record,omitempty"`
+	// set on messages sent by following streams while no records are
+	// appended. heartbeats carry no record
+	Heartbeat     bool `protobuf:"varint,3,opt,name=heartbeat,proto3" json:"heartbeat,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -265,29 +607,969 @@ func (x *ConsumeResponse) GetRecord() *Record {
 	return nil
 }
 
-var File_api_v1_log_proto protoreflect.FileDescriptor
+func (x *ConsumeResponse) GetHeartbeat() bool {
+	if x != nil {
+		return x.Heartbeat
+	}
+	return false
+}
 
-const file_api_v1_log_proto_rawDesc = "" +
-	"\n" +
-	"\x10api/v1/log.proto\x12\x06log.v1\"^\n" +
-	"\x06Record\x12\x14\n" +
-	"\x05value\x18\x01 \x01(\fR\x05value\x12\x16\n" +
-	"\x06offset\x18\x02 \x01(\x04R\x06offset\x12\x12\n" +
-	"\x04term\x18\x03 \x01(\x04R\x04term\x12\x12\n" +
-	"\x04type\x18\x04 \x01(\rR\x04type\"8\n" +
-	"\x0eProduceRequest\x12&\n" +
-	"\x06record\x18\x01 \x01(\v2\x0e.log.v1.RecordR\x06record\")\n" +
-	"\x0fProduceResponse\x12\x16\n" +
-	"\x06offset\x18\x01 \x01(\x04R\x06offset\"(\n" +
-	"\x0eConsumeRequest\x12\x16\n" +
-	"\x06offset\x18\x01 \x01(\x04R\x06offset\"9\n" +
-	"\x0fConsumeResponse\x12&\n" +
-	"\x06record\x18\x02 \x01(\v2\x0e.log.v1.RecordR\x06record2\x8f\x02\n" +
-	"\x03Log\x12<\n" +
-	"\aProduce\x12\x16.log.v1.ProduceRequest\x1a\x17.log.v1.ProduceResponse\"\x00\x12<\n" +
-	"\aConsume\x12\x16.log.v1.ConsumeRequest\x1a\x17.log.v1.ConsumeResponse\"\x00\x12D\n" +
-	"\rConsumeStream\x12\x16.log.v1.ConsumeRequest\x1a\x17.log.v1.ConsumeResponse\"\x000\x01\x12F\n" +
-	"\rProduceStream\x12\x16.log.v1.ProduceRequest\x1a\x17.log.v1.ProduceResponse\"\x00(\x010\x01B'Z%github.com/mrshabel/gumlog/api/log_v1b\x06proto3"
+type ConsumeManyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Offsets       []uint64               `protobuf:"varint,1,rep,packed,name=offsets,proto3" json:"offsets,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConsumeManyRequest) Reset() {
+	*x = ConsumeManyRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConsumeManyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConsumeManyRequest) ProtoMessage() {}
+
+func (x *ConsumeManyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConsumeManyRequest.ProtoReflect.Descriptor instead.
+func (*ConsumeManyRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ConsumeManyRequest) GetOffsets() []uint64 {
+	if x != nil {
+		return x.Offsets
+	}
+	return nil
+}
+
+type ConsumeManyResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// a result for every requested offset, in request order
+	Results       []*ConsumeResult `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConsumeManyResponse) Reset() {
+	*x = ConsumeManyResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConsumeManyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConsumeManyResponse) ProtoMessage() {}
+
+func (x *ConsumeManyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConsumeManyResponse.ProtoReflect.Descriptor instead.
+func (*ConsumeManyResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ConsumeManyResponse) GetResults() []*ConsumeResult {
+	if x != nil {
+		return x.Results
+	}
+	return nil
+}
+
+// the record at an offset, or why it couldn't be read
+type ConsumeResult struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Offset uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	Record *Record                `protobuf:"bytes,2,opt,name=record,proto3" json:"record,omitempty"`
+	// grpc status code and message of a failed read. the code is OK when the
+	// record was read
+	Code          int32  `protobuf:"varint,3,opt,name=code,proto3" json:"code,omitempty"`
+	Error         string `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConsumeResult) Reset() {
+	*x = ConsumeResult{}
+	mi := &file_api_v1_log_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConsumeResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConsumeResult) ProtoMessage() {}
+
+func (x *ConsumeResult) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConsumeResult.ProtoReflect.Descriptor instead.
+func (*ConsumeResult) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ConsumeResult) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *ConsumeResult) GetRecord() *Record {
+	if x != nil {
+		return x.Record
+	}
+	return nil
+}
+
+func (x *ConsumeResult) GetCode() int32 {
+	if x != nil {
+		return x.Code
+	}
+	return 0
+}
+
+func (x *ConsumeResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type GetStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatsRequest) Reset() {
+	*x = GetStatsRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatsRequest) ProtoMessage() {}
+
+func (x *GetStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetStatsRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{8}
+}
+
+type GetStatsResponse struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	Segments           uint64                 `protobuf:"varint,1,opt,name=segments,proto3" json:"segments,omitempty"`
+	TotalBytes         uint64                 `protobuf:"varint,2,opt,name=total_bytes,json=totalBytes,proto3" json:"total_bytes,omitempty"`
+	Records            uint64                 `protobuf:"varint,3,opt,name=records,proto3" json:"records,omitempty"`
+	ActiveSegmentBytes uint64                 `protobuf:"varint,4,opt,name=active_segment_bytes,json=activeSegmentBytes,proto3" json:"active_segment_bytes,omitempty"`
+	// creation time of the oldest segment and time of the latest append
+	Oldest        *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=oldest,proto3" json:"oldest,omitempty"`
+	Newest        *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=newest,proto3" json:"newest,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatsResponse) Reset() {
+	*x = GetStatsResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatsResponse) ProtoMessage() {}
+
+func (x *GetStatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatsResponse.ProtoReflect.Descriptor instead.
+func (*GetStatsResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *GetStatsResponse) GetSegments() uint64 {
+	if x != nil {
+		return x.Segments
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetTotalBytes() uint64 {
+	if x != nil {
+		return x.TotalBytes
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetRecords() uint64 {
+	if x != nil {
+		return x.Records
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetActiveSegmentBytes() uint64 {
+	if x != nil {
+		return x.ActiveSegmentBytes
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetOldest() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Oldest
+	}
+	return nil
+}
+
+func (x *GetStatsResponse) GetNewest() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Newest
+	}
+	return nil
+}
+
+type GetOffsetsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Position      OffsetPosition         `protobuf:"varint,1,opt,name=position,proto3,enum=log.v1.OffsetPosition" json:"position,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetOffsetsRequest) Reset() {
+	*x = GetOffsetsRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetOffsetsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetOffsetsRequest) ProtoMessage() {}
+
+func (x *GetOffsetsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetOffsetsRequest.ProtoReflect.Descriptor instead.
+func (*GetOffsetsRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *GetOffsetsRequest) GetPosition() OffsetPosition {
+	if x != nil {
+		return x.Position
+	}
+	return OffsetPosition_EARLIEST
+}
+
+type GetOffsetsResponse struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Offset uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	// set when the log holds no records. the offset is then the one the first
+	// record will be assigned
+	Empty         bool `protobuf:"varint,2,opt,name=empty,proto3" json:"empty,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetOffsetsResponse) Reset() {
+	*x = GetOffsetsResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetOffsetsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetOffsetsResponse) ProtoMessage() {}
+
+func (x *GetOffsetsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetOffsetsResponse.ProtoReflect.Descriptor instead.
+func (*GetOffsetsResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *GetOffsetsResponse) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *GetOffsetsResponse) GetEmpty() bool {
+	if x != nil {
+		return x.Empty
+	}
+	return false
+}
+
+type GetServersRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetServersRequest) Reset() {
+	*x = GetServersRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetServersRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetServersRequest) ProtoMessage() {}
+
+func (x *GetServersRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetServersRequest.ProtoReflect.Descriptor instead.
+func (*GetServersRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{12}
+}
+
+type GetServersResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Servers       []*Server              `protobuf:"bytes,1,rep,name=servers,proto3" json:"servers,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetServersResponse) Reset() {
+	*x = GetServersResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetServersResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetServersResponse) ProtoMessage() {}
+
+func (x *GetServersResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetServersResponse.ProtoReflect.Descriptor instead.
+func (*GetServersResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *GetServersResponse) GetServers() []*Server {
+	if x != nil {
+		return x.Servers
+	}
+	return nil
+}
+
+// a member of the cluster
+type Server struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	RpcAddr       string                 `protobuf:"bytes,2,opt,name=rpc_addr,json=rpcAddr,proto3" json:"rpc_addr,omitempty"`
+	IsLeader      bool                   `protobuf:"varint,3,opt,name=is_leader,json=isLeader,proto3" json:"is_leader,omitempty"`
+	Voter         bool                   `protobuf:"varint,4,opt,name=voter,proto3" json:"voter,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Server) Reset() {
+	*x = Server{}
+	mi := &file_api_v1_log_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Server) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Server) ProtoMessage() {}
+
+func (x *Server) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Server.ProtoReflect.Descriptor instead.
+func (*Server) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *Server) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Server) GetRpcAddr() string {
+	if x != nil {
+		return x.RpcAddr
+	}
+	return ""
+}
+
+func (x *Server) GetIsLeader() bool {
+	if x != nil {
+		return x.IsLeader
+	}
+	return false
+}
+
+func (x *Server) GetVoter() bool {
+	if x != nil {
+		return x.Voter
+	}
+	return false
+}
+
+type SnapshotRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SnapshotRequest) Reset() {
+	*x = SnapshotRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnapshotRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotRequest) ProtoMessage() {}
+
+func (x *SnapshotRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotRequest.ProtoReflect.Descriptor instead.
+func (*SnapshotRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{15}
+}
+
+type SnapshotResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SnapshotResponse) Reset() {
+	*x = SnapshotResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnapshotResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotResponse) ProtoMessage() {}
+
+func (x *SnapshotResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotResponse.ProtoReflect.Descriptor instead.
+func (*SnapshotResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{16}
+}
+
+type CommitOffsetRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Group         string                 `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
+	Offset        uint64                 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CommitOffsetRequest) Reset() {
+	*x = CommitOffsetRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CommitOffsetRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommitOffsetRequest) ProtoMessage() {}
+
+func (x *CommitOffsetRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommitOffsetRequest.ProtoReflect.Descriptor instead.
+func (*CommitOffsetRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *CommitOffsetRequest) GetGroup() string {
+	if x != nil {
+		return x.Group
+	}
+	return ""
+}
+
+func (x *CommitOffsetRequest) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+type CommitOffsetResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CommitOffsetResponse) Reset() {
+	*x = CommitOffsetResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CommitOffsetResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommitOffsetResponse) ProtoMessage() {}
+
+func (x *CommitOffsetResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommitOffsetResponse.ProtoReflect.Descriptor instead.
+func (*CommitOffsetResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{18}
+}
+
+type FetchCommittedOffsetRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Group         string                 `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FetchCommittedOffsetRequest) Reset() {
+	*x = FetchCommittedOffsetRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FetchCommittedOffsetRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FetchCommittedOffsetRequest) ProtoMessage() {}
+
+func (x *FetchCommittedOffsetRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FetchCommittedOffsetRequest.ProtoReflect.Descriptor instead.
+func (*FetchCommittedOffsetRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *FetchCommittedOffsetRequest) GetGroup() string {
+	if x != nil {
+		return x.Group
+	}
+	return ""
+}
+
+type FetchCommittedOffsetResponse struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Offset uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	// false when the group never committed an offset
+	Found         bool `protobuf:"varint,2,opt,name=found,proto3" json:"found,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FetchCommittedOffsetResponse) Reset() {
+	*x = FetchCommittedOffsetResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FetchCommittedOffsetResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FetchCommittedOffsetResponse) ProtoMessage() {}
+
+func (x *FetchCommittedOffsetResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FetchCommittedOffsetResponse.ProtoReflect.Descriptor instead.
+func (*FetchCommittedOffsetResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *FetchCommittedOffsetResponse) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *FetchCommittedOffsetResponse) GetFound() bool {
+	if x != nil {
+		return x.Found
+	}
+	return false
+}
+
+// the first message of a group stream names the group. later messages ack
+// the offset of a processed record
+type ConsumeGroupRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Group         string                 `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
+	Ack           uint64                 `protobuf:"varint,2,opt,name=ack,proto3" json:"ack,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConsumeGroupRequest) Reset() {
+	*x = ConsumeGroupRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[21]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConsumeGroupRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConsumeGroupRequest) ProtoMessage() {}
+
+func (x *ConsumeGroupRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[21]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConsumeGroupRequest.ProtoReflect.Descriptor instead.
+func (*ConsumeGroupRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{21}
+}
+
+func (x *ConsumeGroupRequest) GetGroup() string {
+	if x != nil {
+		return x.Group
+	}
+	return ""
+}
+
+func (x *ConsumeGroupRequest) GetAck() uint64 {
+	if x != nil {
+		return x.Ack
+	}
+	return 0
+}
+
+var File_api_v1_log_proto protoreflect.FileDescriptor
+
+const file_api_v1_log_proto_rawDesc = "" +
+	"\n" +
+	"\x10api/v1/log.proto\x12\x06log.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\xe1\x02\n" +
+	"\x06Record\x12\x14\n" +
+	"\x05value\x18\x01 \x01(\fR\x05value\x12\x16\n" +
+	"\x06offset\x18\x02 \x01(\x04R\x06offset\x12\x12\n" +
+	"\x04term\x18\x03 \x01(\x04R\x04term\x12\x12\n" +
+	"\x04type\x18\x04 \x01(\rR\x04type\x125\n" +
+	"\aheaders\x18\x05 \x03(\v2\x1b.log.v1.Record.HeadersEntryR\aheaders\x125\n" +
+	"\vcompression\x18\x06 \x01(\x0e2\x13.log.v1.CompressionR\vcompression\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\a \x01(\tR\trequestId\x128\n" +
+	"\ttimestamp\x18\b \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x1a:\n" +
+	"\fHeadersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xba\x01\n" +
+	"\x0eProduceRequest\x12&\n" +
+	"\x06record\x18\x01 \x01(\v2\x0e.log.v1.RecordR\x06record\x12\x1f\n" +
+	"\vproducer_id\x18\x02 \x01(\tR\n" +
+	"producerId\x12\x1a\n" +
+	"\bsequence\x18\x03 \x01(\x04R\bsequence\x12 \n" +
+	"\x04acks\x18\x04 \x01(\x0e2\f.log.v1.AcksR\x04acks\x12!\n" +
+	"\fwait_durable\x18\x05 \x01(\bR\vwaitDurable\"\xa4\x01\n" +
+	"\x0fProduceResponse\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\x12\x18\n" +
+	"\adurable\x18\x02 \x01(\bR\adurable\x128\n" +
+	"\ttimestamp\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12%\n" +
+	"\x0eoffset_unknown\x18\x04 \x01(\bR\roffsetUnknown\"\x8e\x01\n" +
+	"\x0eConsumeRequest\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\x12'\n" +
+	"\x04mode\x18\x02 \x01(\x0e2\x13.log.v1.ConsumeModeR\x04mode\x12'\n" +
+	"\x0frelative_offset\x18\x03 \x01(\x12R\x0erelativeOffset\x12\x12\n" +
+	"\x04tail\x18\x04 \x01(\x04R\x04tail\"W\n" +
+	"\x0fConsumeResponse\x12&\n" +
+	"\x06record\x18\x02 \x01(\v2\x0e.log.v1.RecordR\x06record\x12\x1c\n" +
+	"\theartbeat\x18\x03 \x01(\bR\theartbeat\".\n" +
+	"\x12ConsumeManyRequest\x12\x18\n" +
+	"\aoffsets\x18\x01 \x03(\x04R\aoffsets\"F\n" +
+	"\x13ConsumeManyResponse\x12/\n" +
+	"\aresults\x18\x01 \x03(\v2\x15.log.v1.ConsumeResultR\aresults\"y\n" +
+	"\rConsumeResult\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\x12&\n" +
+	"\x06record\x18\x02 \x01(\v2\x0e.log.v1.RecordR\x06record\x12\x12\n" +
+	"\x04code\x18\x03 \x01(\x05R\x04code\x12\x14\n" +
+	"\x05error\x18\x04 \x01(\tR\x05error\"\x11\n" +
+	"\x0fGetStatsRequest\"\x83\x02\n" +
+	"\x10GetStatsResponse\x12\x1a\n" +
+	"\bsegments\x18\x01 \x01(\x04R\bsegments\x12\x1f\n" +
+	"\vtotal_bytes\x18\x02 \x01(\x04R\n" +
+	"totalBytes\x12\x18\n" +
+	"\arecords\x18\x03 \x01(\x04R\arecords\x120\n" +
+	"\x14active_segment_bytes\x18\x04 \x01(\x04R\x12activeSegmentBytes\x122\n" +
+	"\x06oldest\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\x06oldest\x122\n" +
+	"\x06newest\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\x06newest\"G\n" +
+	"\x11GetOffsetsRequest\x122\n" +
+	"\bposition\x18\x01 \x01(\x0e2\x16.log.v1.OffsetPositionR\bposition\"B\n" +
+	"\x12GetOffsetsResponse\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\x12\x14\n" +
+	"\x05empty\x18\x02 \x01(\bR\x05empty\"\x13\n" +
+	"\x11GetServersRequest\">\n" +
+	"\x12GetServersResponse\x12(\n" +
+	"\aservers\x18\x01 \x03(\v2\x0e.log.v1.ServerR\aservers\"f\n" +
+	"\x06Server\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x19\n" +
+	"\brpc_addr\x18\x02 \x01(\tR\arpcAddr\x12\x1b\n" +
+	"\tis_leader\x18\x03 \x01(\bR\bisLeader\x12\x14\n" +
+	"\x05voter\x18\x04 \x01(\bR\x05voter\"\x11\n" +
+	"\x0fSnapshotRequest\"\x12\n" +
+	"\x10SnapshotResponse\"C\n" +
+	"\x13CommitOffsetRequest\x12\x14\n" +
+	"\x05group\x18\x01 \x01(\tR\x05group\x12\x16\n" +
+	"\x06offset\x18\x02 \x01(\x04R\x06offset\"\x16\n" +
+	"\x14CommitOffsetResponse\"3\n" +
+	"\x1bFetchCommittedOffsetRequest\x12\x14\n" +
+	"\x05group\x18\x01 \x01(\tR\x05group\"L\n" +
+	"\x1cFetchCommittedOffsetResponse\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\x12\x14\n" +
+	"\x05found\x18\x02 \x01(\bR\x05found\"=\n" +
+	"\x13ConsumeGroupRequest\x12\x14\n" +
+	"\x05group\x18\x01 \x01(\tR\x05group\x12\x10\n" +
+	"\x03ack\x18\x02 \x01(\x04R\x03ack*5\n" +
+	"\vCompression\x12\x10\n" +
+	"\fUNCOMPRESSED\x10\x00\x12\b\n" +
+	"\x04GZIP\x10\x01\x12\n" +
+	"\n" +
+	"\x06SNAPPY\x10\x02*%\n" +
+	"\x04Acks\x12\n" +
+	"\n" +
+	"\x06LEADER\x10\x00\x12\a\n" +
+	"\x03ALL\x10\x01\x12\b\n" +
+	"\x04NONE\x10\x02*5\n" +
+	"\vConsumeMode\x12\n" +
+	"\n" +
+	"\x06FOLLOW\x10\x00\x12\x10\n" +
+	"\fUNTIL_LATEST\x10\x01\x12\b\n" +
+	"\x04TAIL\x10\x02**\n" +
+	"\x0eOffsetPosition\x12\f\n" +
+	"\bEARLIEST\x10\x00\x12\n" +
+	"\n" +
+	"\x06LATEST\x10\x012\xed\x06\n" +
+	"\x03Log\x12<\n" +
+	"\aProduce\x12\x16.log.v1.ProduceRequest\x1a\x17.log.v1.ProduceResponse\"\x00\x12<\n" +
+	"\aConsume\x12\x16.log.v1.ConsumeRequest\x1a\x17.log.v1.ConsumeResponse\"\x00\x12H\n" +
+	"\vConsumeMany\x12\x1a.log.v1.ConsumeManyRequest\x1a\x1b.log.v1.ConsumeManyResponse\"\x00\x12D\n" +
+	"\rConsumeStream\x12\x16.log.v1.ConsumeRequest\x1a\x17.log.v1.ConsumeResponse\"\x000\x01\x12F\n" +
+	"\rProduceStream\x12\x16.log.v1.ProduceRequest\x1a\x17.log.v1.ProduceResponse\"\x00(\x010\x01\x12?\n" +
+	"\bGetStats\x12\x17.log.v1.GetStatsRequest\x1a\x18.log.v1.GetStatsResponse\"\x00\x12E\n" +
+	"\n" +
+	"GetOffsets\x12\x19.log.v1.GetOffsetsRequest\x1a\x1a.log.v1.GetOffsetsResponse\"\x00\x12E\n" +
+	"\n" +
+	"GetServers\x12\x19.log.v1.GetServersRequest\x1a\x1a.log.v1.GetServersResponse\"\x00\x12?\n" +
+	"\bSnapshot\x12\x17.log.v1.SnapshotRequest\x1a\x18.log.v1.SnapshotResponse\"\x00\x12K\n" +
+	"\fCommitOffset\x12\x1b.log.v1.CommitOffsetRequest\x1a\x1c.log.v1.CommitOffsetResponse\"\x00\x12c\n" +
+	"\x14FetchCommittedOffset\x12#.log.v1.FetchCommittedOffsetRequest\x1a$.log.v1.FetchCommittedOffsetResponse\"\x00\x12P\n" +
+	"\x12ConsumeGroupStream\x12\x1b.log.v1.ConsumeGroupRequest\x1a\x17.log.v1.ConsumeResponse\"\x00(\x010\x01B'Z%github.com/mrshabel/gumlog/api/log_v1b\x06proto3"
 
 var (
 	file_api_v1_log_proto_rawDescOnce sync.Once
@@ -301,30 +1583,82 @@ func file_api_v1_log_proto_rawDescGZIP() []byte {
 	return file_api_v1_log_proto_rawDescData
 }
 
-var file_api_v1_log_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_api_v1_log_proto_enumTypes = make([]protoimpl.EnumInfo, 4)
+var file_api_v1_log_proto_msgTypes = make([]protoimpl.MessageInfo, 23)
 var file_api_v1_log_proto_goTypes = []any{
-	(*Record)(nil),          // 0: log.v1.Record
-	(*ProduceRequest)(nil),  // 1: log.v1.ProduceRequest
-	(*ProduceResponse)(nil), // 2: log.v1.ProduceResponse
-	(*ConsumeRequest)(nil),  // 3: log.v1.ConsumeRequest
-	(*ConsumeResponse)(nil), // 4: log.v1.ConsumeResponse
+	(Compression)(0),                     // 0: log.v1.Compression
+	(Acks)(0),                            // 1: log.v1.Acks
+	(ConsumeMode)(0),                     // 2: log.v1.ConsumeMode
+	(OffsetPosition)(0),                  // 3: log.v1.OffsetPosition
+	(*Record)(nil),                       // 4: log.v1.Record
+	(*ProduceRequest)(nil),               // 5: log.v1.ProduceRequest
+	(*ProduceResponse)(nil),              // 6: log.v1.ProduceResponse
+	(*ConsumeRequest)(nil),               // 7: log.v1.ConsumeRequest
+	(*ConsumeResponse)(nil),              // 8: log.v1.ConsumeResponse
+	(*ConsumeManyRequest)(nil),           // 9: log.v1.ConsumeManyRequest
+	(*ConsumeManyResponse)(nil),          // 10: log.v1.ConsumeManyResponse
+	(*ConsumeResult)(nil),                // 11: log.v1.ConsumeResult
+	(*GetStatsRequest)(nil),              // 12: log.v1.GetStatsRequest
+	(*GetStatsResponse)(nil),             // 13: log.v1.GetStatsResponse
+	(*GetOffsetsRequest)(nil),            // 14: log.v1.GetOffsetsRequest
+	(*GetOffsetsResponse)(nil),           // 15: log.v1.GetOffsetsResponse
+	(*GetServersRequest)(nil),            // 16: log.v1.GetServersRequest
+	(*GetServersResponse)(nil),           // 17: log.v1.GetServersResponse
+	(*Server)(nil),                       // 18: log.v1.Server
+	(*SnapshotRequest)(nil),              // 19: log.v1.SnapshotRequest
+	(*SnapshotResponse)(nil),             // 20: log.v1.SnapshotResponse
+	(*CommitOffsetRequest)(nil),          // 21: log.v1.CommitOffsetRequest
+	(*CommitOffsetResponse)(nil),         // 22: log.v1.CommitOffsetResponse
+	(*FetchCommittedOffsetRequest)(nil),  // 23: log.v1.FetchCommittedOffsetRequest
+	(*FetchCommittedOffsetResponse)(nil), // 24: log.v1.FetchCommittedOffsetResponse
+	(*ConsumeGroupRequest)(nil),          // 25: log.v1.ConsumeGroupRequest
+	nil,                                  // 26: log.v1.Record.HeadersEntry
+	(*timestamppb.Timestamp)(nil),        // 27: google.protobuf.Timestamp
 }
 var file_api_v1_log_proto_depIdxs = []int32{
-	0, // 0: log.v1.ProduceRequest.record:type_name -> log.v1.Record
-	0, // 1: log.v1.ConsumeResponse.record:type_name -> log.v1.Record
-	1, // 2: log.v1.Log.Produce:input_type -> log.v1.ProduceRequest
-	3, // 3: log.v1.Log.Consume:input_type -> log.v1.ConsumeRequest
-	3, // 4: log.v1.Log.ConsumeStream:input_type -> log.v1.ConsumeRequest
-	1, // 5: log.v1.Log.ProduceStream:input_type -> log.v1.ProduceRequest
-	2, // 6: log.v1.Log.Produce:output_type -> log.v1.ProduceResponse
-	4, // 7: log.v1.Log.Consume:output_type -> log.v1.ConsumeResponse
-	4, // 8: log.v1.Log.ConsumeStream:output_type -> log.v1.ConsumeResponse
-	2, // 9: log.v1.Log.ProduceStream:output_type -> log.v1.ProduceResponse
-	6, // [6:10] is the sub-list for method output_type
-	2, // [2:6] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	26, // 0: log.v1.Record.headers:type_name -> log.v1.Record.HeadersEntry
+	0,  // 1: log.v1.Record.compression:type_name -> log.v1.Compression
+	27, // 2: log.v1.Record.timestamp:type_name -> google.protobuf.Timestamp
+	4,  // 3: log.v1.ProduceRequest.record:type_name -> log.v1.Record
+	1,  // 4: log.v1.ProduceRequest.acks:type_name -> log.v1.Acks
+	27, // 5: log.v1.ProduceResponse.timestamp:type_name -> google.protobuf.Timestamp
+	2,  // 6: log.v1.ConsumeRequest.mode:type_name -> log.v1.ConsumeMode
+	4,  // 7: log.v1.ConsumeResponse.record:type_name -> log.v1.Record
+	11, // 8: log.v1.ConsumeManyResponse.results:type_name -> log.v1.ConsumeResult
+	4,  // 9: log.v1.ConsumeResult.record:type_name -> log.v1.Record
+	27, // 10: log.v1.GetStatsResponse.oldest:type_name -> google.protobuf.Timestamp
+	27, // 11: log.v1.GetStatsResponse.newest:type_name -> google.protobuf.Timestamp
+	3,  // 12: log.v1.GetOffsetsRequest.position:type_name -> log.v1.OffsetPosition
+	18, // 13: log.v1.GetServersResponse.servers:type_name -> log.v1.Server
+	5,  // 14: log.v1.Log.Produce:input_type -> log.v1.ProduceRequest
+	7,  // 15: log.v1.Log.Consume:input_type -> log.v1.ConsumeRequest
+	9,  // 16: log.v1.Log.ConsumeMany:input_type -> log.v1.ConsumeManyRequest
+	7,  // 17: log.v1.Log.ConsumeStream:input_type -> log.v1.ConsumeRequest
+	5,  // 18: log.v1.Log.ProduceStream:input_type -> log.v1.ProduceRequest
+	12, // 19: log.v1.Log.GetStats:input_type -> log.v1.GetStatsRequest
+	14, // 20: log.v1.Log.GetOffsets:input_type -> log.v1.GetOffsetsRequest
+	16, // 21: log.v1.Log.GetServers:input_type -> log.v1.GetServersRequest
+	19, // 22: log.v1.Log.Snapshot:input_type -> log.v1.SnapshotRequest
+	21, // 23: log.v1.Log.CommitOffset:input_type -> log.v1.CommitOffsetRequest
+	23, // 24: log.v1.Log.FetchCommittedOffset:input_type -> log.v1.FetchCommittedOffsetRequest
+	25, // 25: log.v1.Log.ConsumeGroupStream:input_type -> log.v1.ConsumeGroupRequest
+	6,  // 26: log.v1.Log.Produce:output_type -> log.v1.ProduceResponse
+	8,  // 27: log.v1.Log.Consume:output_type -> log.v1.ConsumeResponse
+	10, // 28: log.v1.Log.ConsumeMany:output_type -> log.v1.ConsumeManyResponse
+	8,  // 29: log.v1.Log.ConsumeStream:output_type -> log.v1.ConsumeResponse
+	6,  // 30: log.v1.Log.ProduceStream:output_type -> log.v1.ProduceResponse
+	13, // 31: log.v1.Log.GetStats:output_type -> log.v1.GetStatsResponse
+	15, // 32: log.v1.Log.GetOffsets:output_type -> log.v1.GetOffsetsResponse
+	17, // 33: log.v1.Log.GetServers:output_type -> log.v1.GetServersResponse
+	20, // 34: log.v1.Log.Snapshot:output_type -> log.v1.SnapshotResponse
+	22, // 35: log.v1.Log.CommitOffset:output_type -> log.v1.CommitOffsetResponse
+	24, // 36: log.v1.Log.FetchCommittedOffset:output_type -> log.v1.FetchCommittedOffsetResponse
+	8,  // 37: log.v1.Log.ConsumeGroupStream:output_type -> log.v1.ConsumeResponse
+	26, // [26:38] is the sub-list for method output_type
+	14, // [14:26] is the sub-list for method input_type
+	14, // [14:14] is the sub-list for extension type_name
+	14, // [14:14] is the sub-list for extension extendee
+	0,  // [0:14] is the sub-list for field type_name
 }
 
 func init() { file_api_v1_log_proto_init() }
@@ -337,13 +1671,14 @@ func file_api_v1_log_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_v1_log_proto_rawDesc), len(file_api_v1_log_proto_rawDesc)),
-			NumEnums:      0,
-			NumMessages:   5,
+			NumEnums:      4,
+			NumMessages:   23,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_api_v1_log_proto_goTypes,
 		DependencyIndexes: file_api_v1_log_proto_depIdxs,
+		EnumInfos:         file_api_v1_log_proto_enumTypes,
 		MessageInfos:      file_api_v1_log_proto_msgTypes,
 	}.Build()
 	File_api_v1_log_proto = out.File
@@ -19,10 +19,18 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	Log_Produce_FullMethodName       = "/log.v1.Log/Produce"
-	Log_Consume_FullMethodName       = "/log.v1.Log/Consume"
-	Log_ConsumeStream_FullMethodName = "/log.v1.Log/ConsumeStream"
-	Log_ProduceStream_FullMethodName = "/log.v1.Log/ProduceStream"
+	Log_Produce_FullMethodName              = "/log.v1.Log/Produce"
+	Log_Consume_FullMethodName              = "/log.v1.Log/Consume"
+	Log_ConsumeMany_FullMethodName          = "/log.v1.Log/ConsumeMany"
+	Log_ConsumeStream_FullMethodName        = "/log.v1.Log/ConsumeStream"
+	Log_ProduceStream_FullMethodName        = "/log.v1.Log/ProduceStream"
+	Log_GetStats_FullMethodName             = "/log.v1.Log/GetStats"
+	Log_GetOffsets_FullMethodName           = "/log.v1.Log/GetOffsets"
+	Log_GetServers_FullMethodName           = "/log.v1.Log/GetServers"
+	Log_Snapshot_FullMethodName             = "/log.v1.Log/Snapshot"
+	Log_CommitOffset_FullMethodName         = "/log.v1.Log/CommitOffset"
+	Log_FetchCommittedOffset_FullMethodName = "/log.v1.Log/FetchCommittedOffset"
+	Log_ConsumeGroupStream_FullMethodName   = "/log.v1.Log/ConsumeGroupStream"
 )
 
 // LogClient is the client API for Log service.
@@ -33,10 +41,27 @@ const (
 type LogClient interface {
 	Produce(ctx context.Context, in *ProduceRequest, opts ...grpc.CallOption) (*ProduceResponse, error)
 	Consume(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (*ConsumeResponse, error)
+	// read a set of records by their offsets at once
+	ConsumeMany(ctx context.Context, in *ConsumeManyRequest, opts ...grpc.CallOption) (*ConsumeManyResponse, error)
 	// uni-directional server-side streaming
 	ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ConsumeResponse], error)
 	// bi-directional streaming RPC using read-write stream
 	ProduceStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ProduceRequest, ProduceResponse], error)
+	// size and content statistics of the log
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*GetStatsResponse, error)
+	// offset at the start or end of the log
+	GetOffsets(ctx context.Context, in *GetOffsetsRequest, opts ...grpc.CallOption) (*GetOffsetsResponse, error)
+	// members of the cluster
+	GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error)
+	// take a snapshot of the replicated log on the leader
+	Snapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*SnapshotResponse, error)
+	// offsets consumer groups resume from. the log is the only topic, so
+	// offsets are kept per group
+	CommitOffset(ctx context.Context, in *CommitOffsetRequest, opts ...grpc.CallOption) (*CommitOffsetResponse, error)
+	FetchCommittedOffset(ctx context.Context, in *FetchCommittedOffsetRequest, opts ...grpc.CallOption) (*FetchCommittedOffsetResponse, error)
+	// stream records to a consumer group from its committed offset. the
+	// client acks processed records on the same stream to commit them
+	ConsumeGroupStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ConsumeGroupRequest, ConsumeResponse], error)
 }
 
 type logClient struct {
@@ -67,6 +92,16 @@ func (c *logClient) Consume(ctx context.Context, in *ConsumeRequest, opts ...grp
 	return out, nil
 }
 
+func (c *logClient) ConsumeMany(ctx context.Context, in *ConsumeManyRequest, opts ...grpc.CallOption) (*ConsumeManyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ConsumeManyResponse)
+	err := c.cc.Invoke(ctx, Log_ConsumeMany_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *logClient) ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ConsumeResponse], error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	stream, err := c.cc.NewStream(ctx, &Log_ServiceDesc.Streams[0], Log_ConsumeStream_FullMethodName, cOpts...)
@@ -99,6 +134,79 @@ func (c *logClient) ProduceStream(ctx context.Context, opts ...grpc.CallOption)
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type Log_ProduceStreamClient = grpc.BidiStreamingClient[ProduceRequest, ProduceResponse]
 
+func (c *logClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*GetStatsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetStatsResponse)
+	err := c.cc.Invoke(ctx, Log_GetStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) GetOffsets(ctx context.Context, in *GetOffsetsRequest, opts ...grpc.CallOption) (*GetOffsetsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetOffsetsResponse)
+	err := c.cc.Invoke(ctx, Log_GetOffsets_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetServersResponse)
+	err := c.cc.Invoke(ctx, Log_GetServers_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) Snapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*SnapshotResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SnapshotResponse)
+	err := c.cc.Invoke(ctx, Log_Snapshot_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) CommitOffset(ctx context.Context, in *CommitOffsetRequest, opts ...grpc.CallOption) (*CommitOffsetResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CommitOffsetResponse)
+	err := c.cc.Invoke(ctx, Log_CommitOffset_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) FetchCommittedOffset(ctx context.Context, in *FetchCommittedOffsetRequest, opts ...grpc.CallOption) (*FetchCommittedOffsetResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FetchCommittedOffsetResponse)
+	err := c.cc.Invoke(ctx, Log_FetchCommittedOffset_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) ConsumeGroupStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ConsumeGroupRequest, ConsumeResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Log_ServiceDesc.Streams[2], Log_ConsumeGroupStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ConsumeGroupRequest, ConsumeResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Log_ConsumeGroupStreamClient = grpc.BidiStreamingClient[ConsumeGroupRequest, ConsumeResponse]
+
 // LogServer is the server API for Log service.
 // All implementations must embed UnimplementedLogServer
 // for forward compatibility.
@@ -107,10 +215,27 @@ type Log_ProduceStreamClient = grpc.BidiStreamingClient[ProduceRequest, ProduceR
 type LogServer interface {
 	Produce(context.Context, *ProduceRequest) (*ProduceResponse, error)
 	Consume(context.Context, *ConsumeRequest) (*ConsumeResponse, error)
+	// read a set of records by their offsets at once
+	ConsumeMany(context.Context, *ConsumeManyRequest) (*ConsumeManyResponse, error)
 	// uni-directional server-side streaming
 	ConsumeStream(*ConsumeRequest, grpc.ServerStreamingServer[ConsumeResponse]) error
 	// bi-directional streaming RPC using read-write stream
 	ProduceStream(grpc.BidiStreamingServer[ProduceRequest, ProduceResponse]) error
+	// size and content statistics of the log
+	GetStats(context.Context, *GetStatsRequest) (*GetStatsResponse, error)
+	// offset at the start or end of the log
+	GetOffsets(context.Context, *GetOffsetsRequest) (*GetOffsetsResponse, error)
+	// members of the cluster
+	GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error)
+	// take a snapshot of the replicated log on the leader
+	Snapshot(context.Context, *SnapshotRequest) (*SnapshotResponse, error)
+	// offsets consumer groups resume from. the log is the only topic, so
+	// offsets are kept per group
+	CommitOffset(context.Context, *CommitOffsetRequest) (*CommitOffsetResponse, error)
+	FetchCommittedOffset(context.Context, *FetchCommittedOffsetRequest) (*FetchCommittedOffsetResponse, error)
+	// stream records to a consumer group from its committed offset. the
+	// client acks processed records on the same stream to commit them
+	ConsumeGroupStream(grpc.BidiStreamingServer[ConsumeGroupRequest, ConsumeResponse]) error
 	mustEmbedUnimplementedLogServer()
 }
 
@@ -127,12 +252,36 @@ func (UnimplementedLogServer) Produce(context.Context, *ProduceRequest) (*Produc
 func (UnimplementedLogServer) Consume(context.Context, *ConsumeRequest) (*ConsumeResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Consume not implemented")
 }
+func (UnimplementedLogServer) ConsumeMany(context.Context, *ConsumeManyRequest) (*ConsumeManyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ConsumeMany not implemented")
+}
 func (UnimplementedLogServer) ConsumeStream(*ConsumeRequest, grpc.ServerStreamingServer[ConsumeResponse]) error {
 	return status.Errorf(codes.Unimplemented, "method ConsumeStream not implemented")
 }
 func (UnimplementedLogServer) ProduceStream(grpc.BidiStreamingServer[ProduceRequest, ProduceResponse]) error {
 	return status.Errorf(codes.Unimplemented, "method ProduceStream not implemented")
 }
+func (UnimplementedLogServer) GetStats(context.Context, *GetStatsRequest) (*GetStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedLogServer) GetOffsets(context.Context, *GetOffsetsRequest) (*GetOffsetsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetOffsets not implemented")
+}
+func (UnimplementedLogServer) GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetServers not implemented")
+}
+func (UnimplementedLogServer) Snapshot(context.Context, *SnapshotRequest) (*SnapshotResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Snapshot not implemented")
+}
+func (UnimplementedLogServer) CommitOffset(context.Context, *CommitOffsetRequest) (*CommitOffsetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CommitOffset not implemented")
+}
+func (UnimplementedLogServer) FetchCommittedOffset(context.Context, *FetchCommittedOffsetRequest) (*FetchCommittedOffsetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FetchCommittedOffset not implemented")
+}
+func (UnimplementedLogServer) ConsumeGroupStream(grpc.BidiStreamingServer[ConsumeGroupRequest, ConsumeResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ConsumeGroupStream not implemented")
+}
 func (UnimplementedLogServer) mustEmbedUnimplementedLogServer() {}
 func (UnimplementedLogServer) testEmbeddedByValue()             {}
 
@@ -190,6 +339,24 @@ func _Log_Consume_Handler(srv interface{}, ctx context.Context, dec func(interfa
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Log_ConsumeMany_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConsumeManyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).ConsumeMany(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Log_ConsumeMany_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).ConsumeMany(ctx, req.(*ConsumeManyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Log_ConsumeStream_Handler(srv interface{}, stream grpc.ServerStream) error {
 	m := new(ConsumeRequest)
 	if err := stream.RecvMsg(m); err != nil {
@@ -208,6 +375,121 @@ func _Log_ProduceStream_Handler(srv interface{}, stream grpc.ServerStream) error
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type Log_ProduceStreamServer = grpc.BidiStreamingServer[ProduceRequest, ProduceResponse]
 
+func _Log_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Log_GetStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_GetOffsets_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetOffsetsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetOffsets(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Log_GetOffsets_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetOffsets(ctx, req.(*GetOffsetsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_GetServers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetServersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetServers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Log_GetServers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetServers(ctx, req.(*GetServersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_Snapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).Snapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Log_Snapshot_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).Snapshot(ctx, req.(*SnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_CommitOffset_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CommitOffsetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).CommitOffset(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Log_CommitOffset_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).CommitOffset(ctx, req.(*CommitOffsetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_FetchCommittedOffset_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FetchCommittedOffsetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).FetchCommittedOffset(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Log_FetchCommittedOffset_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).FetchCommittedOffset(ctx, req.(*FetchCommittedOffsetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_ConsumeGroupStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LogServer).ConsumeGroupStream(&grpc.GenericServerStream[ConsumeGroupRequest, ConsumeResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Log_ConsumeGroupStreamServer = grpc.BidiStreamingServer[ConsumeGroupRequest, ConsumeResponse]
+
 // Log_ServiceDesc is the grpc.ServiceDesc for Log service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -223,6 +505,34 @@ var Log_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Consume",
 			Handler:    _Log_Consume_Handler,
 		},
+		{
+			MethodName: "ConsumeMany",
+			Handler:    _Log_ConsumeMany_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _Log_GetStats_Handler,
+		},
+		{
+			MethodName: "GetOffsets",
+			Handler:    _Log_GetOffsets_Handler,
+		},
+		{
+			MethodName: "GetServers",
+			Handler:    _Log_GetServers_Handler,
+		},
+		{
+			MethodName: "Snapshot",
+			Handler:    _Log_Snapshot_Handler,
+		},
+		{
+			MethodName: "CommitOffset",
+			Handler:    _Log_CommitOffset_Handler,
+		},
+		{
+			MethodName: "FetchCommittedOffset",
+			Handler:    _Log_FetchCommittedOffset_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -236,6 +546,12 @@ var Log_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "ConsumeGroupStream",
+			Handler:       _Log_ConsumeGroupStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "api/v1/log.proto",
 }
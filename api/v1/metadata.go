@@ -0,0 +1,12 @@
+package log_v1
+
+// RequestIDKey is the grpc metadata key a request's id is sent under. servers
+// generate an id for requests without one and stamp it on produced records, so
+// that a record can be traced through replication
+const RequestIDKey = "x-request-id"
+
+// ReplicatedKey is the grpc metadata key marking a produce request as
+// replicating records from another server. the records keep the timestamps
+// they were stored with rather than being stamped again, provided the acl
+// allows the client the replicate action
+const ReplicatedKey = "x-replicated"
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mrshabel/gumlog/internal/log"
+)
+
+const usage = "usage: gumlog verify <log dir>"
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "verify":
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		os.Exit(verify(os.Args[2]))
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// scan the log in the given directory for corrupted records without
+// modifying it. returns the process exit code
+func verify(dir string) int {
+	l, err := log.NewLog(dir, log.Config{ReadOnly: true})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "open log: %v\n", err)
+		return 1
+	}
+	defer l.Close()
+
+	errs, err := l.Verify()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify log: %v\n", err)
+		return 1
+	}
+	for _, e := range errs {
+		fmt.Println(e.Error())
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%d corrupted records\n", len(errs))
+		return 1
+	}
+	return 0
+}
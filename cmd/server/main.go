@@ -1,12 +1,49 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"net"
 
+	commitlog "github.com/mrshabel/gumlog/internal/log"
 	"github.com/mrshabel/gumlog/internal/server"
 )
 
 func main() {
-	srv := server.NewHTTPServer(":8000")
+	addr := flag.String("addr", ":8000", "address of the http server")
+	insecureGRPCAddr := flag.String("insecure-grpc-addr", "",
+		"also serve the log over grpc on this address without tls or access control. for local development only")
+	dir := flag.String("dir", "", "directory of the grpc server's log")
+	flag.Parse()
+
+	if *insecureGRPCAddr != "" {
+		go serveInsecureGRPC(*insecureGRPCAddr, *dir)
+	}
+	srv := server.NewHTTPServer(*addr)
 	log.Fatal(srv.ListenAndServe())
 }
+
+// serve a log in the given directory over grpc without authentication
+func serveInsecureGRPC(addr, dir string) {
+	if dir == "" {
+		log.Fatal("-dir is required with -insecure-grpc-addr")
+	}
+	l, err := commitlog.NewLog(dir, commitlog.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:    l,
+		StatsGetter:  l,
+		OffsetGetter: l,
+		Insecure:     true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(srv.Serve(ln))
+}
@@ -2,16 +2,27 @@ package agent
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	api "github.com/mrshabel/gumlog/api/v1"
 	"github.com/mrshabel/gumlog/internal/auth"
+	"github.com/mrshabel/gumlog/internal/client"
 	"github.com/mrshabel/gumlog/internal/discovery"
 	"github.com/mrshabel/gumlog/internal/log"
+	"github.com/mrshabel/gumlog/internal/mux"
 	"github.com/mrshabel/gumlog/internal/server"
 
+	"go.opencensus.io/stats/view"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -26,6 +37,14 @@ type Agent struct {
 	server     *grpc.Server
 	membership *discovery.Membership
 	replicator *log.Replicator
+	// the replicator's client of the local server
+	local *client.Client
+	// shares the rpc port between grpc and the probes
+	mux *mux.Mux
+	// serves the liveness and readiness probes
+	http *http.Server
+	// set once every component is set up
+	setUp atomic.Bool
 
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -39,10 +58,41 @@ type Config struct {
 	DataDir         string
 	BindAddr        string
 	RPCPort         int
-	NodeName        string
-	StartJoinAddrs  []string
-	ACLModelFile    string
-	ACLPolicyFile   string
+	// port on the bind address host serving http liveness and readiness
+	// probes at /healthz and /readyz, and metrics at /metrics. zero disables
+	// them, while the rpc port serves them alongside grpc
+	HTTPPort       int
+	NodeName       string
+	StartJoinAddrs []string
+	// fail to start when none of the StartJoinAddrs can be joined instead of
+	// running alone and joining once they are reachable
+	RequireJoin bool
+	// key encrypting gossip between the agents. see discovery.Config
+	EncryptKey    []byte
+	ACLModelFile  string
+	ACLPolicyFile string
+	// maximum time to wait on shutdown for peers to be told about the agent
+	// leaving the cluster. defaults to 5s
+	LeaveTimeout time.Duration
+	// advertise the agent as a non-voter to the cluster. only a
+	// DistributedLog counts votes, adding non-voters without one. the agent
+	// replicates through a Replicator, which treats voters and non-voters
+	// alike, so the flag is only reported by GetServers
+	NonVoter bool
+	// start as the leader of the cluster. leaders replicate nothing from
+	// their peers, which would append the records the peers replicated from
+	// them back to their log. see Agent.SetLeader
+	Leader bool
+	// store produced records with the id of the request that produced them,
+	// so that replicating agents log the same id. see server.Config
+	RecordRequestIDs bool
+	// segment sizing for the log. the log defaults apply when unset
+	MaxStoreBytes uint64
+	MaxIndexBytes uint64
+	InitialOffset uint64
+	// logger every component logs to. when unset, a development logger is
+	// created and replaces the global logger
+	Logger *zap.Logger
 }
 
 // RPCAddr returns the RPC address from the binding address and the configured RPC port. A non-nil error is returned if the BindAddr is invalid
@@ -54,50 +104,266 @@ func (c *Config) RPCAddr() (string, error) {
 	return fmt.Sprintf("%s:%d", host, c.RPCPort), nil
 }
 
+// HTTPAddr returns the address of the probes from the binding address and the
+// configured HTTP port
+func (c *Config) HTTPAddr() (string, error) {
+	host, _, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d", host, c.HTTPPort), nil
+}
+
+// validate checks the config before any component is started so that a
+// misconfigured agent fails with a descriptive error
+func (c *Config) validate() error {
+	_, port, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return fmt.Errorf("invalid bind address %q: %w", c.BindAddr, err)
+	}
+	bindPort, err := strconv.Atoi(port)
+	if err != nil || bindPort < 1 || bindPort > 65535 {
+		return fmt.Errorf("invalid bind address %q: port must be between 1 and 65535", c.BindAddr)
+	}
+	if c.RPCPort < 1 || c.RPCPort > 65535 {
+		return fmt.Errorf("invalid rpc port %d: must be between 1 and 65535", c.RPCPort)
+	}
+	if bindPort == c.RPCPort {
+		return fmt.Errorf("bind address %q and rpc port %d must use different ports", c.BindAddr, c.RPCPort)
+	}
+	if c.HTTPPort != 0 {
+		if c.HTTPPort < 1 || c.HTTPPort > 65535 {
+			return fmt.Errorf("invalid http port %d: must be between 1 and 65535", c.HTTPPort)
+		}
+		if c.HTTPPort == bindPort {
+			return fmt.Errorf("http port %d must differ from the bind port", c.HTTPPort)
+		}
+	}
+	for name, file := range map[string]string{
+		"acl model":  c.ACLModelFile,
+		"acl policy": c.ACLPolicyFile,
+	} {
+		if file == "" {
+			return fmt.Errorf("%s file is required", name)
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("%s file: %w", name, err)
+		}
+	}
+	return nil
+}
+
 // New creates and sets up an agent together with its components as defined in the config argument. Calling New starts up a running, functioning service. The created agent is returned if no error occurs else a non-nil error is returned
 func New(config Config) (*Agent, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config.LeaveTimeout == 0 {
+		config.LeaveTimeout = 5 * time.Second
+	}
 	agent := &Agent{
 		Config:    config,
 		shutdowns: make(chan struct{}),
 	}
 
-	// set up all components
+	// set up all components. the probes are served first so that the agent
+	// is reported live but not ready while the rest is set up
 	setup := []func() error{
 		agent.setupLogger,
+		agent.setupMux,
+		agent.setupHTTP,
 		agent.setupLog,
-		agent.setupServer,
+		// the server serves the membership's view of the cluster
 		agent.setupMembership,
+		agent.setupServer,
 	}
 	for _, fn := range setup {
 		if err := fn(); err != nil {
+			// stop gossiping so the bind address is released and replication
+			// stops. the agent never served so there is nothing to hand off
+			if agent.membership != nil {
+				agent.membership.Shutdown()
+			}
+			if agent.replicator != nil {
+				agent.replicator.Close()
+			}
+			if agent.local != nil {
+				agent.local.Close()
+			}
+			if agent.http != nil {
+				agent.http.Close()
+			}
+			if agent.mux != nil {
+				agent.mux.Close()
+			}
+			if agent.log != nil {
+				agent.log.Close()
+			}
 			return nil, err
 		}
 	}
+	agent.setUp.Store(true)
 	return agent, nil
 }
 
 func (a *Agent) setupLogger() error {
+	// embedders bring their own logger
+	if a.Config.Logger != nil {
+		return nil
+	}
 	// start a new development logger
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		return err
 	}
 	zap.ReplaceGlobals(logger)
+	a.Config.Logger = logger
+	return nil
+}
+
+// setupMux listens on the rpc port, matching plaintext http requests to the
+// probes when they share the port and every other connection to grpc
+func (a *Agent) setupMux() error {
+	rpcAddr, err := a.Config.RPCAddr()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		return err
+	}
+	a.mux = mux.New(ln)
+	go a.mux.Serve()
+	return nil
+}
+
+// setupHTTP serves the liveness and readiness probes when an http port is
+// configured. the agent is live while the process runs and ready once its
+// components are set up and it has joined the cluster
+func (a *Agent) setupHTTP() error {
+	if a.Config.HTTPPort == 0 {
+		return nil
+	}
+	var ln net.Listener
+	if a.Config.HTTPPort == a.Config.RPCPort {
+		ln = a.mux.Match(mux.HTTP1())
+	} else {
+		addr, err := a.Config.HTTPAddr()
+		if err != nil {
+			return err
+		}
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return err
+		}
+	}
+	handler := http.NewServeMux()
+	handler.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	handler.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := a.ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	if err := view.Register(metricsViews...); err != nil {
+		return err
+	}
+	handler.HandleFunc("/metrics", serveMetrics)
+	a.http = &http.Server{Handler: handler}
+	go a.http.Serve(ln)
+	return nil
+}
+
+// views served at /metrics
+var metricsViews = []*view.View{
+	log.SegmentRollsView,
+	log.SnapshotsView,
+	log.ReplicationLagView,
+}
+
+// write the rows of the metrics views in the prometheus text format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, v := range metricsViews {
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		name := strings.NewReplacer("/", "_", ".", "_").Replace(v.Name)
+		lines := make([]string, 0, len(rows))
+		for _, row := range rows {
+			labels := make([]string, 0, len(row.Tags))
+			for _, t := range row.Tags {
+				labels = append(labels, fmt.Sprintf("%s=%q", t.Key.Name(), t.Value))
+			}
+			var value float64
+			switch data := row.Data.(type) {
+			case *view.CountData:
+				value = float64(data.Value)
+			case *view.SumData:
+				value = data.Value
+			case *view.LastValueData:
+				value = data.Value
+			}
+			lines = append(lines, fmt.Sprintf("%s{%s} %g", name, strings.Join(labels, ","), value))
+		}
+		sort.Strings(lines)
+		fmt.Fprintf(w, "# HELP %s %s\n", name, v.Description)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// report why the agent can't serve requests yet, if it can't
+func (a *Agent) ready() error {
+	select {
+	case <-a.shutdowns:
+		return errors.New("agent is shutting down")
+	default:
+	}
+	switch {
+	case !a.setUp.Load():
+		return errors.New("agent is starting")
+	case !a.membership.Joined():
+		return errors.New("agent hasn't joined the cluster")
+	}
 	return nil
 }
 
 func (a *Agent) setupLog() error {
+	logConfig := log.Config{}
+	logConfig.Segment.MaxStoreBytes = a.Config.MaxStoreBytes
+	logConfig.Segment.MaxIndexBytes = a.Config.MaxIndexBytes
+	logConfig.Segment.InitialOffset = a.Config.InitialOffset
 	var err error
-	a.log, err = log.NewLog(a.Config.DataDir, log.Config{})
+	a.log, err = log.NewLog(a.Config.DataDir, logConfig)
 	return err
 }
 
 func (a *Agent) setupServer() error {
 	// setup server with authorization policies
-	authorizer := auth.New(a.Config.ACLModelFile, a.Config.ACLPolicyFile)
+	authorizer, err := auth.New(a.Config.ACLModelFile, a.Config.ACLPolicyFile, auth.WithLogger(a.Config.Logger.Named("auth")))
+	if err != nil {
+		return err
+	}
+	// offsets committed by consumer groups are kept next to the log
+	groupOffsets, err := log.NewOffsetStore(filepath.Join(a.Config.DataDir, "group-offsets.json"))
+	if err != nil {
+		return err
+	}
 	serverConfig := &server.Config{
-		CommitLog:  a.log,
-		Authorizer: authorizer,
+		CommitLog:        a.log,
+		Authorizer:       authorizer,
+		StatsGetter:      a.log,
+		OffsetGetter:     a.log,
+		ServerGetter:     a.membership,
+		GroupOffsets:     groupOffsets,
+		Logger:           a.Config.Logger,
+		RecordRequestIDs: a.Config.RecordRequestIDs,
 	}
 
 	// setup grpc server
@@ -106,19 +372,11 @@ func (a *Agent) setupServer() error {
 		creds := credentials.NewTLS(a.Config.ServerTLSConfig)
 		opts = append(opts, grpc.Creds(creds))
 	}
-	var err error
 	if a.server, err = server.NewGRPCServer(serverConfig, opts...); err != nil {
 		return err
 	}
-	rpcAddr, err := a.Config.RPCAddr()
-	if err != nil {
-		return err
-	}
-
-	ln, err := net.Listen("tcp", rpcAddr)
-	if err != nil {
-		return err
-	}
+	// grpc takes the connections no other protocol on the port matches
+	ln := a.mux.Match(mux.Any())
 	// setup grpc server listener in the background
 	go func() {
 		if err := a.server.Serve(ln); err != nil {
@@ -141,28 +399,67 @@ func (a *Agent) setupMembership() error {
 	if a.Config.PeerTLSConfig != nil {
 		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(a.Config.PeerTLSConfig)))
 	}
-	conn, err := grpc.NewClient(rpcAddr, opts...)
+	a.local, err = client.Dial(rpcAddr, opts...)
 	if err != nil {
 		return err
 	}
-	client := api.NewLogClient(conn)
 	a.replicator = &log.Replicator{
 		DialOptions: opts,
-		LocalServer: client,
+		LocalServer: a.local.Log(),
+		Logger:      a.Config.Logger,
 	}
+	// pause replication before any member joins
+	a.replicator.SetLeader(a.Config.Leader)
 	// create new discovery membership for client
 	a.membership, err = discovery.New(a.replicator, discovery.Config{
 		NodeName: a.Config.NodeName,
 		BindAddr: a.Config.BindAddr,
 		Tags: map[string]string{
 			"rpc_addr": rpcAddr,
+			"voter":    strconv.FormatBool(!a.Config.NonVoter),
+			"leader":   strconv.FormatBool(a.Config.Leader),
 		},
 		StartJoinAddrs: a.Config.StartJoinAddrs,
+		RequireJoin:    a.Config.RequireJoin,
+		EncryptKey:     a.Config.EncryptKey,
+		Logger:         a.Config.Logger,
 	},
 	)
 	return err
 }
 
+// SetLeader hands the leadership of the cluster to or from the agent. the
+// agent stops replicating from its peers while it leads and resumes once it
+// follows again. the change is gossiped to the cluster
+func (a *Agent) SetLeader(leader bool) error {
+	a.replicator.SetLeader(leader)
+	return a.membership.SetTag("leader", strconv.FormatBool(leader))
+}
+
+// WaitForReplication blocks until the local log holds the record at the given
+// offset, or fails once the timeout elapses
+func (a *Agent) WaitForReplication(offset uint64, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		// an empty log also reports 0 as its highest offset, so the record
+		// itself must be readable
+		if highest, err := a.log.HighestOffset(); err == nil && highest >= offset {
+			if _, err := a.log.Read(offset); err == nil {
+				return nil
+			}
+		}
+		select {
+		case <-deadline:
+			return fmt.Errorf("timed out after %s waiting for offset %d to be replicated", timeout, offset)
+		case <-a.shutdowns:
+			return fmt.Errorf("agent shut down waiting for offset %d to be replicated", offset)
+		case <-ticker.C:
+		}
+	}
+}
+
 // Shutdown shutdowns an agent and its components once with a mutex
 func (a *Agent) Shutdown() error {
 	a.shutdownLock.Lock()
@@ -178,16 +475,33 @@ func (a *Agent) Shutdown() error {
 		a.server.GracefulStop()
 		return nil
 	}
+	leave := func() error {
+		return a.membership.LeaveWithTimeout(a.Config.LeaveTimeout)
+	}
+	closeMux := func() error {
+		return a.mux.Close()
+	}
+	closeHTTP := func() error {
+		if a.http == nil {
+			return nil
+		}
+		return a.http.Close()
+	}
 	shutdown := []func() error{
-		a.membership.Leave, a.replicator.Close,
+		leave, a.replicator.Close, a.local.Close,
 		stopServer,
+		closeMux,
 		a.log.Close,
+		closeHTTP,
 	}
 
+	// run every step even once one fails. the agent can't be shut down
+	// again, so skipping the rest would leave the log unflushed
+	var errs []error
 	for _, fn := range shutdown {
 		if err := fn(); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
@@ -1,46 +1,37 @@
 package agent_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
 	api "github.com/mrshabel/gumlog/api/v1"
 	"github.com/mrshabel/gumlog/internal/agent"
+	logclient "github.com/mrshabel/gumlog/internal/client"
 	"github.com/mrshabel/gumlog/internal/config"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc/metadata"
 )
 
 func TestAgent(t *testing.T) {
-	// setup server tls certs and peer certs
-	// server tls config will be sent to clients
-	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		CertFile:      config.ServerCertFile,
-		KeyFile:       config.ServerKeyFile,
-		CAFile:        config.CAFile,
-		Server:        true,
-		ServerAddress: "127.0.0.1",
-	})
-	require.NoError(t, err)
-
-	// peer tls config will be shared between servers for replication purposes
-	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		CertFile:      config.RootClientCertFile,
-		KeyFile:       config.RootClientKeyFile,
-		CAFile:        config.CAFile,
-		Server:        false,
-		ServerAddress: "127.0.0.1",
-	})
-	require.NoError(t, err)
+	files := configFiles(t)
+	serverTLSConfig, peerTLSConfig := setupTLS(t)
 
 	// setup cluster of 3 nodes acting as replication agents
 	var agents []*agent.Agent
+	var logs []*observer.ObservedLogs
 	for i := range 3 {
 		// get 2 random ports without listener for testing
 		ports := dynaport.Get(2)
@@ -56,16 +47,21 @@ func TestAgent(t *testing.T) {
 			startJoinAddrs = append(startJoinAddrs, agents[0].Config.BindAddr)
 		}
 
+		core, observed := observer.New(zapcore.InfoLevel)
+		logs = append(logs, observed)
 		agent, err := agent.New(agent.Config{
+			Logger:          zap.New(core),
 			NodeName:        fmt.Sprint(i),
 			StartJoinAddrs:  startJoinAddrs,
 			BindAddr:        bindAddr,
 			RPCPort:         rpcPort,
 			DataDir:         dataDir,
-			ACLModelFile:    config.ACLModelFile,
-			ACLPolicyFile:   config.ACLPolicyFile,
+			ACLModelFile:    files.ACLModelFile,
+			ACLPolicyFile:   files.ACLPolicyFile,
 			ServerTLSConfig: serverTLSConfig,
 			PeerTLSConfig:   peerTLSConfig,
+			// trace replication under the id of the original request
+			RecordRequestIDs: true,
 		})
 		require.NoError(t, err)
 
@@ -85,7 +81,9 @@ func TestAgent(t *testing.T) {
 	dummy := []byte("dummy")
 	// leader node for writes
 	leaderClient := client(t, agents[0], peerTLSConfig)
-	produceResponse, err := leaderClient.Produce(context.Background(), &api.ProduceRequest{
+	requestID := "agent-test-request"
+	ctx := metadata.AppendToOutgoingContext(context.Background(), api.RequestIDKey, requestID)
+	produceResponse, err := leaderClient.Produce(ctx, &api.ProduceRequest{
 		Record: &api.Record{
 			Value: dummy,
 		},
@@ -98,8 +96,27 @@ func TestAgent(t *testing.T) {
 	// check that consumed data is the same as produced data
 	require.Equal(t, consumeResponse.Record.Value, dummy)
 
-	// wait for replication to eventually complete
-	time.Sleep(3 * time.Second)
+	// every node is listed as a member of the cluster
+	serversResponse, err := leaderClient.GetServers(context.Background(), &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Len(t, serversResponse.Servers, 3)
+	servers := make(map[string]*api.Server)
+	for _, server := range serversResponse.Servers {
+		servers[server.Id] = server
+	}
+	for _, agent := range agents {
+		rpcAddr, err := agent.Config.RPCAddr()
+		require.NoError(t, err)
+		server, ok := servers[agent.Config.NodeName]
+		require.True(t, ok)
+		require.Equal(t, rpcAddr, server.RpcAddr)
+		require.True(t, server.Voter)
+	}
+
+	// wait for replication to the followers to complete
+	for _, agent := range agents[1:] {
+		require.NoError(t, agent.WaitForReplication(produceResponse.Offset, 5*time.Second))
+	}
 
 	followerClient := client(t, agents[1], peerTLSConfig)
 	consumeResponse, err = followerClient.Consume(context.Background(), &api.ConsumeRequest{
@@ -107,18 +124,354 @@ func TestAgent(t *testing.T) {
 	})
 	require.NoError(t, err)
 	require.Equal(t, consumeResponse.Record.Value, dummy)
+	require.Equal(t, requestID, consumeResponse.Record.RequestId)
+
+	// the produce and the replicated produces are logged under the same
+	// request id
+	for _, observed := range logs {
+		produces := observed.FilterField(zap.String("grpc.method", "Produce")).
+			FilterField(zap.String("grpc.request_id", requestID))
+		require.NotZero(t, produces.Len())
+	}
+}
+
+// test that larger configured segment sizes produce fewer, bigger segments
+func TestAgentSegmentSizes(t *testing.T) {
+	files := configFiles(t)
+	serverTLSConfig, peerTLSConfig := setupTLS(t)
+
+	// number of segments written for the same records under each store size
+	segments := make(map[uint64]int)
+	for _, maxStoreBytes := range []uint64{0, 64 * 1024} {
+		ports := dynaport.Get(2)
+		dataDir, err := os.MkdirTemp("", "agent-test-log")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		agent, err := agent.New(agent.Config{
+			NodeName:        fmt.Sprint(maxStoreBytes),
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:         ports[1],
+			DataDir:         dataDir,
+			ACLModelFile:    files.ACLModelFile,
+			ACLPolicyFile:   files.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			MaxStoreBytes:   maxStoreBytes,
+			MaxIndexBytes:   maxStoreBytes,
+		})
+		require.NoError(t, err)
+
+		client := client(t, agent, peerTLSConfig)
+		for range 100 {
+			_, err := client.Produce(context.Background(), &api.ProduceRequest{
+				Record: &api.Record{Value: []byte("hello world")},
+			})
+			require.NoError(t, err)
+		}
+		require.NoError(t, agent.Shutdown())
+
+		stores, err := filepath.Glob(filepath.Join(dataDir, "*.store"))
+		require.NoError(t, err)
+		segments[maxStoreBytes] = len(stores)
+	}
+	require.Greater(t, segments[0], 1)
+	require.Equal(t, 1, segments[64*1024])
+}
+
+// test that an agent whose start join addresses are unreachable still runs
+func TestAgentDeadJoinAddr(t *testing.T) {
+	files := configFiles(t)
+	serverTLSConfig, peerTLSConfig := setupTLS(t)
+	ports := dynaport.Get(3)
+
+	agent, err := agent.New(agent.Config{
+		NodeName:        "0",
+		StartJoinAddrs:  []string{fmt.Sprintf("127.0.0.1:%d", ports[2])},
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:         ports[1],
+		DataDir:         t.TempDir(),
+		ACLModelFile:    files.ACLModelFile,
+		ACLPolicyFile:   files.ACLPolicyFile,
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+	})
+	require.NoError(t, err)
+	defer agent.Shutdown()
+
+	client := client(t, agent, peerTLSConfig)
+	_, err = client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+}
+
+// test that invalid configs are rejected before any component is started
+func TestAgentInvalidConfig(t *testing.T) {
+	files := configFiles(t)
+	ports := dynaport.Get(2)
+	valid := func() agent.Config {
+		return agent.Config{
+			NodeName:      "0",
+			BindAddr:      fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:       ports[1],
+			DataDir:       t.TempDir(),
+			ACLModelFile:  files.ACLModelFile,
+			ACLPolicyFile: files.ACLPolicyFile,
+		}
+	}
+	table := map[string]func(c *agent.Config){
+		"malformed bind address":    func(c *agent.Config) { c.BindAddr = "127.0.0.1" },
+		"bind port out of range":    func(c *agent.Config) { c.BindAddr = "127.0.0.1:70000" },
+		"rpc port out of range":     func(c *agent.Config) { c.RPCPort = 0 },
+		"bind and rpc ports equal":  func(c *agent.Config) { c.RPCPort = ports[0] },
+		"bind and http ports equal": func(c *agent.Config) { c.HTTPPort = ports[0] },
+		"missing acl model file":    func(c *agent.Config) { c.ACLModelFile = "" },
+		"nonexistent acl policy":    func(c *agent.Config) { c.ACLPolicyFile = filepath.Join(t.TempDir(), "policy.csv") },
+	}
+	for scenario, fn := range table {
+		t.Run(scenario, func(t *testing.T) {
+			c := valid()
+			fn(&c)
+			_, err := agent.New(c)
+			require.Error(t, err)
+		})
+	}
+}
+
+// configFiles returns the paths of the test certs and acl files
+func configFiles(t *testing.T) *config.FilePaths {
+	t.Helper()
+	files, err := config.Files()
+	require.NoError(t, err)
+	return files
+}
+
+// setupTLS returns the server tls config sent to clients and the peer tls
+// config shared between servers for replication purposes
+func setupTLS(t *testing.T) (serverTLSConfig, peerTLSConfig *tls.Config) {
+	t.Helper()
+	files := configFiles(t)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      files.ServerCertFile,
+		KeyFile:       files.ServerKeyFile,
+		CAFile:        files.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	peerTLSConfig, err = config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      files.RootClientCertFile,
+		KeyFile:       files.RootClientKeyFile,
+		CAFile:        files.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	return serverTLSConfig, peerTLSConfig
 }
 
 // helper function for creating a new grpc client for the log service
 func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.LogClient {
-	tlsCreds := credentials.NewTLS(tlsConfig)
-	opts := []grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}
 	rpcAddr, err := agent.Config.RPCAddr()
 	require.NoError(t, err)
 
-	// create grpc connection
-	conn, err := grpc.NewClient(rpcAddr, opts...)
+	c, err := logclient.NewClient(rpcAddr, tlsConfig)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	return c.Log()
+}
+
+// test that an agent is live as soon as it starts and only ready once it has
+// joined the cluster through its start join address
+func TestAgentProbes(t *testing.T) {
+	files := configFiles(t)
+	serverTLSConfig, peerTLSConfig := setupTLS(t)
+	ports := dynaport.Get(5)
+	seedAddr := fmt.Sprintf("127.0.0.1:%d", ports[3])
+
+	probed, err := agent.New(agent.Config{
+		NodeName:        "0",
+		StartJoinAddrs:  []string{seedAddr},
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:         ports[1],
+		HTTPPort:        ports[2],
+		DataDir:         t.TempDir(),
+		ACLModelFile:    files.ACLModelFile,
+		ACLPolicyFile:   files.ACLPolicyFile,
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+	})
+	require.NoError(t, err)
+	defer probed.Shutdown()
+
+	probe := func(port int, path string) int {
+		res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, path))
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	require.Equal(t, http.StatusOK, probe(ports[2], "/healthz"))
+	require.Equal(t, http.StatusServiceUnavailable, probe(ports[2], "/readyz"))
+
+	// the agent becomes ready once the seed it joins through is up. the seed
+	// serves its probes on its rpc port
+	seed, err := agent.New(agent.Config{
+		NodeName:        "1",
+		BindAddr:        seedAddr,
+		RPCPort:         ports[4],
+		HTTPPort:        ports[4],
+		DataDir:         t.TempDir(),
+		ACLModelFile:    files.ACLModelFile,
+		ACLPolicyFile:   files.ACLPolicyFile,
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+	})
+	require.NoError(t, err)
+	defer seed.Shutdown()
+	require.Eventually(t, func() bool {
+		return probe(ports[2], "/readyz") == http.StatusOK
+	}, 20*time.Second, 100*time.Millisecond)
+	require.Equal(t, http.StatusOK, probe(ports[2], "/healthz"))
+	require.Equal(t, http.StatusOK, probe(ports[4], "/readyz"))
+	require.Equal(t, http.StatusOK, probe(ports[2], "/metrics"))
+}
+
+// test that a failed leave doesn't stop the rest of the shutdown, so the
+// log is still flushed and the rpc port released
+func TestAgentShutdownLeaveFailure(t *testing.T) {
+	files := configFiles(t)
+	serverTLSConfig, peerTLSConfig := setupTLS(t)
+	ports := dynaport.Get(2)
+	dataDir := t.TempDir()
+
+	a, err := agent.New(agent.Config{
+		NodeName:        "0",
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:         ports[1],
+		DataDir:         dataDir,
+		ACLModelFile:    files.ACLModelFile,
+		ACLPolicyFile:   files.ACLPolicyFile,
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+		// serf waits a second for its leave to propagate
+		LeaveTimeout: time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	value := []byte("flushed on shutdown")
+	_, err = client(t, a, peerTLSConfig).Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: value},
+	})
+	require.NoError(t, err)
+
+	require.ErrorContains(t, a.Shutdown(), "timed out")
+
+	stores, err := filepath.Glob(filepath.Join(dataDir, "*.store"))
+	require.NoError(t, err)
+	require.Len(t, stores, 1)
+	p, err := os.ReadFile(stores[0])
+	require.NoError(t, err)
+	require.True(t, bytes.Contains(p, value))
+
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[1]))
 	require.NoError(t, err)
+	ln.Close()
+}
+
+// test that the leader doesn't replicate its followers' copies of its own
+// records back to its log, and replicates from them again once it follows
+func TestAgentLeaderReplication(t *testing.T) {
+	files := configFiles(t)
+	serverTLSConfig, peerTLSConfig := setupTLS(t)
+
+	var agents []*agent.Agent
+	for i := range 2 {
+		ports := dynaport.Get(2)
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = []string{agents[0].Config.BindAddr}
+		}
+		a, err := agent.New(agent.Config{
+			NodeName:        fmt.Sprint(i),
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:         ports[1],
+			DataDir:         t.TempDir(),
+			ACLModelFile:    files.ACLModelFile,
+			ACLPolicyFile:   files.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			Leader:          i == 0,
+		})
+		require.NoError(t, err)
+		defer a.Shutdown()
+		agents = append(agents, a)
+	}
+	leader, follower := agents[0], agents[1]
 
-	return api.NewLogClient(conn)
+	// ids of the servers the follower sees as leading the cluster
+	followerClient := client(t, follower, peerTLSConfig)
+	leaders := func() []string {
+		res, err := followerClient.GetServers(context.Background(), &api.GetServersRequest{})
+		require.NoError(t, err)
+		var ids []string
+		for _, server := range res.Servers {
+			if server.IsLeader {
+				ids = append(ids, server.Id)
+			}
+		}
+		return ids
+	}
+	require.Eventually(t, func() bool {
+		return slices.Equal(leaders(), []string{"0"})
+	}, 5*time.Second, 50*time.Millisecond)
+
+	produce, err := client(t, leader, peerTLSConfig).Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, follower.WaitForReplication(produce.Offset, 5*time.Second))
+
+	// the leader never appends the follower's copy of the record
+	require.Error(t, leader.WaitForReplication(produce.Offset+1, time.Second))
+
+	// once it follows, the former leader replicates from its peer again
+	require.NoError(t, leader.SetLeader(false))
+	require.NoError(t, leader.WaitForReplication(produce.Offset+1, 5*time.Second))
+	require.Eventually(t, func() bool {
+		return len(leaders()) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// test that a failed setup releases the ports the agent bound
+func TestAgentSetupFailure(t *testing.T) {
+	files := configFiles(t)
+	serverTLSConfig, peerTLSConfig := setupTLS(t)
+	ports := dynaport.Get(2)
+	bindAddr := fmt.Sprintf("127.0.0.1:%d", ports[0])
+
+	// the model exists but can't be loaded, which is only noticed once the
+	// membership has started
+	model := filepath.Join(t.TempDir(), "model.conf")
+	require.NoError(t, os.WriteFile(model, []byte("not a model"), 0600))
+	_, err := agent.New(agent.Config{
+		NodeName:        "0",
+		BindAddr:        bindAddr,
+		RPCPort:         ports[1],
+		DataDir:         t.TempDir(),
+		ACLModelFile:    model,
+		ACLPolicyFile:   files.ACLPolicyFile,
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+	})
+	require.ErrorContains(t, err, "model")
+
+	for _, addr := range []string{bindAddr, fmt.Sprintf("127.0.0.1:%d", ports[1])} {
+		ln, err := net.Listen("tcp", addr)
+		require.NoError(t, err)
+		ln.Close()
+	}
 }
@@ -3,32 +3,122 @@ package auth
 
 import (
 	"fmt"
+	"io"
+	"os"
 
 	"github.com/casbin/casbin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 type Authorizer struct {
-	enforcer *casbin.Enforcer
+	// synced, as roles may change while other requests are authorized
+	enforcer *casbin.SyncedEnforcer
+	// logs every authorization decision. the global logger is used when nil
+	logger *zap.Logger
+	// logs denied attempts to a dedicated audit destination
+	audit *zap.Logger
+}
+
+// Option configures an Authorizer
+type Option func(*Authorizer)
+
+// WithLogger sets the logger every authorization decision is logged to.
+// defaults to the global logger at the time of the decision
+func WithLogger(logger *zap.Logger) Option {
+	return func(a *Authorizer) {
+		a.logger = logger
+	}
+}
+
+// WithAuditWriter appends every denied attempt as a json line to w, such as
+// a dedicated audit log file
+func WithAuditWriter(w io.Writer) Option {
+	return func(a *Authorizer) {
+		encoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+		a.audit = zap.New(zapcore.NewCore(encoder, zapcore.AddSync(w), zapcore.InfoLevel))
+	}
 }
 
 // the New function returns an authorization enforcer instance where model points to the file
 // containing the casbin's authorization setup and policy points to the csv file containing the
-// ACL table
-func New(model, policy string) *Authorizer {
-	enforcer := casbin.NewEnforcer(model, policy)
-	return &Authorizer{
-		enforcer: enforcer,
+// ACL table. an error is returned when either file is missing or invalid
+func New(model, policy string, opts ...Option) (*Authorizer, error) {
+	for name, file := range map[string]string{"model": model, "policy": policy} {
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("acl %s file: %w", name, err)
+		}
+	}
+	enforcer, err := casbin.NewSyncedEnforcerSafe(model, policy)
+	if err != nil {
+		return nil, fmt.Errorf("load acl model %q and policy %q: %w", model, policy, err)
+	}
+	a := &Authorizer{enforcer: enforcer}
+	for _, opt := range opts {
+		opt(a)
 	}
+	return a, nil
 }
 
 // this function checks whether a given subject can access and perform an action on a given object/resource
 func (a *Authorizer) Authorize(subject, object, action string) error {
-	if !a.enforcer.Enforce(subject, object, action) {
-		errMsg := fmt.Sprintf("%s not permitted to %s to %s", subject, action, object)
-		st := status.New(codes.PermissionDenied, errMsg)
-		return st.Err()
+	allowed := a.enforcer.Enforce(subject, object, action)
+	fields := []zap.Field{
+		zap.String("subject", subject),
+		zap.String("object", object),
+		zap.String("action", action),
+		zap.Bool("allowed", allowed),
+	}
+	// allowed decisions are logged at debug, as every request is authorized
+	logger := a.logger
+	if logger == nil {
+		logger = zap.L().Named("auth")
+	}
+	if allowed {
+		logger.Debug("authorization decision", fields...)
+		return nil
+	}
+	logger.Info("authorization decision", fields...)
+	if a.audit != nil {
+		a.audit.Warn("authorization denied", fields...)
+	}
+	errMsg := fmt.Sprintf("%s not permitted to %s to %s", subject, action, object)
+	st := status.New(codes.PermissionDenied, errMsg)
+	return st.Err()
+}
+
+// AddRoleForUser assigns a role to a subject so that it inherits the role's
+// permissions. it reports whether the subject didn't already have the role
+func (a *Authorizer) AddRoleForUser(user, role string) (bool, error) {
+	if err := a.checkRoles(); err != nil {
+		return false, err
+	}
+	return a.enforcer.AddRoleForUser(user, role), nil
+}
+
+// DeleteRoleForUser removes a role from a subject. it reports whether the
+// subject had the role
+func (a *Authorizer) DeleteRoleForUser(user, role string) (bool, error) {
+	if err := a.checkRoles(); err != nil {
+		return false, err
+	}
+	return a.enforcer.DeleteRoleForUser(user, role), nil
+}
+
+// GetRolesForUser returns the roles assigned to a subject
+func (a *Authorizer) GetRolesForUser(user string) ([]string, error) {
+	if err := a.checkRoles(); err != nil {
+		return nil, err
+	}
+	return a.enforcer.GetRolesForUser(user)
+}
+
+// roles can only be managed when the model has a role definition
+func (a *Authorizer) checkRoles() error {
+	if _, ok := a.enforcer.GetModel()["g"]["g"]; !ok {
+		return fmt.Errorf("acl model has no role definition")
 	}
 	return nil
 }
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const rbacModel = `[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[role_definition]
+g = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = g(r.sub, p.sub) && r.obj == p.obj && r.act == p.act`
+
+const flatModel = `[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && r.obj == p.obj && r.act == p.act`
+
+// writes the model and policy into a temporary directory and returns an
+// authorizer enforcing them
+func setupTest(t *testing.T, model, policy string, opts ...Option) *Authorizer {
+	t.Helper()
+	dir := t.TempDir()
+	modelFile := filepath.Join(dir, "model.conf")
+	policyFile := filepath.Join(dir, "policy.csv")
+	require.NoError(t, os.WriteFile(modelFile, []byte(model), 0644))
+	require.NoError(t, os.WriteFile(policyFile, []byte(policy), 0644))
+	a, err := New(modelFile, policyFile, opts...)
+	require.NoError(t, err)
+	return a
+}
+
+func TestNewMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	modelFile := filepath.Join(dir, "model.conf")
+	require.NoError(t, os.WriteFile(modelFile, []byte(flatModel), 0644))
+	policyFile := filepath.Join(dir, "missing.csv")
+
+	_, err := New(modelFile, policyFile)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.Contains(t, err.Error(), "acl policy file")
+
+	_, err = New(filepath.Join(dir, "missing.conf"), modelFile)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.Contains(t, err.Error(), "acl model file")
+}
+
+func TestAuthorizerRoles(t *testing.T) {
+	a := setupTest(t, rbacModel, "p, writers, *, produce\np, readers, *, consume\ng, root, writers\n")
+
+	// roles from the policy file are granted
+	require.NoError(t, a.Authorize("root", "*", "produce"))
+	roles, err := a.GetRolesForUser("root")
+	require.NoError(t, err)
+	require.Equal(t, []string{"writers"}, roles)
+
+	// a subject inherits produce permission once assigned the role
+	err = a.Authorize("client", "*", "produce")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	added, err := a.AddRoleForUser("client", "writers")
+	require.NoError(t, err)
+	require.True(t, added)
+	require.NoError(t, a.Authorize("client", "*", "produce"))
+	// but not the permissions of other roles
+	require.Error(t, a.Authorize("client", "*", "consume"))
+
+	// and loses it when removed from the role
+	deleted, err := a.DeleteRoleForUser("client", "writers")
+	require.NoError(t, err)
+	require.True(t, deleted)
+	require.Error(t, a.Authorize("client", "*", "produce"))
+	roles, err = a.GetRolesForUser("client")
+	require.NoError(t, err)
+	require.Empty(t, roles)
+}
+
+// test that roles can change while requests are authorized. run with -race
+func TestAuthorizerRolesConcurrent(t *testing.T) {
+	a := setupTest(t, rbacModel, "p, writers, *, produce\n")
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user := fmt.Sprintf("client-%d", i)
+			for range 100 {
+				_, err := a.AddRoleForUser(user, "writers")
+				require.NoError(t, err)
+				_ = a.Authorize(user, "*", "produce")
+				_, err = a.DeleteRoleForUser(user, "writers")
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Error(t, a.Authorize("client-0", "*", "produce"))
+}
+
+func TestAuthorizerRolesUnsupported(t *testing.T) {
+	a := setupTest(t, flatModel, "p, root, *, produce\n")
+
+	require.NoError(t, a.Authorize("root", "*", "produce"))
+	_, err := a.AddRoleForUser("client", "writers")
+	require.Error(t, err)
+	_, err = a.GetRolesForUser("root")
+	require.Error(t, err)
+}
+
+func TestAuthorizerAudit(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	var audit bytes.Buffer
+	a := setupTest(t, flatModel, "p, root, *, produce\n",
+		WithLogger(zap.New(core)),
+		WithAuditWriter(&audit),
+	)
+
+	require.NoError(t, a.Authorize("root", "*", "produce"))
+	require.Error(t, a.Authorize("nobody", "*", "produce"))
+
+	// every decision is logged with its outcome. only denials are logged
+	// above debug
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 2)
+	for i, want := range []struct {
+		subject string
+		allowed bool
+		level   zapcore.Level
+	}{{"root", true, zapcore.DebugLevel}, {"nobody", false, zapcore.InfoLevel}} {
+		require.Equal(t, want.level, entries[i].Level)
+		fields := entries[i].ContextMap()
+		require.Equal(t, want.subject, fields["subject"])
+		require.Equal(t, "*", fields["object"])
+		require.Equal(t, "produce", fields["action"])
+		require.Equal(t, want.allowed, fields["allowed"])
+	}
+
+	// only the denied attempt is audited
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	require.Len(t, lines, 1)
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	require.Equal(t, "nobody", entry["subject"])
+	require.Equal(t, false, entry["allowed"])
+}
+
+func TestAllowList(t *testing.T) {
+	a := NewAllowList("root", "admin")
+	table := map[string]struct {
+		subject string
+		action  string
+		allowed bool
+	}{
+		"listed subject produces":   {subject: "root", action: "produce", allowed: true},
+		"listed subject consumes":   {subject: "admin", action: "consume", allowed: true},
+		"unlisted subject denied":   {subject: "nobody", action: "produce"},
+		"unauthenticated is denied": {subject: "", action: "consume"},
+	}
+	for scenario, tc := range table {
+		t.Run(scenario, func(t *testing.T) {
+			err := a.Authorize(tc.subject, "*", tc.action)
+			if tc.allowed {
+				require.NoError(t, err)
+				return
+			}
+			require.Equal(t, codes.PermissionDenied, status.Code(err))
+		})
+	}
+}
@@ -0,0 +1,126 @@
+// this package contains a client for producing records to and consuming
+// records from a log server
+package client
+
+import (
+	"context"
+	"crypto/tls"
+
+	api "github.com/mrshabel/gumlog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Client wraps a grpc connection to a log server
+type Client struct {
+	conn *grpc.ClientConn
+	log  api.LogClient
+}
+
+// NewClient creates a client for the log server at addr. the connection is
+// secured with the given tls config or left insecure when it's nil
+func NewClient(addr string, tlsConfig *tls.Config) (*Client, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	return Dial(addr, grpc.WithTransportCredentials(creds))
+}
+
+// Dial creates a client for the log server at addr using the given dial
+// options. the options must include the transport credentials
+func Dial(addr string, opts ...grpc.DialOption) (*Client, error) {
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, log: api.NewLogClient(conn)}, nil
+}
+
+// Log returns the underlying log service client for requests the helpers
+// don't cover
+func (c *Client) Log() api.LogClient {
+	return c.log
+}
+
+// Produce appends the record to the log and returns its offset
+func (c *Client) Produce(ctx context.Context, record *api.Record) (uint64, error) {
+	res, err := c.log.Produce(ctx, &api.ProduceRequest{Record: record})
+	if err != nil {
+		return 0, err
+	}
+	return res.Offset, nil
+}
+
+// ProduceBatch appends the records in order over a single stream and returns
+// their offsets
+func (c *Client) ProduceBatch(ctx context.Context, records []*api.Record) ([]uint64, error) {
+	stream, err := c.log.ProduceStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]uint64, 0, len(records))
+	for _, record := range records {
+		if err := stream.Send(&api.ProduceRequest{Record: record}); err != nil {
+			return offsets, err
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			return offsets, err
+		}
+		offsets = append(offsets, res.Offset)
+	}
+	return offsets, stream.CloseSend()
+}
+
+// Consume reads the record stored at the given offset
+func (c *Client) Consume(ctx context.Context, offset uint64) (*api.Record, error) {
+	res, err := c.log.Consume(ctx, &api.ConsumeRequest{Offset: offset})
+	if err != nil {
+		return nil, err
+	}
+	return res.Record, nil
+}
+
+// Tail streams records starting from the given offset. the tail keeps
+// waiting for new records until it's closed or the context is done
+func (c *Client) Tail(ctx context.Context, offset uint64) (*Tail, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := c.log.ConsumeStream(ctx, &api.ConsumeRequest{Offset: offset})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &Tail{stream: stream, cancel: cancel}, nil
+}
+
+// Close closes the underlying connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Tail iterates over the records of a consume stream
+type Tail struct {
+	stream api.Log_ConsumeStreamClient
+	cancel context.CancelFunc
+}
+
+// Next blocks until the next record is received, skipping heartbeats
+func (t *Tail) Next() (*api.Record, error) {
+	for {
+		res, err := t.stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if !res.Heartbeat {
+			return res.Record, nil
+		}
+	}
+}
+
+// Close stops the stream
+func (t *Tail) Close() error {
+	t.cancel()
+	return nil
+}
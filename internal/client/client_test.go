@@ -0,0 +1,136 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	api "github.com/mrshabel/gumlog/api/v1"
+	"github.com/mrshabel/gumlog/internal/auth"
+	"github.com/mrshabel/gumlog/internal/client"
+	"github.com/mrshabel/gumlog/internal/config"
+	"github.com/mrshabel/gumlog/internal/log"
+	"github.com/mrshabel/gumlog/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+func TestClient(t *testing.T) {
+	table := map[string]func(t *testing.T, c *client.Client){
+		"produce/consume a record succeeds": testProduceConsume,
+		"produce a batch succeeds":          testProduceBatch,
+		"tail follows the log":              testTail,
+		"consume past log boundary fails":   testConsumePastBoundary,
+	}
+	for scenario, fn := range table {
+		t.Run(scenario, func(t *testing.T) {
+			c, teardown := setupTest(t)
+			defer teardown()
+			fn(t, c)
+		})
+	}
+}
+
+func testProduceConsume(t *testing.T, c *client.Client) {
+	ctx := context.Background()
+	off, err := c.Produce(ctx, &api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	record, err := c.Consume(ctx, off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.Equal(t, off, record.Offset)
+}
+
+func testProduceBatch(t *testing.T, c *client.Client) {
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}
+	offsets, err := c.ProduceBatch(context.Background(), records)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, offsets)
+}
+
+func testTail(t *testing.T, c *client.Client) {
+	ctx := context.Background()
+	_, err := c.ProduceBatch(ctx, []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	})
+	require.NoError(t, err)
+
+	tail, err := c.Tail(ctx, 1)
+	require.NoError(t, err)
+	defer tail.Close()
+
+	record, err := tail.Next()
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), record.Value)
+
+	// records produced after the tail started are received
+	_, err = c.Produce(ctx, &api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	record, err = tail.Next()
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), record.Value)
+	require.Equal(t, uint64(2), record.Offset)
+}
+
+func testConsumePastBoundary(t *testing.T, c *client.Client) {
+	_, err := c.Consume(context.Background(), 1)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// setupTest serves a log over tls and returns a client authenticated as root
+func setupTest(t *testing.T) (*client.Client, func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	files, err := config.Files()
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      files.ServerCertFile,
+		KeyFile:       files.ServerKeyFile,
+		CAFile:        files.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "client-test")
+	require.NoError(t, err)
+	clientLog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	authorizer, err := auth.New(files.ACLModelFile, files.ACLPolicyFile)
+	require.NoError(t, err)
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:  clientLog,
+		Authorizer: authorizer,
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go srv.Serve(l)
+
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.RootClientCertFile,
+		KeyFile:  files.RootClientKeyFile,
+		CAFile:   files.CAFile,
+	})
+	require.NoError(t, err)
+	c, err := client.NewClient(l.Addr().String(), clientTLSConfig)
+	require.NoError(t, err)
+
+	return c, func() {
+		c.Close()
+		srv.Stop()
+		l.Close()
+		clientLog.Remove()
+	}
+}
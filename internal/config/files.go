@@ -2,33 +2,57 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 )
 
-// file paths containing the tls certs
-var (
-	CAFile               = configFile("ca.pem")
-	ServerCertFile       = configFile("server.pem")
-	ServerKeyFile        = configFile("server-key.pem")
-	RootClientCertFile   = configFile("root-client.pem")
-	RootClientKeyFile    = configFile("root-client-key.pem")
-	NobodyClientCertFile = configFile("nobody-client.pem")
-	NobodyClientKeyFile  = configFile("nobody-client-key.pem")
+// FilePaths holds the paths of the tls certs and acl files
+type FilePaths struct {
+	CAFile               string
+	ServerCertFile       string
+	ServerKeyFile        string
+	RootClientCertFile   string
+	RootClientKeyFile    string
+	NobodyClientCertFile string
+	NobodyClientKeyFile  string
 
 	// acl model to setup the acl enforcer and policy defining the rules
-	ACLModelFile  = configFile("model.conf")
-	ACLPolicyFile = configFile("policy.csv")
-)
+	ACLModelFile  string
+	ACLPolicyFile string
+}
 
-func configFile(filename string) string {
+// Dir returns the directory holding the config files. it is CONFIG_DIR when
+// set and defaults to .gumlog in the user's home directory
+func Dir() (string, error) {
 	if dir := os.Getenv("CONFIG_DIR"); dir != "" {
-		return filepath.Join(dir, filename)
+		return dir, nil
 	}
-	// default to the user's home directory
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("resolve config directory, set CONFIG_DIR: %w", err)
+	}
+	return filepath.Join(homeDir, ".gumlog"), nil
+}
+
+// Files returns the paths of the config files in the config directory
+func Files() (*FilePaths, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	configFile := func(filename string) string {
+		return filepath.Join(dir, filename)
 	}
-	return filepath.Join(homeDir, ".gumlog", filename)
+	return &FilePaths{
+		CAFile:               configFile("ca.pem"),
+		ServerCertFile:       configFile("server.pem"),
+		ServerKeyFile:        configFile("server-key.pem"),
+		RootClientCertFile:   configFile("root-client.pem"),
+		RootClientKeyFile:    configFile("root-client-key.pem"),
+		NobodyClientCertFile: configFile("nobody-client.pem"),
+		NobodyClientKeyFile:  configFile("nobody-client-key.pem"),
+		ACLModelFile:         configFile("model.conf"),
+		ACLPolicyFile:        configFile("policy.csv"),
+	}, nil
 }
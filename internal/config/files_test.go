@@ -0,0 +1,33 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFiles(t *testing.T) {
+	// without a home or config directory the paths can't be resolved
+	t.Setenv("HOME", "")
+	t.Setenv("CONFIG_DIR", "")
+	require.NotPanics(t, func() {
+		_, err := Files()
+		require.Error(t, err)
+	})
+
+	// the config directory takes precedence over the home directory
+	dir := t.TempDir()
+	t.Setenv("CONFIG_DIR", dir)
+	files, err := Files()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "ca.pem"), files.CAFile)
+	require.Equal(t, filepath.Join(dir, "policy.csv"), files.ACLPolicyFile)
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("CONFIG_DIR", "")
+	files, err = Files()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(home, ".gumlog", "model.conf"), files.ACLModelFile)
+}
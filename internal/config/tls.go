@@ -9,7 +9,14 @@ import (
 
 func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 	var err error
-	tlsConfig := &tls.Config{}
+	// refuse protocol versions older than the minimum, tls 1.2 by default
+	tlsConfig := &tls.Config{
+		MinVersion:   cfg.MinVersion,
+		CipherSuites: cfg.CipherSuites,
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
 	if cfg.CertFile != "" && cfg.KeyFile != "" {
 		// load the certificates into the tls config
 		tlsConfig.Certificates = make([]tls.Certificate, 1)
@@ -35,6 +42,9 @@ func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 		if cfg.Server {
 			tlsConfig.ClientCAs = ca
 			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			if cfg.ClientCertOptional {
+				tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
 		} else {
 			tlsConfig.RootCAs = ca
 		}
@@ -49,4 +59,12 @@ type TLSConfig struct {
 	CAFile        string
 	ServerAddress string
 	Server        bool
+	// let clients of a server connect without a certificate. certificates
+	// that are presented are still verified
+	ClientCertOptional bool
+	// lowest tls version accepted. defaults to tls 1.2
+	MinVersion uint16
+	// cipher suites enabled for tls 1.2 and below. the defaults are used when
+	// empty. tls 1.3 suites are not configurable
+	CipherSuites []uint16
 }
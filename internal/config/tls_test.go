@@ -0,0 +1,70 @@
+package config
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupTLSConfigMinVersion(t *testing.T) {
+	files, err := Files()
+	require.NoError(t, err)
+
+	serverTLSConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile:      files.ServerCertFile,
+		KeyFile:       files.ServerKeyFile,
+		CAFile:        files.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), serverTLSConfig.MinVersion)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig)
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// complete the handshake before hanging up
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	table := map[string]struct {
+		maxVersion uint16
+		wantErr    bool
+	}{
+		"tls 1.1 client is rejected": {maxVersion: tls.VersionTLS11, wantErr: true},
+		"tls 1.2 client is accepted": {maxVersion: tls.VersionTLS12},
+	}
+	for scenario, tc := range table {
+		t.Run(scenario, func(t *testing.T) {
+			clientTLSConfig, err := SetupTLSConfig(TLSConfig{
+				CertFile:      files.RootClientCertFile,
+				KeyFile:       files.RootClientKeyFile,
+				CAFile:        files.CAFile,
+				ServerAddress: "127.0.0.1",
+				MinVersion:    tls.VersionTLS10,
+			})
+			require.NoError(t, err)
+			clientTLSConfig.MaxVersion = tc.maxVersion
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			err = tls.Client(conn, clientTLSConfig).Handshake()
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
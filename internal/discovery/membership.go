@@ -1,9 +1,14 @@
 package discovery
 
 import (
+	"encoding/base64"
+	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/serf/serf"
+	api "github.com/mrshabel/gumlog/api/v1"
 	"go.uber.org/zap"
 )
 
@@ -11,11 +16,19 @@ import (
 type Membership struct {
 	Config
 	handler Handler
-	serf    *serf.Serf
+	// guards the listeners, the tags while they're updated and the encrypt
+	// key while it's rotated
+	mu sync.RWMutex
+	// additional handlers notified of join and leave events after handler
+	listeners []Handler
+	serf      *serf.Serf
 	// entry and exist events channel
 	events chan serf.Event
 	// logger instance for service discovery activities
 	logger *zap.Logger
+	// closed when the member leaves to stop retrying to join
+	left      chan struct{}
+	leaveOnce sync.Once
 }
 
 // New creates a new serf membership instance for the current node
@@ -23,8 +36,13 @@ func New(handler Handler, config Config) (*Membership, error) {
 	c := &Membership{
 		Config:  config,
 		handler: handler,
-		logger:  zap.L().Named("membership"),
+		left:    make(chan struct{}),
 	}
+	logger := config.Logger
+	if logger == nil {
+		logger = zap.L()
+	}
+	c.logger = logger.Named("membership")
 	if err := c.setupSerf(); err != nil {
 		return nil, err
 	}
@@ -40,12 +58,45 @@ type Config struct {
 
 	// key value metadata tags to give more context about the node.
 	// can be used to shared info on whether a node is a voter or not,
-	// and RPC addresses
+	// and RPC addresses. nodes without a "voter" tag are voters
 	Tags map[string]string
 	// existing node addresses that any new node can join. the new node
 	// will connect to one node in the defined addresses and then broadcast
 	// its presence to the other nodes through gossiping
 	StartJoinAddrs []string
+	// fail when none of the StartJoinAddrs can be joined. otherwise the node
+	// runs on its own and keeps retrying to join in the background
+	RequireJoin bool
+	// attempts to join through StartJoinAddrs before giving up or retrying in
+	// the background, and the delay before the first retry which doubles on
+	// every retry. default to 3 and 500ms
+	JoinAttempts int
+	JoinBackoff  time.Duration
+	// key used to encrypt gossip traffic with AES. must be 16, 24 or 32 bytes
+	// long to select AES-128, AES-192 or AES-256. gossip is unencrypted when
+	// no key is set
+	EncryptKey []byte
+	// failure detection tuning. members are probed every ProbeInterval and
+	// suspected when they don't answer within ProbeTimeout, while gossip is
+	// sent every GossipInterval. shorter intervals detect failed members
+	// sooner at the cost of more traffic. serf's defaults apply when unset
+	ProbeInterval  time.Duration
+	ProbeTimeout   time.Duration
+	GossipInterval time.Duration
+	// logger for service discovery activities. defaults to the global logger
+	Logger *zap.Logger
+}
+
+// upper bound of the delay between attempts to join
+const maxJoinBackoff = 30 * time.Second
+
+// validateKey checks that the key selects one of AES-128, AES-192 or AES-256
+func validateKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("invalid encrypt key length %d: must be 16, 24 or 32 bytes", len(key))
 }
 
 func (m *Membership) setupSerf() error {
@@ -56,10 +107,27 @@ func (m *Membership) setupSerf() error {
 	config := serf.DefaultConfig()
 	config.Init()
 
+	if m.EncryptKey != nil {
+		if err := validateKey(m.EncryptKey); err != nil {
+			return err
+		}
+		config.MemberlistConfig.SecretKey = m.EncryptKey
+	}
+
 	// include current node membership details for gossiping
 	config.MemberlistConfig.BindAddr = addr.IP.String()
 	config.MemberlistConfig.BindPort = addr.Port
 
+	if m.ProbeInterval != 0 {
+		config.MemberlistConfig.ProbeInterval = m.ProbeInterval
+	}
+	if m.ProbeTimeout != 0 {
+		config.MemberlistConfig.ProbeTimeout = m.ProbeTimeout
+	}
+	if m.GossipInterval != 0 {
+		config.MemberlistConfig.GossipInterval = m.GossipInterval
+	}
+
 	m.events = make(chan serf.Event)
 	config.EventCh = m.events
 
@@ -77,20 +145,90 @@ func (m *Membership) setupSerf() error {
 	go m.eventHandler()
 	if m.StartJoinAddrs != nil {
 		// join an existing cluster
-		if _, err = m.serf.Join(m.StartJoinAddrs, true); err != nil {
-			return err
+		if m.JoinAttempts == 0 {
+			m.JoinAttempts = 3
+		}
+		if m.JoinBackoff == 0 {
+			m.JoinBackoff = 500 * time.Millisecond
+		}
+		backoff, err := m.join(m.JoinAttempts, m.JoinBackoff)
+		if err != nil {
+			if m.RequireJoin {
+				m.serf.Shutdown()
+				return err
+			}
+			m.logger.Warn("failed to join cluster, retrying in the background",
+				zap.Error(err), zap.Strings("start_join_addrs", m.StartJoinAddrs))
+			go m.retryJoin(backoff)
 		}
 	}
 	return nil
 }
 
+// join the cluster through the start join addresses, making up to the given
+// attempts with an exponential backoff between them. returns the backoff for
+// the next attempt
+func (m *Membership) join(attempts int, backoff time.Duration) (time.Duration, error) {
+	var err error
+	for i := range attempts {
+		if i > 0 {
+			select {
+			case <-m.left:
+				return backoff, err
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxJoinBackoff)
+		}
+		if _, err = m.serf.Join(m.StartJoinAddrs, true); err == nil {
+			return backoff, nil
+		}
+	}
+	return backoff, err
+}
+
+// keep trying to join the cluster until it succeeds, another member joins
+// this node or the node leaves
+func (m *Membership) retryJoin(backoff time.Duration) {
+	for {
+		select {
+		case <-m.left:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxJoinBackoff)
+		if m.serf.NumNodes() > 1 {
+			return
+		}
+		if _, err := m.serf.Join(m.StartJoinAddrs, true); err == nil {
+			m.logger.Info("joined cluster", zap.Strings("start_join_addrs", m.StartJoinAddrs))
+			return
+		}
+	}
+}
+
 // Handler represents a component in the service that needs to know
 // when a server joins or leaves the cluster
 type Handler interface {
-	Join(name, addr string) error
+	Join(name, addr string, voter bool) error
 	Leave(name string) error
 }
 
+// AddListener subscribes another handler to the join and leave events of the
+// cluster's members. listeners are called after the membership's handler and
+// their errors are only logged
+func (m *Membership) AddListener(listener Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, listener)
+}
+
+// handlers returns the membership's handler followed by its listeners
+func (m *Membership) handlers() []Handler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Handler{m.handler}, m.listeners...)
+}
+
 // eventHandler handles Join and Leave events for its members. it runs in an
 // endless loop to ensure that all events are delivered.
 func (m *Membership) eventHandler() {
@@ -116,18 +254,23 @@ func (m *Membership) eventHandler() {
 	}
 }
 
-// handleJoins adds a new member to the cluster with their names and
-// rpc address tags
+// handleJoins adds a new member to the cluster with their names, rpc address
+// and voter tags
 func (m *Membership) handleJoin(member serf.Member) {
-	if err := m.handler.Join(member.Name, member.Tags["rpc_addr"]); err != nil {
-		m.logError(err, "failed to join", member)
+	voter := member.Tags["voter"] != "false"
+	for _, h := range m.handlers() {
+		if err := h.Join(member.Name, member.Tags["rpc_addr"], voter); err != nil {
+			m.logError(err, "failed to join", member)
+		}
 	}
 }
 
 // handleJoins removes a member from the cluster with their name
 func (m *Membership) handleLeave(member serf.Member) {
-	if err := m.handler.Leave(member.Name); err != nil {
-		m.logError(err, "failed to leave", member)
+	for _, h := range m.handlers() {
+		if err := h.Leave(member.Name); err != nil {
+			m.logError(err, "failed to leave", member)
+		}
 	}
 }
 
@@ -136,16 +279,126 @@ func (m *Membership) isLocal(member serf.Member) bool {
 	return m.serf.LocalMember().Name == member.Name
 }
 
+// Joined reports whether the node has joined the cluster through its start
+// join addresses or been joined by another member. nodes without start join
+// addresses form a cluster of their own
+func (m *Membership) Joined() bool {
+	return len(m.StartJoinAddrs) == 0 || m.serf.NumNodes() > 1
+}
+
 // Members return a snapshot of  all the current members in the cluster
 func (m *Membership) Members() []serf.Member {
 	return m.serf.Members()
 }
 
+// GetServers returns the live members of the cluster with their rpc
+// addresses, marking the members tagged as the leader
+func (m *Membership) GetServers() ([]*api.Server, error) {
+	var servers []*api.Server
+	for _, member := range m.serf.Members() {
+		if member.Status != serf.StatusAlive {
+			continue
+		}
+		servers = append(servers, &api.Server{
+			Id:       member.Name,
+			RpcAddr:  member.Tags["rpc_addr"],
+			Voter:    member.Tags["voter"] != "false",
+			IsLeader: member.Tags["leader"] == "true",
+		})
+	}
+	return servers, nil
+}
+
+// SetTag updates a tag of the local member and gossips it to the cluster
+func (m *Membership) SetTag(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tags := make(map[string]string, len(m.Tags)+1)
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	tags[key] = value
+	if err := m.serf.SetTags(tags); err != nil {
+		return err
+	}
+	m.Tags = tags
+	return nil
+}
+
 // Leave tells member to leave the cluster
 func (m *Membership) Leave() error {
+	m.leaveOnce.Do(func() { close(m.left) })
 	return m.serf.Leave()
 }
 
+// LeaveWithTimeout tells member to leave the cluster and waits until the
+// leave has been broadcast to the other members, failing if that takes longer
+// than the timeout
+func (m *Membership) LeaveWithTimeout(timeout time.Duration) error {
+	m.leaveOnce.Do(func() { close(m.left) })
+	done := make(chan error, 1)
+	go func() {
+		done <- m.serf.Leave()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %s waiting to leave the cluster", timeout)
+	}
+	// serf is only marked as left once its leave intent was broadcast
+	if state := m.serf.State(); state != serf.SerfLeft {
+		return fmt.Errorf("member did not leave the cluster, state is %s", state)
+	}
+	return nil
+}
+
+// Shutdown stops the member without leaving the cluster, releasing its bind
+// address. the other members see it as failed
+func (m *Membership) Shutdown() error {
+	m.leaveOnce.Do(func() { close(m.left) })
+	return m.serf.Shutdown()
+}
+
+// RotateKey replaces the key encrypting gossip traffic across the cluster. the
+// new key is installed on every member before it is used so members can still
+// talk while switching over, and the old key is then removed
+func (m *Membership) RotateKey(key []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if !m.serf.EncryptionEnabled() {
+		return fmt.Errorf("gossip encryption is not enabled")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := base64.StdEncoding.EncodeToString(m.EncryptKey)
+	encoded := base64.StdEncoding.EncodeToString(key)
+	manager := m.serf.KeyManager()
+	steps := []struct {
+		name string
+		fn   func(string) (*serf.KeyResponse, error)
+		key  string
+	}{
+		{"install", manager.InstallKey, encoded},
+		{"use", manager.UseKey, encoded},
+		{"remove", manager.RemoveKey, old},
+	}
+	for _, step := range steps {
+		resp, err := step.fn(step.key)
+		if err != nil {
+			return fmt.Errorf("failed to %s key: %w", step.name, err)
+		}
+		if resp.NumErr > 0 {
+			return fmt.Errorf("failed to %s key on %d of %d members", step.name, resp.NumErr, resp.NumNodes)
+		}
+	}
+	m.EncryptKey = key
+	return nil
+}
+
 // logError logs the given error message with the member's details
 func (m *Membership) logError(err error, msg string, member serf.Member) {
 	m.logger.Error(
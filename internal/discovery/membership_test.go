@@ -2,6 +2,7 @@ package discovery
 
 import (
 	"fmt"
+	"strconv"
 	"testing"
 	"time"
 
@@ -16,11 +17,12 @@ type handler struct {
 	leaves chan string
 }
 
-func (h *handler) Join(id, addr string) error {
+func (h *handler) Join(id, addr string, voter bool) error {
 	if h.joins != nil {
 		h.joins <- map[string]string{
-			"id":   id,
-			"addr": addr,
+			"id":    id,
+			"addr":  addr,
+			"voter": strconv.FormatBool(voter),
 		}
 	}
 	return nil
@@ -58,6 +60,176 @@ func TestMembership(t *testing.T) {
 	require.Equal(t, fmt.Sprintf("%d", 2), <-handler.leaves)
 }
 
+func TestMembershipListener(t *testing.T) {
+	m, h := setupMember(t, nil)
+	listener := &handler{
+		joins:  make(chan map[string]string, 3),
+		leaves: make(chan string, 3),
+	}
+	m[0].AddListener(listener)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+
+	// both the handler and the listener see the joins
+	require.Eventually(t, func() bool {
+		return len(h.joins) == 2 && len(listener.joins) == 2
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.NoError(t, m[2].Leave())
+	require.Eventually(t, func() bool {
+		return len(h.leaves) == 1 && len(listener.leaves) == 1
+	}, 3*time.Second, 250*time.Millisecond)
+	require.Equal(t, "2", <-h.leaves)
+	require.Equal(t, "2", <-listener.leaves)
+}
+
+func TestMembershipLeaveWithTimeout(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 && len(m[0].Members()) == 3
+	}, 3*time.Second, 250*time.Millisecond)
+
+	// the leave has been broadcast once it returns
+	timeout := 3 * time.Second
+	start := time.Now()
+	require.NoError(t, m[1].LeaveWithTimeout(timeout))
+	require.Less(t, time.Since(start), timeout)
+	require.Eventually(t, func() bool {
+		for _, peer := range []*Membership{m[0], m[2]} {
+			for _, member := range peer.Members() {
+				if member.Name == "1" && member.Status != serf.StatusLeft {
+					return false
+				}
+			}
+		}
+		return true
+	}, timeout, 50*time.Millisecond)
+	require.Equal(t, "1", <-handler.leaves)
+}
+
+// test that members probed often detect a member that went down without
+// leaving well within serf's default detection time
+func TestMembershipFastProbe(t *testing.T) {
+	var members []*Membership
+	for i := range 2 {
+		ports := dynaport.Get(1)
+		addr := fmt.Sprintf("127.0.0.1:%d", ports[0])
+		c := Config{
+			NodeName:       fmt.Sprint(i),
+			BindAddr:       addr,
+			Tags:           map[string]string{"rpc_addr": addr},
+			ProbeInterval:  50 * time.Millisecond,
+			ProbeTimeout:   25 * time.Millisecond,
+			GossipInterval: 20 * time.Millisecond,
+		}
+		if i > 0 {
+			c.StartJoinAddrs = []string{members[0].BindAddr}
+		}
+		m, err := New(&handler{}, c)
+		require.NoError(t, err)
+		defer m.Leave()
+		members = append(members, m)
+	}
+	require.Eventually(t, func() bool {
+		return len(members[0].Members()) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// go down without telling the other member
+	require.NoError(t, members[1].serf.Shutdown())
+	require.Eventually(t, func() bool {
+		for _, member := range members[0].Members() {
+			if member.Name == "1" {
+				return member.Status == serf.StatusFailed
+			}
+		}
+		return false
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestMembershipJoinRetry(t *testing.T) {
+	ports := dynaport.Get(2)
+	seedAddr := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	c := Config{
+		NodeName:       "1",
+		BindAddr:       fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		Tags:           map[string]string{"rpc_addr": "127.0.0.1:0"},
+		StartJoinAddrs: []string{seedAddr},
+		JoinAttempts:   2,
+		JoinBackoff:    10 * time.Millisecond,
+	}
+
+	// nothing listens on the seed address yet
+	required := c
+	required.RequireJoin = true
+	_, err := New(&handler{}, required)
+	require.Error(t, err)
+
+	m, err := New(&handler{}, c)
+	require.NoError(t, err)
+	defer m.Leave()
+	require.Len(t, m.Members(), 1)
+
+	// the node joins once the seed comes up
+	seed, err := New(&handler{}, Config{
+		NodeName: "0",
+		BindAddr: seedAddr,
+		Tags:     map[string]string{"rpc_addr": "127.0.0.1:0"},
+	})
+	require.NoError(t, err)
+	defer seed.Leave()
+	require.Eventually(t, func() bool {
+		return len(m.Members()) == 2 && len(seed.Members()) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestMembershipEncryption(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	newMember := func(name string, key []byte, join ...string) (*Membership, error) {
+		addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+		m, err := New(&handler{}, Config{
+			NodeName:       name,
+			BindAddr:       addr,
+			Tags:           map[string]string{"rpc_addr": addr},
+			StartJoinAddrs: join,
+			RequireJoin:    true,
+			JoinAttempts:   1,
+			EncryptKey:     key,
+		})
+		if err == nil {
+			t.Cleanup(func() { m.Leave() })
+		}
+		return m, err
+	}
+
+	_, err := newMember("short", []byte("short"))
+	require.Error(t, err)
+
+	seed, err := newMember("0", key)
+	require.NoError(t, err)
+	m, err := newMember("1", key, seed.BindAddr)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(seed.Members()) == 2 && len(m.Members()) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// a node with the wrong key can't talk to the cluster
+	_, err = newMember("2", []byte("fedcba9876543210"), seed.BindAddr)
+	require.Error(t, err)
+
+	// after a rotation only the new key gets a node in
+	rotated := []byte("abcdef0123456789abcdef01")
+	require.NoError(t, seed.RotateKey(rotated))
+	_, err = newMember("3", key, seed.BindAddr)
+	require.Error(t, err)
+	_, err = newMember("4", rotated, seed.BindAddr)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(seed.Members()) == 3 && len(m.Members()) == 3
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
 func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler) {
 	// get current number of members connected
 	id := len(members)
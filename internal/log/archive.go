@@ -0,0 +1,115 @@
+package log
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	api "github.com/mrshabel/gumlog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// identifies a log archive and the version of its format. records follow the
+// header, each prefixed with the length of its encoding
+const archiveHeader = "GUMLOGA1"
+
+// Export writes every record in the log, together with its offset, to an
+// archive that Import can rebuild the log from
+func (l *Log) Export(w io.Writer) error {
+	l.mu.RLock()
+	lowest := l.segments[0].baseOffset
+	next := l.segments[len(l.segments)-1].nextOffset
+	l.mu.RUnlock()
+
+	buf := bufio.NewWriter(w)
+	if _, err := buf.WriteString(archiveHeader); err != nil {
+		return err
+	}
+	for off := lowest; off < next; off++ {
+		record, err := l.Read(off)
+		if err != nil {
+			return err
+		}
+		p, err := proto.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := binary.Write(buf, enc, uint64(len(p))); err != nil {
+			return err
+		}
+		if _, err := buf.Write(p); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// Import rebuilds the records of an archive written by Export into the log,
+// which must be empty. the records keep their offsets regardless of how the
+// log's segments are sized
+func (l *Log) Import(r io.Reader) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	l.mu.RLock()
+	empty := len(l.segments) == 1 && l.activeSegment.nextOffset == l.activeSegment.baseOffset
+	l.mu.RUnlock()
+	if !empty {
+		return fmt.Errorf("import into non-empty log")
+	}
+
+	buf := bufio.NewReader(r)
+	header := make([]byte, len(archiveHeader))
+	if _, err := io.ReadFull(buf, header); err != nil {
+		return err
+	}
+	if string(header) != archiveHeader {
+		return fmt.Errorf("invalid archive header: %q", header)
+	}
+
+	for first := true; ; first = false {
+		var size uint64
+		if err := binary.Read(buf, enc, &size); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		p := make([]byte, size)
+		if _, err := io.ReadFull(buf, p); err != nil {
+			return err
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		// start the log at the archive's first offset
+		if first {
+			if err := l.rebase(record.Offset); err != nil {
+				return err
+			}
+		}
+		want := record.Offset
+		off, err := l.Append(record)
+		if err != nil {
+			return err
+		}
+		if off != want {
+			return fmt.Errorf("archive record at offset %d imported at offset %d", want, off)
+		}
+	}
+}
+
+// replace the log's only, empty segment with one starting at the given offset
+func (l *Log) rebase(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.activeSegment.baseOffset == off {
+		return nil
+	}
+	if err := l.activeSegment.Remove(); err != nil {
+		return err
+	}
+	l.segments = nil
+	return l.newSegment(off)
+}
@@ -1,19 +1,62 @@
 package log
 
-import "github.com/hashicorp/raft"
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
 
 // log configuration
 type Config struct {
+	// open existing segments without modifying them. appends fail and no
+	// segment is created when the log holds none
+	ReadOnly bool
 	// raft configuration
 	Raft struct {
 		raft.Config
-		StreamLayer *raft.StreamLayer
+		StreamLayer *StreamLayer
 		Bootstrap   bool
+		// size of the chunks snapshots are persisted in. defaults to 64KiB
+		SnapshotChunkBytes int
+		// maximum bytes per second written when persisting a snapshot. zero
+		// leaves snapshots unthrottled
+		SnapshotBytesPerSecond int
+		// number of segments read concurrently when persisting a snapshot.
+		// segments are read one at a time when below 2
+		SnapshotReadWorkers int
+		// number of snapshots kept on disk so an older one can be restored
+		// when the latest is corrupt. defaults to 1
+		SnapshotRetained int
+		// number of recently read raft entries cached in memory to serve
+		// repeated reads during replication. defaults to 512
+		LogCacheSize int
 	}
 	// maximum bytes for the store and index
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// expected size of a record's data. when set and MaxIndexBytes is
+		// unset, the index is sized to fill up together with the store
+		AvgRecordBytes uint64
+		// grow store files to MaxStoreBytes when segments are created to
+		// reduce fragmentation. the unused space is trimmed on close
+		Preallocate bool
+		// read and write index files with ordinary file I/O instead of memory
+		// mapping them. builds with the nommap tag never memory map them
+		DisableMmap bool
+		// bytes of appended records buffered in memory before they are
+		// written to a store file. defaults to 4KB
+		WriteBufferSize int
+		// bytes read from a store file at once when reading a record, so that
+		// records fitting in it take a single read instead of one for their
+		// length and one for their data. zero reads them separately
+		ReadBufferSize int
+		// opens the store of each segment. defaults to files in the log's
+		// directory
+		OpenStore StoreOpener
+		// maximum duration the active segment stays open for writes before a
+		// new segment is rolled, regardless of its size. zero disables it
+		MaxAge time.Duration
 	}
 }
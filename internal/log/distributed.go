@@ -2,29 +2,136 @@ package log
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
 	api "github.com/mrshabel/gumlog/api/v1"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"golang.org/x/time/rate"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// fsm snapshots persisted
+	snapshots = stats.Int64("gumlog/snapshots", "fsm snapshots persisted", stats.UnitDimensionless)
+	// SnapshotsView counts the snapshots raft persisted of the log. it must
+	// be registered to be exported
+	SnapshotsView = &view.View{
+		Name:        "gumlog/snapshots",
+		Measure:     snapshots,
+		Description: "number of fsm snapshots persisted",
+		Aggregation: view.Count(),
+	}
 )
 
 type DistributedLog struct {
 	config Config
 	log    *Log
+	fsm    *fsm
 	raft   *raft.Raft
+	// raft's own stores, closed after raft shuts down
+	logStore    *logStore
+	stableStore *raftboltdb.BoltStore
 }
 
 // fsm is the finite-state machine that is responsible for handling all business logic for the internal log.
 type fsm struct {
 	log *Log
+	// size of the chunks snapshots are persisted in
+	chunkBytes int
+	// throttles snapshot writes when set
+	limiter *rate.Limiter
+	// number of segments read concurrently for snapshots
+	readWorkers int
+	// appends stored in the raft log that haven't been applied yet
+	pending *pendingAppends
+}
+
+// pendingAppends tracks the raft indexes of the append entries this server
+// stored but hasn't applied to its log yet. entries stored before a restart
+// aren't tracked, so their records read as out of range until applied
+type pendingAppends struct {
+	mu sync.Mutex
+	// in increasing order, as raft stores entries
+	indexes []uint64
+}
+
+// track the append entries among the stored raft entries
+func (p *pendingAppends) store(records []*raft.Log) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, record := range records {
+		if record.Type == raft.LogCommand && len(record.Data) > 0 && RequestType(record.Data[0]) == AppendRequestType {
+			p.indexes = append(p.indexes, record.Index)
+		}
+	}
+}
+
+// forget the entries up to the given index once it's applied
+func (p *pendingAppends) applied(index uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := sort.Search(len(p.indexes), func(i int) bool { return p.indexes[i] > index })
+	p.indexes = p.indexes[n:]
+}
+
+// forget the entries within [min, max] removed from the raft log
+func (p *pendingAppends) delete(min, max uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lo := sort.Search(len(p.indexes), func(i int) bool { return p.indexes[i] >= min })
+	hi := sort.Search(len(p.indexes), func(i int) bool { return p.indexes[i] > max })
+	p.indexes = append(p.indexes[:lo], p.indexes[hi:]...)
+}
+
+// forget every entry, such as when a snapshot replaces the log
+func (p *pendingAppends) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.indexes = nil
+}
+
+// count the tracked appends committed up to the given index
+func (p *pendingAppends) committed(commit uint64) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return uint64(sort.Search(len(p.indexes), func(i int) bool { return p.indexes[i] > commit }))
+}
+
+// default size of the chunks snapshots are persisted in
+const defaultSnapshotChunkBytes = 64 << 10
+
+// create the fsm of the given log, persisting snapshots as configured
+func newFSM(l *Log, c Config) *fsm {
+	f := &fsm{
+		log:         l,
+		chunkBytes:  c.Raft.SnapshotChunkBytes,
+		readWorkers: c.Raft.SnapshotReadWorkers,
+		pending:     &pendingAppends{},
+	}
+	if f.chunkBytes <= 0 {
+		f.chunkBytes = defaultSnapshotChunkBytes
+	}
+	if c.Raft.SnapshotBytesPerSecond > 0 {
+		// a chunk is never written in more than one burst
+		f.limiter = rate.NewLimiter(rate.Limit(c.Raft.SnapshotBytesPerSecond), max(f.chunkBytes, c.Raft.SnapshotBytesPerSecond))
+	}
+	return f
 }
 
 // NewDistributedLog sets up a new instance of a distributed log which achieves consensus with raft
@@ -57,7 +164,8 @@ func (l *DistributedLog) setupLog(dataDir string) error {
 
 func (l *DistributedLog) setupRaft(dataDir string) error {
 	// setup finite-state machine
-	fsm := &fsm{log: l.log}
+	fsm := newFSM(l.log, l.config)
+	l.fsm = fsm
 
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
@@ -71,6 +179,8 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if err != nil {
 		return err
 	}
+	logStore.pending = fsm.pending
+	l.logStore = logStore
 
 	// setup stable store to keep cluster configuration and metadata
 	storePath := filepath.Join(dataDir, "raft", "stable")
@@ -78,10 +188,14 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if err != nil {
 		return err
 	}
+	l.stableStore = stableStore
 
 	// setup snapshot store to hold snapshotted data. this will include everything in the raft data directory
 	snapshotPath := filepath.Join(dataDir, "raft")
 	maxSnapshotRetained := 1
+	if l.config.Raft.SnapshotRetained != 0 {
+		maxSnapshotRetained = l.config.Raft.SnapshotRetained
+	}
 	snapshotStore, err := raft.NewFileSnapshotStore(snapshotPath, maxSnapshotRetained, os.Stderr)
 	if err != nil {
 		return err
@@ -91,25 +205,11 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	maxPool := 5
 	timeout := 10 * time.Second
 	transport := raft.NewNetworkTransport(
-		*l.config.Raft.StreamLayer, maxPool, timeout, os.Stderr,
+		l.config.Raft.StreamLayer, maxPool, timeout, os.Stderr,
 	)
 
 	// setup raft configuration
-	config := raft.DefaultConfig()
-	// assign unique mandatory node ID to the server
-	config.LocalID = l.config.Raft.LocalID
-	if l.config.Raft.HeartbeatTimeout != 0 {
-		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
-	}
-	if l.config.Raft.ElectionTimeout != 0 {
-		config.ElectionTimeout = l.config.Raft.ElectionTimeout
-	}
-	if l.config.Raft.LeaderLeaseTimeout != 0 {
-		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
-	}
-	if l.config.Raft.CommitTimeout != 0 {
-		config.CommitTimeout = l.config.Raft.CommitTimeout
-	}
+	config := raftConfig(l.config.Raft.Config)
 
 	// create raft instance
 	l.raft, err = raft.NewRaft(config, fsm, logStore, stableStore, snapshotStore, transport)
@@ -126,10 +226,45 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	return err
 }
 
+// raftConfig merges the fields set in the given config over raft's defaults.
+// fields left at their zero value keep the default, so options that default
+// to true, such as ShutdownOnRemove, can't be turned off
+func raftConfig(c raft.Config) *raft.Config {
+	config := raft.DefaultConfig()
+	merged := reflect.ValueOf(config).Elem()
+	set := reflect.ValueOf(c)
+	for i := range set.NumField() {
+		field := merged.Field(i)
+		if field.CanSet() && !set.Field(i).IsZero() {
+			field.Set(set.Field(i))
+		}
+	}
+	return config
+}
+
 // Append adds a new record to the distributed log
 func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	return l.AppendAcks(record, api.Acks_LEADER)
+}
+
+// AppendAcks adds a new record to the distributed log, returning once it's
+// acknowledged at the given level. the leader only appends records to its
+// log once a quorum stored them, so acks LEADER and ALL both wait for the
+// record to be committed. acks NONE returns once the record is submitted to
+// raft, with an unknown offset of 0
+func (l *DistributedLog) AppendAcks(record *api.Record, acks api.Acks) (uint64, error) {
+	// stamp the record before it's replicated so every server stores the
+	// same time
+	if record.Timestamp == nil {
+		record.Timestamp = timestamppb.Now()
+	}
+	req := &api.ProduceRequest{Record: record}
+	if acks == api.Acks_NONE {
+		_, err := l.submit(AppendRequestType, req)
+		return 0, err
+	}
 	// apply write to the raft fsm
-	res, err := l.apply(AppendRequestType, &api.ProduceRequest{Record: record})
+	res, err := l.apply(AppendRequestType, req)
 	if err != nil {
 		return 0, err
 	}
@@ -137,8 +272,43 @@ func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
 	return res.(*api.ProduceResponse).Offset, nil
 }
 
+// Flush does nothing. records appended with acks LEADER or ALL count as
+// durable once raft commits them on a quorum of servers, not once the log
+// they're applied to is synced to disk
+func (l *DistributedLog) Flush() error {
+	return nil
+}
+
 // apply wraps Raft Apply API and is used to inform the fsm to append a record to the log
 func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interface{}, error) {
+	future, err := l.submit(reqType, req)
+	if err != nil {
+		return nil, err
+	}
+	// check for raft errors, (timeouts...)
+	if err := future.Error(); err != nil {
+		// leadership was lost while applying
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return nil, api.ErrNotLeader{LeaderAddr: l.LeaderAddr()}
+		}
+		return nil, err
+	}
+	// get response
+	res := future.Response()
+	// check if a service error was returned in the process
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// submit a command to raft without waiting for it to be applied
+func (l *DistributedLog) submit(reqType RequestType, req proto.Message) (raft.ApplyFuture, error) {
+	// only the leader applies writes. followers point clients to it
+	if l.raft.State() != raft.Leader {
+		return nil, api.ErrNotLeader{LeaderAddr: l.LeaderAddr()}
+	}
 	// write req type (append) and message to buffer slice
 	var buf bytes.Buffer
 	if _, err := buf.Write([]byte{byte(reqType)}); err != nil {
@@ -155,24 +325,141 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interfac
 
 	// apply command to raft fsm. this replicates the record and appends it to the leader's log
 	timeout := 10 * time.Second
-	future := l.raft.Apply(buf.Bytes(), timeout)
-	// check for raft errors, (timeouts...)
-	if future.Error() != nil {
-		return nil, future.Error()
+	return l.raft.Apply(buf.Bytes(), timeout), nil
+}
+
+// Read reads a record for the given offset from the server's log. This uses a "relaxed consistency" since reads does not go through raft here
+func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
+	// offsets past the end of the local log may already be committed,
+	// waiting to be applied
+	if _, next := l.log.OffsetBounds(); offset >= next && l.fsm.pending.committed(l.raft.CommitIndex()) > offset-next {
+		return nil, api.ErrNotReplicatedYet{Offset: offset}
 	}
-	// get response
-	res := future.Response()
-	// check if a service error was returned in the process
-	if err, ok := res.(error); ok {
+	return l.log.Read(offset)
+}
+
+// Join adds the server to the raft cluster. voters take part in leader
+// elections and count toward quorum while non-voters only replicate the log,
+// which scales reads without affecting quorum
+func (l *DistributedLog) Join(id, addr string, voter bool) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			// server has already joined with the same suffrage
+			if srv.ID == serverID && srv.Address == serverAddr && (srv.Suffrage == raft.Voter) == voter {
+				return nil
+			}
+			// remove the existing server before adding it back
+			if err := l.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if voter {
+		return l.raft.AddVoter(serverID, serverAddr, 0, 0).Error()
+	}
+	return l.raft.AddNonvoter(serverID, serverAddr, 0, 0).Error()
+}
+
+// Leave removes the server from the raft cluster
+func (l *DistributedLog) Leave(id string) error {
+	return l.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+// GetServers returns the servers in the raft cluster, marking the leader and
+// which servers are voters
+func (l *DistributedLog) GetServers() ([]*api.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
 		return nil, err
 	}
+	_, leaderID := l.raft.LeaderWithID()
+	var servers []*api.Server
+	for _, srv := range future.Configuration().Servers {
+		servers = append(servers, &api.Server{
+			Id:       string(srv.ID),
+			RpcAddr:  string(srv.Address),
+			IsLeader: srv.ID == leaderID,
+			Voter:    srv.Suffrage == raft.Voter,
+		})
+	}
+	return servers, nil
+}
 
-	return res, nil
+// LeaderAddr returns the raft address of the cluster's leader, or an empty
+// string when there is no known leader
+func (l *DistributedLog) LeaderAddr() string {
+	addr, _ := l.raft.LeaderWithID()
+	return string(addr)
 }
 
-// Read reads a record for the given offset from the server's log. This uses a "relaxed consistency" since reads does not go through raft here
-func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
-	return l.log.Read(offset)
+// WaitForLeader blocks until the cluster has elected a leader or the timeout
+// elapses
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out waiting for leader")
+		case <-ticker.C:
+			if addr, _ := l.raft.LeaderWithID(); addr != "" {
+				return nil
+			}
+		}
+	}
+}
+
+// NextOffset returns the first offset at or after the given one that holds a
+// record in the server's log
+func (l *DistributedLog) NextOffset(after uint64) (uint64, bool) {
+	return l.log.NextOffset(after)
+}
+
+// OffsetBounds returns the cached offset bounds of the server's log
+func (l *DistributedLog) OffsetBounds() (lowest, next uint64) {
+	return l.log.OffsetBounds()
+}
+
+// Snapshot has raft snapshot the server's log now rather than at its next
+// snapshot interval. only the leader takes snapshots on demand. a log with no
+// entries since the latest snapshot is already captured by it
+func (l *DistributedLog) Snapshot() error {
+	if l.raft.State() != raft.Leader {
+		return api.ErrNotLeader{LeaderAddr: l.LeaderAddr()}
+	}
+	err := l.raft.Snapshot().Error()
+	if errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		return nil
+	}
+	return err
+}
+
+// Close shuts down the raft instance and closes raft's stores and the server's
+// log
+func (l *DistributedLog) Close() error {
+	if err := l.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if err := l.stableStore.Close(); err != nil {
+		return err
+	}
+	if err := l.logStore.Close(); err != nil {
+		return err
+	}
+	return l.log.Close()
+}
+
+// Stats returns the statistics of the server's log
+func (l *DistributedLog) Stats() Stats {
+	return l.log.Stats()
 }
 
 // enfore raft.FSM behavior on the internal fsm defined
@@ -190,6 +477,9 @@ func (l *fsm) Apply(record *raft.Log) interface{} {
 	// extract the data from the raft log
 	buf := record.Data
 
+	// the entry is no longer pending once the log holds its record
+	defer l.pending.applied(record.Index)
+
 	// get the request type
 	reqType := RequestType(buf[0])
 	switch reqType {
@@ -215,7 +505,9 @@ func (f *fsm) applyAppend(b []byte) interface{} {
 
 // snapshotting
 type snapshot struct {
-	reader io.Reader
+	reader     io.ReadCloser
+	chunkBytes int
+	limiter    *rate.Limiter
 }
 
 var _ raft.FSMSnapshot = (*snapshot)(nil)
@@ -223,23 +515,62 @@ var _ raft.FSMSnapshot = (*snapshot)(nil)
 // Snapshot creates and returns a point-in-time snapshot of the FSM state
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 	// get entire log state
-	r := f.log.Reader()
-	return &snapshot{reader: r}, nil
+	var r io.ReadCloser
+	if f.readWorkers > 1 {
+		r = f.log.ParallelReader(f.readWorkers)
+	} else {
+		r = f.log.Reader()
+	}
+	return &snapshot{reader: r, chunkBytes: f.chunkBytes, limiter: f.limiter}, nil
 }
 
-// Persist writes the FSM state to the underlying sink, a file in this case
+// Persist writes the FSM state to the underlying sink, a file in this case.
+// the state is copied in chunks, waiting on the rate limit before each one,
+// and the snapshot is cancelled as soon as a chunk can't be read or written
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
-	// write snapshotted data from log to the raft sink
-	if _, err := io.Copy(sink, s.reader); err != nil {
+	chunk := make([]byte, s.chunkBytes)
+	for {
+		n, err := s.reader.Read(chunk)
+		if n > 0 {
+			if s.limiter != nil {
+				if werr := s.limiter.WaitN(context.Background(), n); werr != nil {
+					sink.Cancel()
+					return werr
+				}
+			}
+			// write snapshotted data from log to the raft sink
+			if _, werr := sink.Write(chunk[:n]); werr != nil {
+				sink.Cancel()
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sink.Cancel()
+			return err
+		}
+	}
+	if err := sink.Close(); err != nil {
 		return err
 	}
-	return sink.Close()
+	stats.Record(context.Background(), snapshots.M(1))
+	return nil
 }
 
-func (s *snapshot) Release() {}
+// stop reading segments ahead once the snapshot is done with
+func (s *snapshot) Release() {
+	s.reader.Close()
+}
 
-// Restore restores an FSM from a snapshot
+// Restore restores an FSM from a snapshot. the snapshot must hold records with
+// contiguous offsets, otherwise the restore fails
 func (f *fsm) Restore(r io.ReadCloser) error {
+	// the snapshot replaces the entries stored so far. entries stored after
+	// it are no longer tracked, so their records read as out of range until
+	// they're applied
+	f.pending.reset()
 	// get record length
 	b := make([]byte, lenWidth)
 	var buf bytes.Buffer
@@ -247,6 +578,10 @@ func (f *fsm) Restore(r io.ReadCloser) error {
 		_, err := io.ReadFull(r, b)
 		if err != nil {
 			if err == io.EOF {
+				// an empty snapshot restores an empty log
+				if i == 0 {
+					return f.log.Clear()
+				}
 				break
 			}
 			return err
@@ -257,28 +592,43 @@ func (f *fsm) Restore(r io.ReadCloser) error {
 			return err
 		}
 		record := &api.Record{}
-		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
+		if err = decodeRecord(buf.Bytes(), record); err != nil {
 			return err
 		}
 
 		// use the record length as the initial offset for the first record
 		if i == 0 {
 			f.log.Config.Segment.InitialOffset = record.Offset
-			if err := f.log.Reset(); err != nil {
+			if err := f.log.Clear(); err != nil {
 				return err
 			}
 		}
-		if _, err = f.log.Append(record); err != nil {
+		// the offset assigned by the log must match the snapshotted offset
+		want := record.Offset
+		off, err := f.log.Append(record)
+		if err != nil {
 			return err
 		}
+		if off != want {
+			return fmt.Errorf("snapshot record %d has offset %d, expected %d", i, want, off)
+		}
 		buf.Reset()
 	}
 	return nil
 }
 
+// default number of raft entries cached by the log store
+const defaultLogCacheSize = 512
+
 // log store
 type logStore struct {
 	*Log
+	// recently read entries by their index
+	cache *lru.Cache
+	// reads records from the log, swapped out in tests
+	read func(off uint64) (*api.Record, error)
+	// tracks the stored appends until they're applied
+	pending *pendingAppends
 }
 
 var _ raft.LogStore = (*logStore)(nil)
@@ -288,7 +638,15 @@ func newLogStore(dir string, cfg Config) (*logStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &logStore{log}, nil
+	size := cfg.Raft.LogCacheSize
+	if size == 0 {
+		size = defaultLogCacheSize
+	}
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{Log: log, cache: cache, read: log.Read, pending: &pendingAppends{}}, nil
 }
 
 func (l *logStore) FirstIndex() (uint64, error) {
@@ -301,8 +659,12 @@ func (l *logStore) LastIndex() (uint64, error) {
 
 // GetLog retrieves a record at a given index
 func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	if cached, ok := l.cache.Get(index); ok {
+		*out = *cached.(*raft.Log)
+		return nil
+	}
 	// retrieve the data at a given index
-	in, err := l.Read(index)
+	in, err := l.read(index)
 	if err != nil {
 		return err
 	}
@@ -310,6 +672,8 @@ func (l *logStore) GetLog(index uint64, out *raft.Log) error {
 	out.Index = in.Offset
 	out.Type = raft.LogType(in.Type)
 	out.Term = in.Term
+	entry := *out
+	l.cache.Add(index, &entry)
 	return nil
 }
 
@@ -319,20 +683,53 @@ func (l *logStore) StoreLog(record *raft.Log) error {
 
 func (l *logStore) StoreLogs(records []*raft.Log) error {
 	for _, record := range records {
-		if _, err := l.Append(&api.Record{
+		r := &api.Record{
 			Value: record.Data,
 			Term:  record.Term,
 			Type:  uint32(record.Type),
-		}); err != nil {
+		}
+		// keep the time raft appended the entry at rather than stamping it again
+		if !record.AppendedAt.IsZero() {
+			r.Timestamp = timestamppb.New(record.AppendedAt)
+		}
+		if _, err := l.Append(r); err != nil {
 			return err
 		}
 	}
+	// raft takes stored entries as durable, so they must survive a crash
+	// rather than be trimmed back to an older checkpoint when reopened
+	if err := l.Flush(); err != nil {
+		return err
+	}
+	l.pending.store(records)
 	return nil
 }
 
-// Delete old records
+// DeleteRange removes the records within [min, max]. raft only deletes a prefix
+// of the log when compacting it after a snapshot, or a suffix when resolving
+// conflicting entries from a new leader. ranges that would leave a hole in the
+// log are rejected
 func (l *logStore) DeleteRange(min, max uint64) error {
-	return l.Truncate(max)
+	// deleted indexes may be stored again with different entries
+	defer l.cache.Purge()
+	l.pending.delete(min, max)
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	highest, err := l.HighestOffset()
+	if err != nil {
+		return err
+	}
+	switch {
+	case min <= lowest:
+		// prefix truncation only drops segments whose records are all within range
+		return l.Truncate(max)
+	case max >= highest:
+		return l.truncateFrom(min)
+	default:
+		return fmt.Errorf("unsupported delete range [%d, %d]: only prefix or suffix ranges can be deleted", min, max)
+	}
 }
 
 // stream layer
@@ -0,0 +1,594 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	api "github.com/mrshabel/gumlog/api/v1"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLogStoreDeleteRange(t *testing.T) {
+	table := map[string]func(t *testing.T, l *logStore){
+		"prefix range keeps later records":   testDeleteRangePrefix,
+		"suffix range keeps earlier records": testDeleteRangeSuffix,
+		"middle range is rejected":           testDeleteRangeMiddle,
+	}
+	for scenario, fn := range table {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "log-store-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// raft indexes start at 1. two records fit in each segment
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32
+			c.Segment.InitialOffset = 1
+			l, err := newLogStore(dir, c)
+			require.NoError(t, err)
+			defer l.Close()
+
+			// store records with indexes 1-5 across three segments. the
+			// entries carry a fixed time so that their size doesn't vary
+			for i := uint64(1); i <= 5; i++ {
+				require.NoError(t, l.StoreLog(&raft.Log{Index: i, Data: []byte("record"), AppendedAt: stamp.AsTime()}))
+			}
+			fn(t, l)
+		})
+	}
+}
+
+func testDeleteRangePrefix(t *testing.T, l *logStore) {
+	require.NoError(t, l.DeleteRange(1, 2))
+
+	first, err := l.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), first)
+	for i := uint64(3); i <= 5; i++ {
+		require.NoError(t, l.GetLog(i, &raft.Log{}))
+	}
+}
+
+func testDeleteRangeSuffix(t *testing.T, l *logStore) {
+	require.NoError(t, l.DeleteRange(4, 5))
+
+	// records below min survive
+	for i := uint64(1); i <= 3; i++ {
+		require.NoError(t, l.GetLog(i, &raft.Log{}))
+	}
+	for i := uint64(4); i <= 5; i++ {
+		require.Error(t, l.GetLog(i, &raft.Log{}))
+	}
+	last, err := l.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), last)
+
+	// new records continue from the truncation point
+	require.NoError(t, l.StoreLog(&raft.Log{Index: 4, Data: []byte("replaced")}))
+	var out raft.Log
+	require.NoError(t, l.GetLog(4, &out))
+	require.Equal(t, []byte("replaced"), out.Data)
+}
+
+func testDeleteRangeMiddle(t *testing.T, l *logStore) {
+	require.Error(t, l.DeleteRange(2, 3))
+
+	// nothing is removed
+	for i := uint64(1); i <= 5; i++ {
+		require.NoError(t, l.GetLog(i, &raft.Log{}))
+	}
+}
+
+// test that stored entries are checkpointed before raft takes them as durable,
+// so reopening the log store after a crash doesn't trim them
+func TestLogStoreCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.InitialOffset = 1
+	l, err := newLogStore(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, l.StoreLogs([]*raft.Log{
+		{Index: 1, Term: 1, Data: []byte("record")},
+		{Index: 2, Term: 1, Data: []byte("record")},
+	}))
+	off, ok, err := readCheckpoint(segmentPath(dir, 1, ".checkpoint"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), off)
+}
+
+func TestLogStoreCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-store-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.InitialOffset = 1
+	l, err := newLogStore(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// count the reads that reach the log
+	reads := 0
+	l.read = func(off uint64) (*api.Record, error) {
+		reads++
+		return l.Log.Read(off)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		require.NoError(t, l.StoreLog(&raft.Log{Index: i, Term: 1, Data: []byte("record")}))
+	}
+
+	for range 3 {
+		var out raft.Log
+		require.NoError(t, l.GetLog(2, &out))
+		require.Equal(t, raft.Log{Index: 2, Term: 1, Data: []byte("record")}, out)
+	}
+	require.Equal(t, 1, reads)
+
+	// replaced entries are read again
+	require.NoError(t, l.DeleteRange(2, 3))
+	require.NoError(t, l.StoreLog(&raft.Log{Index: 2, Term: 2, Data: []byte("replaced")}))
+	var out raft.Log
+	require.NoError(t, l.GetLog(2, &out))
+	require.Equal(t, []byte("replaced"), out.Data)
+	require.Equal(t, 2, reads)
+}
+
+// test that appends are pending from when they're stored until they're
+// applied, and only count once committed
+func TestPendingAppends(t *testing.T) {
+	entry := func(index uint64, reqType RequestType) *raft.Log {
+		return &raft.Log{Index: index, Type: raft.LogCommand, Data: []byte{byte(reqType)}}
+	}
+	p := &pendingAppends{}
+	p.store([]*raft.Log{
+		entry(1, AppendRequestType),
+		{Index: 2, Type: raft.LogConfiguration},
+		entry(3, AppendRequestType),
+		entry(4, AppendRequestType),
+		entry(5, AppendRequestType),
+	})
+	require.Equal(t, uint64(4), p.committed(5))
+	// entries past the commit index aren't counted yet
+	require.Equal(t, uint64(2), p.committed(3))
+
+	p.applied(3)
+	require.Equal(t, uint64(2), p.committed(5))
+	// a new leader replaces the conflicting suffix
+	p.delete(5, 5)
+	require.Equal(t, uint64(1), p.committed(5))
+	p.store([]*raft.Log{entry(5, AppendRequestType)})
+	require.Equal(t, uint64(2), p.committed(5))
+
+	p.reset()
+	require.Zero(t, p.committed(5))
+}
+
+func TestFSMRestore(t *testing.T) {
+	table := map[string]struct {
+		offsets []uint64
+		wantErr bool
+	}{
+		"contiguous offsets":   {offsets: []uint64{3, 4, 5}},
+		"empty snapshot":       {offsets: nil},
+		"offset gap fails":     {offsets: []uint64{3, 5}, wantErr: true},
+		"offset reorder fails": {offsets: []uint64{3, 2}, wantErr: true},
+	}
+	for scenario, tc := range table {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "fsm-restore-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			l, err := NewLog(dir, Config{})
+			require.NoError(t, err)
+			defer l.Close()
+			// existing state must be replaced by the snapshot
+			_, err = l.Append(&api.Record{Value: []byte("stale")})
+			require.NoError(t, err)
+
+			// encode records in the same format the log reader produces
+			var snapshot bytes.Buffer
+			for _, off := range tc.offsets {
+				p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: off})
+				require.NoError(t, err)
+				require.NoError(t, binary.Write(&snapshot, enc, uint64(len(p))))
+				snapshot.Write(p)
+			}
+
+			f := newFSM(l, Config{})
+			err = f.Restore(io.NopCloser(&snapshot))
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			if len(tc.offsets) == 0 {
+				// the log is empty but still accepts appends
+				_, err = l.Read(0)
+				require.Error(t, err)
+				_, err = l.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+				return
+			}
+			for _, off := range tc.offsets {
+				record, err := l.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, off, record.Offset)
+			}
+		})
+	}
+}
+
+// snapshotSink keeps a persisted snapshot in memory, tracking its writes
+type snapshotSink struct {
+	bytes.Buffer
+	writes    int
+	largest   int
+	closed    bool
+	cancelled bool
+}
+
+func (s *snapshotSink) Write(p []byte) (int, error) {
+	s.writes++
+	s.largest = max(s.largest, len(p))
+	return s.Buffer.Write(p)
+}
+
+func (s *snapshotSink) ID() string { return "test" }
+
+func (s *snapshotSink) Cancel() error {
+	s.cancelled = true
+	return nil
+}
+
+func (s *snapshotSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestFSMSnapshotChunks(t *testing.T) {
+	dir, err := os.MkdirTemp("", "fsm-snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	const records = 500
+	for i := range records {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	c.Raft.SnapshotChunkBytes = 256
+	c.Raft.SnapshotBytesPerSecond = 10 << 20
+	f := newFSM(l, c)
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+	require.True(t, sink.closed)
+	require.False(t, sink.cancelled)
+	// the log is written in many chunks of at most the configured size
+	require.Equal(t, 256, sink.largest)
+	require.GreaterOrEqual(t, sink.writes, sink.Len()/256)
+
+	// the persisted snapshot restores the whole log
+	restoreDir, err := os.MkdirTemp("", "fsm-snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoreDir)
+	restored, err := NewLog(restoreDir, Config{})
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, newFSM(restored, Config{}).Restore(io.NopCloser(&sink.Buffer)))
+	for i := range uint64(records) {
+		record, err := restored.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+}
+
+func TestDistributedLogSnapshotRetained(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "distributed-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config := Config{}
+	config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = "0"
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.Bootstrap = true
+	config.Raft.SnapshotRetained = 3
+	// keep raft from taking snapshots on its own
+	config.Raft.SnapshotInterval = time.Hour
+	config.Raft.TrailingLogs = 2
+	l, err := NewDistributedLog(dataDir, config)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+
+	// raft settings are passed through while the rest keep their defaults
+	raftConfig := l.raft.ReloadableConfig()
+	require.Equal(t, uint64(2), raftConfig.TrailingLogs)
+	require.Equal(t, time.Hour, raftConfig.SnapshotInterval)
+	require.Equal(t, raft.DefaultConfig().SnapshotThreshold, raftConfig.SnapshotThreshold)
+
+	// every snapshot needs new entries to capture
+	for i := range 4 {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		require.NoError(t, l.raft.Snapshot().Error())
+	}
+	snapshots, err := os.ReadDir(filepath.Join(dataDir, "raft", "snapshots"))
+	require.NoError(t, err)
+	require.Len(t, snapshots, 3)
+}
+
+func TestDistributedLogAcks(t *testing.T) {
+	// a leader and a voting follower, so that commits need both
+	var logs []*DistributedLog
+	for i := range 2 {
+		dataDir, err := os.MkdirTemp("", "distributed-log-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		// a lease long enough for the leader to take writes after losing
+		// its follower
+		config.Raft.HeartbeatTimeout = 500 * time.Millisecond
+		config.Raft.ElectionTimeout = 500 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 500 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String(), true))
+		}
+		logs = append(logs, l)
+	}
+	leader, follower := logs[0], logs[1]
+	defer leader.Close()
+
+	// acks=all returns once the follower stored the record too
+	off, err := leader.AppendAcks(&api.Record{Value: []byte("all")}, api.Acks_ALL)
+	require.NoError(t, err)
+	_, err = leader.Read(off)
+	require.NoError(t, err)
+
+	// without the follower no record can be committed. acks=none returns
+	// regardless while acks=all waits until it fails
+	require.NoError(t, follower.Close())
+	start := time.Now()
+	_, err = leader.AppendAcks(&api.Record{Value: []byte("none")}, api.Acks_NONE)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+	_, err = leader.AppendAcks(&api.Record{Value: []byte("all")}, api.Acks_ALL)
+	require.Error(t, err)
+	_, err = leader.Read(off + 1)
+	require.Error(t, err)
+}
+
+// test that a follower reading records committed by the leader but not yet
+// applied to its log is told to retry, unlike reads of nonexistent offsets
+func TestDistributedLogNotReplicatedYet(t *testing.T) {
+	var logs []*DistributedLog
+	for i := range 2 {
+		dataDir, err := os.MkdirTemp("", "distributed-log-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 500 * time.Millisecond
+		config.Raft.ElectionTimeout = 500 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 500 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String(), true))
+		}
+		logs = append(logs, l)
+	}
+	leader, follower := logs[0], logs[1]
+
+	off, err := leader.Append(&api.Record{Value: []byte("applied")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := follower.Read(off)
+		return err == nil
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// the follower stores the next record in its raft log, letting the leader
+	// commit it, but can't apply it while its log is locked. the record is
+	// pending once the follower learns it's committed
+	follower.log.mu.Lock()
+	off, err = leader.Append(&api.Record{Value: []byte("committed")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return follower.raft.CommitIndex() >= leader.raft.CommitIndex()
+	}, 3*time.Second, 10*time.Millisecond)
+	_, err = follower.Read(off)
+	require.ErrorAs(t, err, &api.ErrNotReplicatedYet{})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	follower.log.mu.Unlock()
+
+	require.Eventually(t, func() bool {
+		record, err := follower.Read(off)
+		return err == nil && string(record.Value) == "committed"
+	}, 3*time.Second, 10*time.Millisecond)
+	_, err = follower.Read(off + 1)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+}
+
+func TestDistributedLogNonVoter(t *testing.T) {
+	// the leader and a non-voting follower
+	var logs []*DistributedLog
+	var addrs []string
+	for i := range 2 {
+		dataDir, err := os.MkdirTemp("", "distributed-log-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String(), false))
+		}
+		logs = append(logs, l)
+		addrs = append(addrs, ln.Addr().String())
+	}
+	leader, follower := logs[0], logs[1]
+	defer leader.Close()
+
+	// the non-voter replicates the leader's records
+	off, err := leader.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		record, err := follower.Read(off)
+		return err == nil && string(record.Value) == "first"
+	}, 3*time.Second, 50*time.Millisecond)
+
+	require.Equal(t, addrs[0], leader.LeaderAddr())
+	require.Equal(t, addrs[0], follower.LeaderAddr())
+
+	// writes to the follower are redirected to the leader
+	_, err = follower.Append(&api.Record{Value: []byte("redirected")})
+	var notLeader api.ErrNotLeader
+	require.ErrorAs(t, err, &notLeader)
+	require.Equal(t, addrs[0], notLeader.LeaderAddr)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	servers, err := leader.GetServers()
+	require.NoError(t, err)
+	require.Len(t, servers, 2)
+	require.Equal(t, "0", servers[0].Id)
+	require.True(t, servers[0].IsLeader)
+	require.True(t, servers[0].Voter)
+	require.Equal(t, "1", servers[1].Id)
+	require.False(t, servers[1].IsLeader)
+	require.False(t, servers[1].Voter)
+
+	// the leader keeps its quorum with the non-voter down
+	require.NoError(t, follower.Close())
+	_, err = leader.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	addr, _ := leader.raft.LeaderWithID()
+	require.NotEmpty(t, addr)
+}
+
+func TestDistributedLogSnapshot(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "distributed-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	newLog := func() *DistributedLog {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = "0"
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = true
+		config.Raft.SnapshotInterval = time.Hour
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+		return l
+	}
+
+	// snapshots taken are counted
+	require.NoError(t, view.Register(SnapshotsView))
+	defer view.Unregister(SnapshotsView)
+	snapshotCount := func() int64 {
+		rows, err := view.RetrieveData(SnapshotsView.Name)
+		require.NoError(t, err)
+		if len(rows) == 0 {
+			return 0
+		}
+		return rows[0].Data.(*view.CountData).Value
+	}
+
+	l := newLog()
+	for i := range 3 {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Snapshot())
+	snapshots, err := os.ReadDir(filepath.Join(dataDir, "raft", "snapshots"))
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	require.Equal(t, int64(1), snapshotCount())
+	// nothing new to capture
+	require.NoError(t, l.Snapshot())
+	require.NoError(t, l.Close())
+
+	// without its local log the server restores the records from the snapshot
+	require.NoError(t, os.RemoveAll(filepath.Join(dataDir, "log")))
+	l = newLog()
+	defer l.Close()
+	for i := range uint64(3) {
+		record, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+}
@@ -1,12 +1,15 @@
 package log
 
 import (
+	"errors"
 	"io"
 	"os"
-
-	"github.com/tysonmote/gommap"
+	"sort"
 )
 
+// ErrIndexFull is returned when an index has no space left for another entry
+var ErrIndexFull = errors.New("index is full")
+
 var (
 	// offset width for index in bytes
 	offWidth uint64 = 4
@@ -16,13 +19,28 @@ var (
 	entWidth = offWidth + posWidth
 )
 
+// indexData holds the raw entries of an index file. it is memory mapped
+// where supported and read through ordinary file I/O otherwise
+type indexData interface {
+	io.ReaderAt
+	io.WriterAt
+	// persist written entries to disk
+	Sync() error
+	// release the data. the underlying file is left open
+	Close() error
+}
+
 type index struct {
 	// persisted file
 	file *os.File
-	// memory mapped file for faster reads
-	mmap gommap.MMap
+	// entries of the file, memory mapped for faster reads by default
+	data indexData
+	// number of bytes available for entries
+	capacity uint64
 	// size of index and location where next write will be appended
 	size uint64
+	// whether the file is used as is for reads only
+	readOnly bool
 }
 
 // create a new instance of the index file
@@ -35,27 +53,40 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	}
 	idx.size = uint64(fi.Size())
 
+	// use a read-only index as it is. an empty file can't be mapped
+	if c.ReadOnly {
+		idx.readOnly = true
+		idx.capacity = idx.size
+		if idx.size == 0 {
+			return idx, nil
+		}
+		if idx.data, err = openIndexData(f, c); err != nil {
+			return nil, err
+		}
+		return idx, nil
+	}
+
 	// grow file to maximum index size before memory mapping as
 	// file can't be grown after memory mapping. this pads the file
 	// with zero's until the size is full
 	if err := os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
 		return nil, err
 	}
-	// create memory mapping
-	mmap, err := gommap.Map(
-		idx.file.Fd(),
-		// assign rw permissions
-		gommap.PROT_READ|gommap.PROT_WRITE,
-		gommap.MAP_SHARED,
-	)
-	if err != nil {
+	idx.capacity = c.Segment.MaxIndexBytes
+	if idx.data, err = openIndexData(f, c); err != nil {
 		return nil, err
 	}
-	idx.mmap = mmap
-
 	return idx, nil
 }
 
+// open the entries of an index file, memory mapping them unless disabled
+func openIndexData(f *os.File, c Config) (indexData, error) {
+	if c.Segment.DisableMmap {
+		return fileIndexData{f}, nil
+	}
+	return mapIndexData(f, c.ReadOnly)
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
@@ -64,45 +95,154 @@ func (i *index) Name() string {
 // 'in' is a relative offset
 // returns the output relative offset, position of record in the store, error
 func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
-	if i.size == 0 {
+	n := i.size / entWidth
+	if n == 0 {
 		return 0, 0, io.EOF
 	}
-	// check for negative offset values since 'in' is a relative measurement
-	if in == -1 {
-		out = uint32(i.size/entWidth - 1)
-	} else {
-		out = uint32(in)
-	}
-	// get byte position of entry in memory-mapped file
-	pos = uint64(out) * entWidth
-	if i.size < pos+entWidth {
+	// -1 reads the last entry. other offsets must name a written entry. they
+	// are checked before conversion so that large values can't wrap around
+	// onto a valid entry
+	var slot uint64
+	switch {
+	case in == -1:
+		slot = n - 1
+	case in < 0 || uint64(in) >= n:
 		return 0, 0, io.EOF
+	default:
+		slot = uint64(in)
 	}
+	// get byte position of entry in the file
+	pos = slot * entWidth
 
 	// extract the actual content from the file
 	// first 4 bytes is the offset and remaining 8 bytes for actual position
-	out = enc.Uint32(i.mmap[pos : pos+offWidth])
-	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth])
+	ent := make([]byte, entWidth)
+	if _, err := i.data.ReadAt(ent, int64(pos)); err != nil {
+		return 0, 0, err
+	}
+	out = enc.Uint32(ent[:offWidth])
+	pos = enc.Uint64(ent[offWidth:])
 	return out, pos, nil
 }
 
+// read the entry with the highest relative offset at or below the given one,
+// so that lookups between stored offsets land on a real record. entries are
+// searched by their stored offsets, which works for sparse indexes as well.
+// io.EOF is returned when every entry is above the offset
+func (i *index) ReadNearest(in int64) (out uint32, pos uint64, err error) {
+	n := int(i.size / entWidth)
+	if n == 0 || in < 0 {
+		return 0, 0, io.EOF
+	}
+	ent := make([]byte, entWidth)
+	readOffset := func(slot int) (uint32, error) {
+		if _, err := i.data.ReadAt(ent, int64(slot)*int64(entWidth)); err != nil {
+			return 0, err
+		}
+		return enc.Uint32(ent[:offWidth]), nil
+	}
+	// find the first entry above the offset. the one before it is the nearest
+	var readErr error
+	above := sort.Search(n, func(slot int) bool {
+		off, err := readOffset(slot)
+		if err != nil {
+			readErr = err
+			return true
+		}
+		return int64(off) > in
+	})
+	if readErr != nil {
+		return 0, 0, readErr
+	}
+	if above == 0 {
+		return 0, 0, io.EOF
+	}
+	if _, err := i.data.ReadAt(ent, int64(above-1)*int64(entWidth)); err != nil {
+		return 0, 0, err
+	}
+	return enc.Uint32(ent[:offWidth]), enc.Uint64(ent[offWidth:]), nil
+}
+
+// IndexEntry locates a record in its segment's store
+type IndexEntry struct {
+	Offset uint64
+	// position of the record's length prefix in the store
+	Pos uint64
+}
+
+// return every entry of the index in order. offsets are relative to the
+// segment's base offset
+func (i *index) Entries() ([]IndexEntry, error) {
+	if i.size == 0 {
+		return nil, nil
+	}
+	// read all entries at once
+	b := make([]byte, i.size)
+	if _, err := i.data.ReadAt(b, 0); err != nil {
+		return nil, err
+	}
+	entries := make([]IndexEntry, 0, i.size/entWidth)
+	for ent := b; len(ent) >= int(entWidth); ent = ent[entWidth:] {
+		entries = append(entries, IndexEntry{
+			Offset: uint64(enc.Uint32(ent[:offWidth])),
+			Pos:    enc.Uint64(ent[offWidth:entWidth]),
+		})
+	}
+	return entries, nil
+}
+
 // append a given relative offset value and actual position to index file
 func (i *index) Write(off uint32, pos uint64) error {
 	// check if there is enough space for writes
-	if uint64(len(i.mmap)) < i.size+entWidth {
-		return io.EOF
+	if i.isFull() {
+		return ErrIndexFull
 	}
 	// add to the end of the index. offsets are relative to the base(first) offset
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
-	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
+	ent := make([]byte, entWidth)
+	enc.PutUint32(ent[:offWidth], off)
+	enc.PutUint64(ent[offWidth:], pos)
+	if _, err := i.data.WriteAt(ent, int64(i.size)); err != nil {
+		return err
+	}
 	i.size += uint64(entWidth)
 
 	return nil
 }
 
+// report whether there is no space left for another entry
+func (i *index) isFull() bool {
+	return i.capacity < i.size+entWidth
+}
+
+// discard all entries from the given relative offset onwards
+func (i *index) Truncate(off uint32) {
+	if size := uint64(off) * entWidth; size < i.size {
+		i.size = size
+	}
+}
+
+// commit the written entries to disk
+func (i *index) Sync() error {
+	if i.readOnly {
+		return nil
+	}
+	if err := i.data.Sync(); err != nil {
+		return err
+	}
+	return i.file.Sync()
+}
+
 func (i *index) Close() error {
-	// flush changes made to the memory mapped region synchronously to disk
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+	if i.readOnly {
+		if i.data != nil {
+			if err := i.data.Close(); err != nil {
+				return err
+			}
+		}
+		return i.file.Close()
+	}
+	// flush changes made to the entries synchronously to disk
+	if err := i.data.Sync(); err != nil {
 		return err
 	}
 	// commit file content to disk
@@ -110,12 +250,12 @@ func (i *index) Close() error {
 		return err
 	}
 
-	// unmap file before truncating. without this, windows prevents the
-	// truncation as it may lead to corrupt memory
-	if err := i.mmap.UnsafeUnmap(); err != nil {
+	// release the entries before truncating. without this, windows prevents
+	// the truncation of a memory mapped file as it may lead to corrupt memory
+	if err := i.data.Close(); err != nil {
 		return err
 	}
-	// truncate file to actual size to compensate for file growth during
+	// truncate file to actual size to compensate for file growth before
 	// memory mapping. this removes all zero padding
 	if err := i.file.Truncate(int64(i.size)); err != nil {
 		return err
@@ -127,3 +267,13 @@ func (i *index) Close() error {
 	}
 	return nil
 }
+
+// fileIndexData reads and writes index entries with ordinary file I/O
+type fileIndexData struct {
+	*os.File
+}
+
+// the file is closed by the index
+func (fileIndexData) Close() error {
+	return nil
+}
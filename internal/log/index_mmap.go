@@ -0,0 +1,56 @@
+//go:build !nommap
+
+package log
+
+import (
+	"io"
+	"os"
+
+	"github.com/tysonmote/gommap"
+)
+
+// mmapIndexData accesses index entries through a memory mapping of the file
+type mmapIndexData struct {
+	mmap gommap.MMap
+}
+
+// memory map the whole index file, for reads only if read-only is set
+func mapIndexData(f *os.File, readOnly bool) (indexData, error) {
+	// assign rw permissions unless the index is read-only
+	prot := gommap.PROT_READ | gommap.PROT_WRITE
+	if readOnly {
+		prot = gommap.PROT_READ
+	}
+	mmap, err := gommap.Map(f.Fd(), prot, gommap.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapIndexData{mmap: mmap}, nil
+}
+
+func (m *mmapIndexData) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.mmap)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.mmap[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *mmapIndexData) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(m.mmap)) {
+		return 0, ErrIndexFull
+	}
+	return copy(m.mmap[off:], p), nil
+}
+
+// flush changes made to the memory mapped region synchronously to disk
+func (m *mmapIndexData) Sync() error {
+	return m.mmap.Sync(gommap.MS_SYNC)
+}
+
+func (m *mmapIndexData) Close() error {
+	return m.mmap.UnsafeUnmap()
+}
@@ -0,0 +1,11 @@
+//go:build nommap
+
+package log
+
+import "os"
+
+// builds without memory mapping always read and write index entries through
+// the file
+func mapIndexData(f *os.File, readOnly bool) (indexData, error) {
+	return fileIndexData{f}, nil
+}
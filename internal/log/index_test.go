@@ -2,13 +2,25 @@ package log
 
 import (
 	"io"
+	"math"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 )
 
+// index configurations covering the memory mapped and plain file entries
+var indexConfigs = map[string]bool{"mmap": false, "file": true}
+
 func TestIndex(t *testing.T) {
+	for name, disableMmap := range indexConfigs {
+		t.Run(name, func(t *testing.T) {
+			testIndex(t, disableMmap)
+		})
+	}
+}
+
+func testIndex(t *testing.T, disableMmap bool) {
 	// temp index directory for testing
 	f, err := os.CreateTemp(os.TempDir(), "index_test")
 	require.NoError(t, err)
@@ -17,6 +29,7 @@ func TestIndex(t *testing.T) {
 	// set initial segment index bytes to 1024
 	c := Config{}
 	c.Segment.MaxIndexBytes = 1024
+	c.Segment.DisableMmap = disableMmap
 	idx, err := newIndex(f, c)
 	require.NoError(t, err)
 
@@ -60,3 +73,132 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, off, entries[1].Off)
 	require.Equal(t, pos, entries[1].Pos)
 }
+
+func TestIndexFull(t *testing.T) {
+	for name, disableMmap := range indexConfigs {
+		t.Run(name, func(t *testing.T) {
+			testIndexFull(t, disableMmap)
+		})
+	}
+}
+
+func testIndexFull(t *testing.T, disableMmap bool) {
+	f, err := os.CreateTemp(os.TempDir(), "index_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	c.Segment.DisableMmap = disableMmap
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	require.NoError(t, idx.Write(0, 0))
+	require.Equal(t, ErrIndexFull, idx.Write(1, 10))
+}
+
+func TestIndexEntries(t *testing.T) {
+	for name, disableMmap := range indexConfigs {
+		t.Run(name, func(t *testing.T) {
+			f, err := os.CreateTemp(os.TempDir(), "index_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = 1024
+			c.Segment.DisableMmap = disableMmap
+			idx, err := newIndex(f, c)
+			require.NoError(t, err)
+			entries, err := idx.Entries()
+			require.NoError(t, err)
+			require.Empty(t, entries)
+
+			want := []IndexEntry{{Offset: 0, Pos: 0}, {Offset: 1, Pos: 21}, {Offset: 2, Pos: 50}}
+			for _, ent := range want {
+				require.NoError(t, idx.Write(uint32(ent.Offset), ent.Pos))
+			}
+			entries, err = idx.Entries()
+			require.NoError(t, err)
+			require.Equal(t, want, entries)
+
+			// the entries survive reopening the index
+			require.NoError(t, idx.Close())
+			f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+			require.NoError(t, err)
+			idx, err = newIndex(f, c)
+			require.NoError(t, err)
+			defer idx.Close()
+			entries, err = idx.Entries()
+			require.NoError(t, err)
+			require.Equal(t, want, entries)
+		})
+	}
+}
+
+func TestIndexReadNearest(t *testing.T) {
+	for name, disableMmap := range indexConfigs {
+		t.Run(name, func(t *testing.T) {
+			f, err := os.CreateTemp(os.TempDir(), "index_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = 1024
+			c.Segment.DisableMmap = disableMmap
+			idx, err := newIndex(f, c)
+			require.NoError(t, err)
+			defer idx.Close()
+			_, _, err = idx.ReadNearest(0)
+			require.Equal(t, io.EOF, err)
+
+			// a sparse index with an entry for every fourth offset
+			for off := uint32(4); off <= 16; off += 4 {
+				require.NoError(t, idx.Write(off, uint64(off)*10))
+			}
+			_, _, err = idx.ReadNearest(3)
+			require.Equal(t, io.EOF, err)
+			for in, want := range map[int64]uint32{4: 4, 5: 4, 7: 4, 8: 8, 15: 12, 16: 16, 100: 16} {
+				out, pos, err := idx.ReadNearest(in)
+				require.NoError(t, err)
+				require.Equal(t, want, out)
+				require.Equal(t, uint64(want)*10, pos)
+			}
+		})
+	}
+}
+
+// test that offsets outside the written entries end with io.EOF, including
+// ones that would wrap around onto a written entry
+func TestIndexReadOutOfRange(t *testing.T) {
+	for name, disableMmap := range indexConfigs {
+		t.Run(name, func(t *testing.T) {
+			f, err := os.CreateTemp(os.TempDir(), "index_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = 1024
+			c.Segment.DisableMmap = disableMmap
+			idx, err := newIndex(f, c)
+			require.NoError(t, err)
+			defer idx.Close()
+			for off := uint32(0); off < 3; off++ {
+				require.NoError(t, idx.Write(off, uint64(off)*10))
+			}
+
+			for _, in := range []int64{-2, math.MinInt64, 3, 1 << 32, math.MaxInt64} {
+				_, _, err := idx.Read(in)
+				require.Equal(t, io.EOF, err, "offset %d", in)
+			}
+			// the last written entry is at the boundary
+			out, pos, err := idx.Read(2)
+			require.NoError(t, err)
+			require.Equal(t, uint32(2), out)
+			require.Equal(t, uint64(20), pos)
+			out, _, err = idx.Read(-1)
+			require.NoError(t, err)
+			require.Equal(t, uint32(2), out)
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package log
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
@@ -8,8 +11,53 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	api "github.com/mrshabel/gumlog/api/v1"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// ErrReadOnly is returned when modifying a log opened as read-only
+	ErrReadOnly = errors.New("log is read-only")
+	// ErrOffsetMismatch is returned when a record can't be appended at the
+	// requested offset
+	ErrOffsetMismatch = errors.New("offset mismatch")
+	// ErrIncompleteSegment is returned when opening a log with a segment whose
+	// store or index file is missing
+	ErrIncompleteSegment = errors.New("incomplete segment")
+)
+
+// reasons a segment is rolled
+const (
+	// the store or index reached its maximum size, or a record needed a
+	// segment of its own
+	rollSize = "size"
+	// the segment was open for longer than its maximum age
+	rollAge = "age"
+)
+
+var (
+	// tag holding why a segment was rolled
+	reasonKey = tag.MustNewKey("reason")
+	// segments rolled by logs
+	segmentRolls = stats.Int64("gumlog/segment_rolls", "segments rolled", stats.UnitDimensionless)
+	// SegmentRollsView counts the segments rolled by the reason they were
+	// rolled for. logs rolling often point to misconfigured segment sizes.
+	// it must be registered to be exported
+	SegmentRollsView = &view.View{
+		Name:        "gumlog/segment_rolls",
+		Measure:     segmentRolls,
+		Description: "number of segments rolled by reason",
+		TagKeys:     []tag.Key{reasonKey},
+		Aggregation: view.Count(),
+	}
 )
 
 // log to hold all segments and keep track of active segment
@@ -21,15 +69,31 @@ type Log struct {
 
 	activeSegment *segment
 	segments      []*segment
+
+	// channels of the subscribers to appended records by their ids
+	subsMu      sync.Mutex
+	subscribers map[uint64]chan *api.Record
+	nextSubID   uint64
+
+	// offset bounds cached for lock-free range checks. see OffsetBounds
+	lowest atomic.Uint64
+	next   atomic.Uint64
 }
 
 // Creates a new log while defaulting the maximum store and index
-// bytes to 1024 each
+// bytes to 1024 each. the index size is derived from the store size
+// when an average record size is configured
 func NewLog(dir string, c Config) (*Log, error) {
 	// setup defaults for values not specified
 	if c.Segment.MaxStoreBytes == 0 {
 		c.Segment.MaxStoreBytes = 1024
 	}
+	if c.Segment.MaxIndexBytes == 0 && c.Segment.AvgRecordBytes > 0 {
+		// one index entry for every record expected to fit in the store
+		recordWidth := c.Segment.AvgRecordBytes + lenWidth
+		entries := (c.Segment.MaxStoreBytes + recordWidth - 1) / recordWidth
+		c.Segment.MaxIndexBytes = entries * entWidth
+	}
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
@@ -47,30 +111,56 @@ func (l *Log) setup() error {
 		return err
 	}
 
-	// get the base offset for each segment since it's used in the filename
-	// of store and index files
-	var baseOffsets []uint64
+	// group the files of each segment by the base offset in their names. stores
+	// may not be backed by files. names may be zero-padded or not, depending
+	// on the version that created them
+	fileStores := l.Config.Segment.OpenStore == nil
+	type segmentFiles struct{ index, store bool }
+	segmentsFound := make(map[uint64]*segmentFiles)
 	for _, file := range files {
-		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		ext := path.Ext(file.Name())
+		if ext != ".index" && (ext != ".store" || !fileStores) {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ext), 10, 0)
+		if err != nil {
+			continue
+		}
+		found, ok := segmentsFound[off]
+		if !ok {
+			found = &segmentFiles{}
+			segmentsFound[off] = found
+		}
+		found.index = found.index || ext == ".index"
+		found.store = found.store || ext == ".store"
+	}
+	baseOffsets := make([]uint64, 0, len(segmentsFound))
+	for off := range segmentsFound {
 		baseOffsets = append(baseOffsets, off)
 	}
-
 	// sort the base offsets
 	sort.Slice(baseOffsets, func(i int, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
-	for i := 0; i < len(baseOffsets); i++ {
+	// a segment missing one of its files can't be read reliably
+	for _, off := range baseOffsets {
+		if found := segmentsFound[off]; !found.index {
+			return fmt.Errorf("%w %d in %s: index file is missing", ErrIncompleteSegment, off, l.Dir)
+		} else if fileStores && !found.store {
+			return fmt.Errorf("%w %d in %s: store file is missing", ErrIncompleteSegment, off, l.Dir)
+		}
+	}
+	for _, baseOffset := range baseOffsets {
 		// create new segment with base offset for each entry
-		if err := l.newSegment(baseOffsets[i]); err != nil {
+		if err := l.newSegment(baseOffset); err != nil {
 			return err
 		}
-		// skip next element since baseOffset contains duplicates for
-		// index and store files (same filename)
-		i++
 	}
 	// new log for cases when no existing segments exist
 	if l.segments == nil {
+		if l.Config.ReadOnly {
+			return fmt.Errorf("read-only log in %s has no segments", l.Dir)
+		}
 		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
 			return err
 		}
@@ -79,26 +169,180 @@ func (l *Log) setup() error {
 	return nil
 }
 
-// append a record to the active segment of a log and return the offset
+// append a record to the active segment of a log and return the offset. a
+// segment that can't index the record is rolled and the record is appended
+// to the new segment, so a full index is never surfaced to callers. records
+// larger than MaxStoreBytes are accepted and written alone to a fresh
+// segment, which is rolled right after
 func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	off, err := l.activeSegment.Append(record)
+	return l.append(context.Background(), record)
+}
+
+// AppendRecord appends a record like Append and returns it as stored, with
+// the offset and, unless it already had one, the timestamp the log assigned
+func (l *Log) AppendRecord(record *api.Record) (*api.Record, error) {
+	if _, err := l.Append(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// append a record like Append unless the context is done before the log
+// can be locked. the append is traced as a child of the context's span
+func (l *Log) AppendContext(ctx context.Context, record *api.Record) (uint64, error) {
+	if err := l.lockContext(ctx); err != nil {
+		return 0, err
+	}
+	defer l.mu.Unlock()
+	return l.append(ctx, record)
+}
+
+// append a record only if it will be assigned the given offset. this lets
+// recovery tooling assert where a record lands instead of assuming it
+func (l *Log) AppendAt(off uint64, record *api.Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if next := l.activeSegment.nextOffset; off != next {
+		return fmt.Errorf("%w: append at %d, next offset is %d", ErrOffsetMismatch, off, next)
+	}
+	_, err := l.append(context.Background(), record)
+	return err
+}
+
+func (l *Log) append(ctx context.Context, record *api.Record) (off uint64, err error) {
+	ctx, span := trace.StartSpan(ctx, "log.Append")
+	defer func() {
+		if err != nil {
+			setSpanError(span, err)
+		}
+		span.End()
+	}()
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	// seal an expired active segment holding records before appending, as
+	// well as a maxed one whose roll failed after the previous append
+	s := l.activeSegment
+	if s.IsMaxed() {
+		if err := l.rollSegment(ctx, s.nextOffset, rollSize); err != nil {
+			return 0, err
+		}
+	} else if s.IsExpired() && s.nextOffset > s.baseOffset {
+		if err := l.rollSegment(ctx, s.nextOffset, rollAge); err != nil {
+			return 0, err
+		}
+	}
+	// give a record that can't fit in any store a segment of its own
+	s = l.activeSegment
+	record.Offset = s.nextOffset
+	if record.Timestamp == nil {
+		record.Timestamp = timestamppb.Now()
+	}
+	if storedWidth(record) > l.Config.Segment.MaxStoreBytes && s.nextOffset > s.baseOffset {
+		if err := l.rollSegment(ctx, s.nextOffset, rollSize); err != nil {
+			return 0, err
+		}
+	}
+	size := l.activeSegment.store.Size()
+	off, err = l.activeSegment.Append(record)
+	// roll a segment whose index filled up before its store and retry
+	if errors.Is(err, ErrIndexFull) {
+		if err = l.rollSegment(ctx, l.activeSegment.nextOffset, rollSize); err != nil {
+			return 0, err
+		}
+		size = l.activeSegment.store.Size()
+		off, err = l.activeSegment.Append(record)
+	}
 	if err != nil {
 		return 0, err
 	}
+	l.cacheBounds()
+	l.publish(record)
+	span.AddAttributes(
+		trace.Int64Attribute("offset", int64(off)),
+		trace.Int64Attribute("segment.base", int64(l.activeSegment.baseOffset)),
+		trace.Int64Attribute("bytes", int64(l.activeSegment.store.Size()-size)),
+	)
 
-	// update active segment if maxed out
+	// update active segment if maxed out. the record is appended either way,
+	// so a failed roll isn't returned to callers that would retry the append.
+	// the next append rolls the segment instead
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+		if err := l.rollSegment(ctx, off+1, rollSize); err != nil {
+			span.Annotate(
+				[]trace.Attribute{trace.StringAttribute("error", err.Error())},
+				"segment roll failed, retrying on the next append",
+			)
+		}
+	}
+	return off, nil
+}
+
+// record a failed operation on its span
+func setSpanError(span *trace.Span, err error) {
+	code := int32(trace.StatusCodeUnknown)
+	var outOfRange api.ErrOffsetOutOfRange
+	if errors.As(err, &outOfRange) {
+		code = trace.StatusCodeNotFound
+	}
+	span.SetStatus(trace.Status{Code: code, Message: err.Error()})
+}
+
+// seal the active segment and continue in a new one at the given offset. the
+// roll is counted by its reason and traced with the new segment's offset
+func (l *Log) rollSegment(ctx context.Context, off uint64, reason string) error {
+	ctx, span := trace.StartSpan(ctx, "log.RollSegment")
+	defer span.End()
+	span.AddAttributes(
+		trace.Int64Attribute("segment.base", int64(off)),
+		trace.StringAttribute("reason", reason),
+	)
+	// checkpoint the sealed segment. segments are trimmed back to their
+	// checkpoint when reopened, so a stale one would leave a hole in the log
+	if err := l.activeSegment.Flush(); err != nil {
+		setSpanError(span, err)
+		return err
+	}
+	if err := l.newSegment(off); err != nil {
+		setSpanError(span, err)
+		return err
+	}
+	if ctx, err := tag.New(ctx, tag.Upsert(reasonKey, reason)); err == nil {
+		stats.Record(ctx, segmentRolls.M(1))
 	}
-	return off, err
+	return nil
 }
 
 // retrieve the record stored at a given offset with the segment's offset
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.read(context.Background(), off)
+}
+
+// read a record like Read unless the context is done before the log can be
+// locked. the read is traced as a child of the context's span
+func (l *Log) ReadContext(ctx context.Context, off uint64) (*api.Record, error) {
+	if err := l.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer l.mu.Unlock()
+	return l.read(ctx, off)
+}
+
+func (l *Log) read(ctx context.Context, off uint64) (record *api.Record, err error) {
+	_, span := trace.StartSpan(ctx, "log.Read")
+	span.AddAttributes(trace.Int64Attribute("offset", int64(off)))
+	defer func() {
+		if err != nil {
+			setSpanError(span, err)
+		} else {
+			span.AddAttributes(trace.Int64Attribute("bytes", int64(proto.Size(record))))
+		}
+		span.End()
+	}()
 	// find segment containing record with the offset
 	// offset should be between baseOffset of segment and
 	// nextOffset of the same segment
@@ -114,14 +358,62 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 		return nil, api.ErrOffsetOutOfRange{Offset: off}
 	}
 
+	span.AddAttributes(trace.Int64Attribute("segment.base", int64(s.baseOffset)))
+
 	// return segment data
 	return s.Read(off)
 }
 
+// read a record by an offset that counts back from the end of the log when
+// negative: -1 is the latest record, -2 the one before it and so on.
+// non-negative offsets are read as they are
+func (l *Log) ReadRelative(off int64) (*api.Record, error) {
+	if off >= 0 {
+		return l.Read(uint64(off))
+	}
+	// the bounds and the record are read under the same lock so that the
+	// record can't be removed in between
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	lowest := l.segments[0].baseOffset
+	next := l.activeSegment.nextOffset
+	if n := uint64(-off); n <= next-lowest {
+		return l.read(context.Background(), next-n)
+	}
+	return nil, api.ErrRelativeOffsetOutOfRange{Offset: off}
+}
+
+// acquire the log's lock unless the context is done first. a lock acquired
+// after giving up is released straight away
+func (l *Log) lockContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if l.mu.TryLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		l.mu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			l.mu.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
 // close all segments in the log
 func (l *Log) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	defer l.closeSubscribers()
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
@@ -132,17 +424,49 @@ func (l *Log) Close() error {
 
 // remove log by closing it and deleting all related records
 func (l *Log) Remove() error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
 	if err := l.Close(); err != nil {
 		return err
 	}
 	return os.RemoveAll(l.Dir)
 }
 
+// Clear removes every segment of the log and starts over with an empty
+// segment at the initial offset. unlike Reset, the directory itself is kept,
+// along with its permissions and anything else it holds
+func (l *Log) Clear() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	defer l.closeSubscribers()
+	for _, s := range l.segments {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	l.segments = nil
+	l.activeSegment = nil
+	return l.newSegment(l.Config.Segment.InitialOffset)
+}
+
 // reset log by removing it and setting it up again
 func (l *Log) Reset() error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	// recreate the removed directory and drop the closed segments
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments = nil
+	l.activeSegment = nil
 
 	return l.setup()
 }
@@ -154,6 +478,69 @@ func (l *Log) LowestOffset() (uint64, error) {
 	return l.segments[0].baseOffset, nil
 }
 
+// OffsetBounds returns the lowest offset of the log and the offset the next
+// appended record gets without locking the log. the bounds are cached once
+// an append or truncation completes, so they may lag concurrent ones
+func (l *Log) OffsetBounds() (lowest, next uint64) {
+	return l.lowest.Load(), l.next.Load()
+}
+
+// NextOffset returns the first offset at or after the given one that holds a
+// record, skipping the offsets removed from the log. it reports false when
+// no record exists at or after the offset yet
+func (l *Log) NextOffset(after uint64) (uint64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		if after < s.nextOffset && s.baseOffset < s.nextOffset {
+			return max(after, s.baseOffset), true
+		}
+	}
+	return 0, false
+}
+
+// Flush writes buffered records to disk and commits them along with their
+// index entries, without closing the log. sealed segments are checkpointed
+// when rolled, so only the active segment and those never checkpointed since
+// being reopened are flushed. flushing writes the checkpoint, so it holds the
+// write lock
+func (l *Log) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.segments {
+		if s != l.activeSegment && s.checkpoint == s.nextOffset {
+			continue
+		}
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OffsetIndex returns the offset and store position of every record in the
+// segment with the given base offset, for tools that read the store file
+// directly. records still buffered in memory may not be in the file yet
+func (l *Log) OffsetIndex(segmentBase uint64) ([]IndexEntry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		if s.baseOffset != segmentBase {
+			continue
+		}
+		entries, err := s.index.Entries()
+		if err != nil {
+			return nil, err
+		}
+		// convert relative offsets to absolute ones
+		for i := range entries {
+			entries[i].Offset += s.baseOffset
+		}
+		return entries, nil
+	}
+	return nil, fmt.Errorf("no segment with base offset %d", segmentBase)
+}
+
 // retrieve the highest segment offset in the log
 func (l *Log) HighestOffset() (uint64, error) {
 	l.mu.RLock()
@@ -167,14 +554,96 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
-// remove old segments from disk to avoid overflow
+// Stats summarizes the size and contents of a log
+type Stats struct {
+	// number of segments in the log
+	Segments int
+	// bytes used by all stores and indexes
+	TotalBytes uint64
+	// number of records between the lowest and highest offsets
+	Records uint64
+	// bytes used by the active segment's store
+	ActiveSegmentBytes uint64
+	// time the oldest segment was created and time of the latest append
+	Oldest time.Time
+	Newest time.Time
+}
+
+// retrieve the stats of the log from the segments' tracked sizes without
+// reading any record
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stats := Stats{
+		Segments:           len(l.segments),
+		ActiveSegmentBytes: l.activeSegment.store.Size(),
+		Newest:             l.activeSegment.appendedAt,
+	}
+	for _, s := range l.segments {
+		stats.TotalBytes += s.store.Size() + s.index.size
+	}
+	first := l.segments[0]
+	stats.Records = l.activeSegment.nextOffset - first.baseOffset
+	// reopened segments may have been appended to before they were opened
+	stats.Oldest = first.createdAt
+	if first.appendedAt.Before(stats.Oldest) {
+		stats.Oldest = first.appendedAt
+	}
+	return stats
+}
+
+// SegmentInfo describes a segment of the log
+type SegmentInfo struct {
+	// offset of the segment's first record and the offset its next record
+	// gets. both are equal for an empty segment
+	BaseOffset uint64
+	NextOffset uint64
+	// bytes used by the segment's store and index
+	StoreBytes uint64
+	IndexBytes uint64
+	// time the segment was created and time of its latest append
+	Oldest time.Time
+	Newest time.Time
+	// whether records are appended to the segment
+	Active bool
+}
+
+// retrieve a snapshot of every segment's metadata, oldest first
+func (l *Log) Segments() []SegmentInfo {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	infos := make([]SegmentInfo, 0, len(l.segments))
+	for _, s := range l.segments {
+		info := SegmentInfo{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreBytes: s.store.Size(),
+			IndexBytes: s.index.size,
+			Oldest:     s.createdAt,
+			Newest:     s.appendedAt,
+			Active:     s == l.activeSegment,
+		}
+		// reopened segments may have been appended to before they were opened
+		if s.appendedAt.Before(info.Oldest) {
+			info.Oldest = s.appendedAt
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// remove old segments from disk to avoid overflow. the active segment is
+// never removed so the log stays writable, even when all of its records are
+// below the lowest offset
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
 	var segments []*segment
 	for _, s := range l.segments {
-		// discard segments whose highest offsets are lesser than lower
-		if s.nextOffset-1 <= lowest {
+		if l.truncatable(s, lowest) {
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -184,37 +653,180 @@ func (l *Log) Truncate(lowest uint64) error {
 	}
 	// update segments in-place
 	l.segments = segments
+	l.cacheBounds()
 	return nil
 }
 
-type originReader struct {
-	*store
-	off int64
+// TruncateEstimate reports the segments Truncate would remove for the given
+// lowest offset and the bytes their stores and indexes use, without removing
+// anything
+func (l *Log) TruncateEstimate(lowest uint64) (segmentsToRemove int, bytesFreed uint64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		if l.truncatable(s, lowest) {
+			segmentsToRemove++
+			bytesFreed += s.store.Size() + s.index.size
+		}
+	}
+	return segmentsToRemove, bytesFreed
+}
+
+// report whether truncating the log to the lowest offset removes the segment:
+// all of its records are below the offset and it isn't the active segment
+func (l *Log) truncatable(s *segment, lowest uint64) bool {
+	return s != l.activeSegment && s.nextOffset-1 <= lowest
 }
 
-func (o *originReader) Read(p []byte) (int, error) {
-	// read content of store from offset
-	n, err := o.ReadAt(p, o.off)
-	// EOF may be returned in cases where the allocated byte slice exceeds data read
-	if err != nil && err != io.EOF {
-		return 0, err
+// remove all records from the given offset onwards. segments starting at or
+// after the offset are deleted while the segment containing it is cut short
+func (l *Log) truncateFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	defer l.closeSubscribers()
+	var segments []*segment
+	for _, s := range l.segments {
+		if s.baseOffset >= off {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.Truncate(off); err != nil {
+			return err
+		}
+		segments = append(segments, s)
 	}
-	o.off += int64(n)
-	return n, err
+	l.segments = segments
+	// start afresh from the offset when no segment survives
+	if len(l.segments) == 0 {
+		return l.newSegment(off)
+	}
+	l.activeSegment = l.segments[len(l.segments)-1]
+	l.cacheBounds()
+	return nil
+}
+
+// errReader fails every read with the given error
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
 }
 
 // read the entire log with all segments.
-// this concatenates all segments and read them as one
-func (l *Log) Reader() io.Reader {
+// this concatenates all segments and read them as one. the segments are
+// snapshotted on call so concurrent truncation does not close files that the
+// reader still needs. closing the reader releases the segments it holds open
+func (l *Log) Reader() io.ReadCloser {
+	readers, err := l.segmentReaders()
+	if err != nil {
+		return io.NopCloser(errReader{err})
+	}
+	return newSegmentsReader(readers)
+}
+
+// read the log like Reader, starting at the record with the given offset.
+// segments before the one holding the offset are skipped, so only the tail of
+// the log is read. reading from the next offset to be appended reads nothing
+func (l *Log) ReaderFrom(off uint64) io.ReadCloser {
+	readers, err := l.segmentReadersFrom(off)
+	if err != nil {
+		return io.NopCloser(errReader{err})
+	}
+	return newSegmentsReader(readers)
+}
+
+// segmentsReader reads segments one after the other and closes all of them
+// when closed, including the segments that weren't read to the end
+type segmentsReader struct {
+	io.Reader
+	readers []io.ReadCloser
+}
+
+func newSegmentsReader(readers []io.ReadCloser) *segmentsReader {
+	multi := make([]io.Reader, 0, len(readers))
+	for _, r := range readers {
+		multi = append(multi, r)
+	}
+	return &segmentsReader{Reader: io.MultiReader(multi...), readers: readers}
+}
+
+func (s *segmentsReader) Close() error {
+	var errs []error
+	for _, r := range s.readers {
+		if err := r.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// open a reader over the current contents of every segment, in order
+func (l *Log) segmentReaders() ([]io.ReadCloser, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	return l.openReaders(l.segments[0].baseOffset)
+}
+
+// open readers over the segments from the one holding the given offset, with
+// the first reader positioned at the offset's record
+func (l *Log) segmentReadersFrom(off uint64) ([]io.ReadCloser, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if off < l.segments[0].baseOffset || off > l.activeSegment.nextOffset {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return l.openReaders(off)
+}
+
+func (l *Log) openReaders(off uint64) ([]io.ReadCloser, error) {
+	readers := make([]io.ReadCloser, 0, len(l.segments))
+	closeAll := func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}
+	for _, segment := range l.segments {
+		// the segment only holds records before the offset
+		if segment.nextOffset <= off && segment.baseOffset < off {
+			continue
+		}
+		r, err := segment.store.Reader()
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		readers = append(readers, r)
+		if segment.baseOffset >= off {
+			continue
+		}
+		// skip the records before the offset in its segment
+		_, pos, err := segment.index.Read(int64(off - segment.baseOffset))
+		if err == nil {
+			err = skip(r, pos)
+		}
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+	return readers, nil
+}
 
-	readers := make([]io.Reader, len(l.segments))
-	for i, segment := range l.segments {
-		// add segment reader that implements Reader interface
-		readers[i] = &originReader{segment.store, 0}
+// skip the first n bytes of a segment store reader
+func skip(r io.Reader, n uint64) error {
+	if o, ok := r.(*originReader); ok {
+		o.off = min(int64(n), o.size)
+		return nil
 	}
-	return io.MultiReader(readers...)
+	_, err := io.CopyN(io.Discard, r, int64(n))
+	return err
 }
 
 // create a new segment with a given base offset and set it as the
@@ -227,5 +839,12 @@ func (l *Log) newSegment(off uint64) error {
 	l.segments = append(l.segments, s)
 	// set it as the active segment
 	l.activeSegment = s
+	l.cacheBounds()
 	return nil
 }
+
+// update the cached offset bounds. callers hold the write lock
+func (l *Log) cacheBounds() {
+	l.lowest.Store(l.segments[0].baseOffset)
+	l.next.Store(l.activeSegment.nextOffset)
+}
@@ -1,24 +1,68 @@
 package log
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	api "github.com/mrshabel/gumlog/api/v1"
 	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// time records are stamped with in tests that depend on their size. records
+// appended without a timestamp are stamped with the current time, whose
+// encoded size varies
+var stamp = timestamppb.New(time.Unix(1700000000, 0))
+
 // test for all cases of our log usage
 func TestLog(t *testing.T) {
 	table := map[string]func(t *testing.T, log *Log){
 		"append and read record":      testAppendRead,
 		"offset out of range error":   testOutOfRangeErr,
+		"read relative offset":        testReadRelative,
+		"export and import":           testExportImport,
+		"context cancellation":        testContextCancel,
+		"read-only":                   testReadOnly,
+		"trace append":                testTraceAppend,
+		"append at offset":            testAppendAt,
+		"verify":                      testVerify,
+		"offset index":                testOffsetIndex,
+		"flush":                       testFlush,
+		"checkpoint sealed segments":  testCheckpointSealed,
+		"concurrent flush":            testConcurrentFlush,
+		"legacy segment names":        testLegacySegmentNames,
+		"future record version":       testFutureRecordVersion,
 		"init with existing segments": testInitExisting,
+		"missing segment file":        testMissingSegmentFile,
+		"recover partial write":       testRecoverPartialWrite,
 		"reader":                      testReader,
+		"parallel reader":             testParallelReader,
+		"reader from offset":          testReaderFrom,
+		"oversized record":            testOversizedRecord,
+		"next offset":                 testNextOffset,
+		"offset bounds":               testOffsetBounds,
+		"clear":                       testClear,
+		"append record":               testAppendRecord,
+		"segments":                    testSegments,
+		"subscribe":                   testSubscribe,
+		"reader during truncate":      testReaderTruncate,
 		"truncate":                    testTruncate,
+		"truncate estimate":           testTruncateEstimate,
+		"roll expired segment":        testRollExpired,
+		"roll expired reopened":       testRollExpiredReopened,
+		"stats":                       testStats,
 	}
 	for scenario, fn := range table {
 		t.Run(scenario, func(t *testing.T) {
@@ -38,6 +82,181 @@ func TestLog(t *testing.T) {
 	}
 }
 
+// test that an append that finds the active segment's index full succeeds in
+// a new segment rather than failing
+func TestLogIndexBoundary(t *testing.T) {
+	table := map[string]struct {
+		maxIndexBytes uint64
+		reopen        bool
+	}{
+		// the index isn't maxed after its last entry but can't take another
+		"index ends between entries": {maxIndexBytes: 2*entWidth + entWidth/2},
+		// a reopened log doesn't roll its last segment even if it is full
+		"full segment reopened": {maxIndexBytes: 2 * entWidth, reopen: true},
+	}
+	for scenario, tc := range table {
+		t.Run(scenario, func(t *testing.T) {
+			dir := t.TempDir()
+			config := Config{}
+			config.Segment.MaxStoreBytes = 1024
+			config.Segment.MaxIndexBytes = tc.maxIndexBytes
+			l, err := NewLog(dir, config)
+			require.NoError(t, err)
+			for range 2 {
+				_, err := l.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			if tc.reopen {
+				// drop the empty segment rolled after the full one
+				require.NoError(t, l.Close())
+				require.NoError(t, os.Remove(segmentPath(dir, 2, ".index")))
+				require.NoError(t, os.Remove(segmentPath(dir, 2, ".store")))
+				l, err = NewLog(dir, config)
+				require.NoError(t, err)
+				require.Len(t, l.segments, 1)
+			}
+			defer l.Close()
+
+			// the index of the first segment holds exactly 2 entries
+			off, err := l.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), off)
+			require.Len(t, l.segments, 2)
+			require.Equal(t, uint64(2), l.segments[1].baseOffset)
+			record, err := l.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+		})
+	}
+}
+
+// test that a failed segment roll after an append doesn't fail the append,
+// and that the roll is retried by the next append
+func TestLogRollFailure(t *testing.T) {
+	var failRoll bool
+	errDiskFull := errors.New("disk full")
+	config := Config{}
+	config.Segment.MaxStoreBytes = 32
+	config.Segment.OpenStore = func(dir string, baseOffset uint64, c Config) (SegmentStore, error) {
+		if failRoll {
+			return nil, errDiskFull
+		}
+		return openFileStore(dir, baseOffset, c)
+	}
+	l, err := NewLog(t.TempDir(), config)
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp})
+	require.NoError(t, err)
+	failRoll = true
+	off, err := l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Len(t, l.segments, 1)
+
+	// appends fail without writing while the segment can't be rolled
+	_, err = l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp})
+	require.ErrorIs(t, err, errDiskFull)
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), highest)
+
+	failRoll = false
+	off, err = l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.Len(t, l.segments, 2)
+	for i := range uint64(3) {
+		record, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, record.Offset)
+	}
+}
+
+// test that every segment roll is counted with the reason it was rolled for
+func TestLogRollMetrics(t *testing.T) {
+	require.NoError(t, view.Register(SegmentRollsView))
+	defer view.Unregister(SegmentRollsView)
+	rolls := func(reason string) int64 {
+		rows, err := view.RetrieveData(SegmentRollsView.Name)
+		require.NoError(t, err)
+		for _, row := range rows {
+			if len(row.Tags) == 1 && row.Tags[0].Value == reason {
+				return row.Data.(*view.CountData).Value
+			}
+		}
+		return 0
+	}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Segment.MaxAge = time.Hour
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// a store fills up every couple of records
+	for range 8 {
+		_, err := l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp})
+		require.NoError(t, err)
+	}
+	require.Len(t, l.segments, 5)
+	require.Equal(t, int64(4), rolls(rollSize))
+	require.Zero(t, rolls(rollAge))
+
+	// an aged segment holding records is rolled before the next append
+	l.Config.Segment.MaxStoreBytes = 1024
+	l.activeSegment.config.Segment.MaxStoreBytes = 1024
+	_, err = l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp})
+	require.NoError(t, err)
+	l.activeSegment.createdAt = time.Now().Add(-2 * time.Hour)
+	_, err = l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp})
+	require.NoError(t, err)
+	require.Equal(t, int64(4), rolls(rollSize))
+	require.Equal(t, int64(1), rolls(rollAge))
+}
+
+// test that the index is sized from the store size and the average record
+// size, and that segments roll on whichever limit is reached first
+func TestLogDerivedIndexBytes(t *testing.T) {
+	table := map[string]struct {
+		avgRecordBytes uint64
+		maxIndexBytes  uint64
+		wantIndexBytes uint64
+		// base offset of the second segment
+		wantRollOffset uint64
+	}{
+		// records are smaller than expected so the index fills first
+		"index maxes first": {avgRecordBytes: 63, wantIndexBytes: 3 * entWidth, wantRollOffset: 3},
+		// records are larger than expected so the store fills first
+		"store maxes first":           {avgRecordBytes: 1, wantIndexBytes: 23 * entWidth, wantRollOffset: 7},
+		"explicit index size is kept": {avgRecordBytes: 1, maxIndexBytes: 2 * entWidth, wantIndexBytes: 2 * entWidth, wantRollOffset: 2},
+	}
+	for scenario, tc := range table {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "log-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			config := Config{}
+			config.Segment.MaxStoreBytes = 200
+			config.Segment.MaxIndexBytes = tc.maxIndexBytes
+			config.Segment.AvgRecordBytes = tc.avgRecordBytes
+			l, err := NewLog(dir, config)
+			require.NoError(t, err)
+			defer l.Close()
+			require.Equal(t, tc.wantIndexBytes, l.Config.Segment.MaxIndexBytes)
+
+			for range 30 {
+				_, err := l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp})
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.wantRollOffset, l.segments[1].baseOffset)
+		})
+	}
+}
+
 func testAppendRead(t *testing.T, l *Log) {
 	record := &api.Record{Value: []byte("hello world")}
 	off, err := l.Append(record)
@@ -63,6 +282,442 @@ func testOutOfRangeErr(t *testing.T, l *Log) {
 	require.Equal(t, uint64(1), apiErr.Offset)
 }
 
+// test that negative offsets are read back from the end of the log
+func testReadRelative(t *testing.T, l *Log) {
+	// an empty log has no latest record
+	_, err := l.ReadRelative(-1)
+	require.Equal(t, api.ErrRelativeOffsetOutOfRange{Offset: -1}, err)
+
+	for i := range 5 {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	// records below the truncated segment are gone
+	require.NoError(t, l.Truncate(1))
+
+	table := map[int64]uint64{
+		-1: 4,
+		-2: 3,
+		-3: 2,
+		2:  2,
+	}
+	for off, want := range table {
+		read, err := l.ReadRelative(off)
+		require.NoError(t, err)
+		require.Equal(t, want, read.Offset)
+	}
+	_, err = l.ReadRelative(-4)
+	require.Equal(t, api.ErrRelativeOffsetOutOfRange{Offset: -4}, err)
+}
+
+// test that an exported log is rebuilt with the same records and offsets
+func testExportImport(t *testing.T, l *Log) {
+	for i := range 5 {
+		_, err := l.Append(&api.Record{
+			Value:   []byte(fmt.Sprintf("record %d", i)),
+			Headers: map[string]string{"index": fmt.Sprint(i)},
+		})
+		require.NoError(t, err)
+	}
+	// the archive starts from the lowest remaining offset
+	require.NoError(t, l.Truncate(1))
+
+	var archive bytes.Buffer
+	require.NoError(t, l.Export(&archive))
+
+	// import into a log with differently sized segments
+	dir, err := os.MkdirTemp("", "log-import-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	n, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer n.Close()
+	require.NoError(t, n.Import(&archive))
+
+	lowest, err := n.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	highest, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+	for off := uint64(2); off <= 4; off++ {
+		want, err := l.Read(off)
+		require.NoError(t, err)
+		got, err := n.Read(off)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, got))
+	}
+
+	// a log holding records can't be imported into
+	require.NoError(t, l.Export(&archive))
+	require.Error(t, n.Import(&archive))
+}
+
+// test that operations give up once their context is done
+func testContextCancel(t *testing.T, l *Log) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := l.AppendContext(ctx, &api.Record{Value: []byte("hello world")})
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = l.Read(0)
+	require.Error(t, err)
+
+	off, err := l.AppendContext(context.Background(), &api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// a read blocked on the lock returns once its context is cancelled
+	l.mu.Lock()
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = l.ReadContext(ctx, off)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Less(t, time.Since(start), time.Second)
+	l.mu.Unlock()
+
+	// the abandoned lock is released
+	record, err := l.ReadContext(context.Background(), off)
+	require.NoError(t, err)
+	require.Equal(t, off, record.Offset)
+}
+
+// test that a read-only log serves reads without modifying its files
+func testReadOnly(t *testing.T, l *Log) {
+	record := &api.Record{Value: []byte("hello world")}
+	for range 3 {
+		_, err := l.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	sizes := func() map[string]int64 {
+		files, err := os.ReadDir(l.Dir)
+		require.NoError(t, err)
+		sizes := make(map[string]int64)
+		for _, file := range files {
+			fi, err := file.Info()
+			require.NoError(t, err)
+			sizes[file.Name()] = fi.Size()
+		}
+		return sizes
+	}
+	want := sizes()
+
+	config := l.Config
+	config.ReadOnly = true
+	r, err := NewLog(l.Dir, config)
+	require.NoError(t, err)
+	for off := uint64(0); off < 3; off++ {
+		read, err := r.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, read.Value)
+	}
+	_, err = r.Append(record)
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, r.Truncate(0))
+	// nothing removes the files of a read-only log
+	require.Equal(t, ErrReadOnly, r.Clear())
+	require.Equal(t, ErrReadOnly, r.Remove())
+	require.Equal(t, ErrReadOnly, r.Reset())
+	require.Equal(t, ErrReadOnly, r.Import(strings.NewReader(archiveHeader)))
+	require.NoError(t, r.Close())
+	require.Equal(t, want, sizes())
+
+	// no segment is created for an empty read-only log
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_, err = NewLog(dir, config)
+	require.Error(t, err)
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+// collects the spans exported by the tracer
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+// test that appends and rollovers are recorded as children of the caller's span
+func testTraceAppend(t *testing.T, l *Log) {
+	recorder := &spanRecorder{}
+	trace.RegisterExporter(recorder)
+	defer trace.UnregisterExporter(recorder)
+
+	ctx, parent := trace.StartSpan(context.Background(), "produce", trace.WithSampler(trace.AlwaysSample()))
+	// two records fill up the first segment
+	for range 2 {
+		_, err := l.AppendContext(ctx, &api.Record{Value: []byte("hello world"), Timestamp: stamp})
+		require.NoError(t, err)
+	}
+	parent.End()
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	spans := make(map[string][]*trace.SpanData)
+	for _, span := range recorder.spans {
+		spans[span.Name] = append(spans[span.Name], span)
+	}
+	appends := spans["log.Append"]
+	require.Len(t, appends, 2)
+	for i, span := range appends {
+		require.Equal(t, parent.SpanContext().SpanID, span.ParentSpanID)
+		require.Equal(t, int64(i), span.Attributes["offset"])
+		require.Equal(t, int64(0), span.Attributes["segment.base"])
+		require.Greater(t, span.Attributes["bytes"], int64(0))
+	}
+	rolls := spans["log.RollSegment"]
+	require.Len(t, rolls, 1)
+	require.Equal(t, appends[1].SpanID, rolls[0].ParentSpanID)
+	require.Equal(t, int64(2), rolls[0].Attributes["segment.base"])
+}
+
+// test that records are only appended at the next offset
+func testAppendAt(t *testing.T, l *Log) {
+	record := &api.Record{Value: []byte("hello world")}
+	for off := uint64(0); off < 3; off++ {
+		require.NoError(t, l.AppendAt(off, record))
+	}
+	read, err := l.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), read.Offset)
+
+	// offsets behind or ahead of the next offset are rejected
+	for _, off := range []uint64{2, 4} {
+		require.ErrorIs(t, l.AppendAt(off, record), ErrOffsetMismatch)
+	}
+	off, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+// test that records stored in a newer format are refused with a descriptive
+// error while current records stay readable
+func testFutureRecordVersion(t *testing.T, l *Log) {
+	_, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// store a record framed with the version marker and a future version
+	p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: 1})
+	require.NoError(t, err)
+	s := l.activeSegment
+	_, pos, err := s.store.Append(append([]byte{versionMarker, maxRecordVersion + 1}, p...))
+	require.NoError(t, err)
+	require.NoError(t, s.index.Write(uint32(s.nextOffset-s.baseOffset), pos))
+	s.nextOffset++
+
+	record, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+
+	_, err = l.Read(1)
+	var versionErr ErrUnsupportedRecordVersion
+	require.ErrorAs(t, err, &versionErr)
+	require.Equal(t, byte(maxRecordVersion+1), versionErr.Version)
+	require.Contains(t, err.Error(), "newer than the supported version")
+}
+
+// test that segments with unpadded names are set up in order alongside
+// zero-padded ones
+func testLegacySegmentNames(t *testing.T, l *Log) {
+	for i := range 24 {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	var bases []uint64
+	for _, s := range l.segments {
+		bases = append(bases, s.baseOffset)
+	}
+	require.Greater(t, len(bases), 3)
+	require.NoError(t, l.Close())
+
+	// new segment files sort lexically in offset order
+	files, err := os.ReadDir(l.Dir)
+	require.NoError(t, err)
+	var names []string
+	for _, file := range files {
+		if path.Ext(file.Name()) == ".index" {
+			names = append(names, file.Name())
+		}
+	}
+	require.Len(t, names, len(bases))
+	for i, base := range bases {
+		require.Equal(t, fmt.Sprintf("%020d.index", base), names[i])
+	}
+
+	// name every other segment the way earlier versions did
+	for i := 1; i < len(bases); i += 2 {
+		for _, ext := range []string{".store", ".index"} {
+			require.NoError(t, os.Rename(
+				path.Join(l.Dir, fmt.Sprintf("%020d%s", bases[i], ext)),
+				path.Join(l.Dir, fmt.Sprintf("%d%s", bases[i], ext)),
+			))
+		}
+	}
+
+	n, err := NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Len(t, n.segments, len(bases))
+	for i, s := range n.segments {
+		require.Equal(t, bases[i], s.baseOffset)
+	}
+	for i := range uint64(24) {
+		record, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(i), string(record.Value))
+	}
+	// appends continue after the last record
+	off, err := n.Append(&api.Record{Value: []byte("24")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(24), off)
+}
+
+// test that flushed records are on disk while the log is still open
+func testFlush(t *testing.T, l *Log) {
+	record := &api.Record{Value: []byte("hello world"), Timestamp: stamp}
+	_, err := l.Append(record)
+	require.NoError(t, err)
+
+	// the record is still buffered
+	b, err := os.ReadFile(segmentPath(l.Dir, 0, ".store"))
+	require.NoError(t, err)
+	require.Empty(t, b)
+
+	require.NoError(t, l.Flush())
+	b, err = os.ReadFile(segmentPath(l.Dir, 0, ".store"))
+	require.NoError(t, err)
+	require.Len(t, b, 29)
+
+	// sealing the segment after the second record flushes it as well
+	_, err = l.Append(record)
+	require.NoError(t, err)
+	b, err = os.ReadFile(segmentPath(l.Dir, 0, ".store"))
+	require.NoError(t, err)
+	require.Len(t, b, 29+31)
+	read := &api.Record{}
+	require.NoError(t, proto.Unmarshal(b[lenWidth:29], read))
+	require.Equal(t, record.Value, read.Value)
+
+	// the index entry locating the second record is on disk too
+	idx, err := os.ReadFile(segmentPath(l.Dir, 0, ".index"))
+	require.NoError(t, err)
+	ent := idx[entWidth : 2*entWidth]
+	require.Equal(t, uint32(1), enc.Uint32(ent[:offWidth]))
+	require.Equal(t, uint64(29), enc.Uint64(ent[offWidth:]))
+}
+
+// test that rolled segments are checkpointed up to their last record, so
+// reopening them doesn't trim records a later segment follows
+func testCheckpointSealed(t *testing.T, l *Log) {
+	record := &api.Record{Value: []byte("hello world"), Timestamp: stamp}
+	_, err := l.Append(record)
+	require.NoError(t, err)
+	require.NoError(t, l.Flush())
+	// the first segment rolls after its second record, the next one after
+	// its fourth
+	for range 3 {
+		_, err := l.Append(record)
+		require.NoError(t, err)
+	}
+	for base, want := range map[uint64]uint64{0: 2, 2: 4} {
+		off, ok, err := readCheckpoint(segmentPath(l.Dir, base, ".checkpoint"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, want, off)
+	}
+}
+
+// test that concurrent appends and flushes each checkpoint the active segment
+// without racing on its checkpoint file
+func testConcurrentFlush(t *testing.T, l *Log) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				if _, err := l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp}); err != nil {
+					errs <- err
+					return
+				}
+				if err := l.Flush(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	_, next := l.OffsetBounds()
+	off, ok, err := readCheckpoint(l.activeSegment.checkpointPath())
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, next, off)
+}
+
+// test that a segment's index entries locate its records in the store
+func testOffsetIndex(t *testing.T, l *Log) {
+	for range 5 {
+		_, err := l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp})
+		require.NoError(t, err)
+	}
+	// each segment holds 2 records. a record takes 29 bytes with its length
+	// prefix, or 31 once its offset is encoded
+	entries, err := l.OffsetIndex(0)
+	require.NoError(t, err)
+	require.Equal(t, []IndexEntry{{Offset: 0, Pos: 0}, {Offset: 1, Pos: 29}}, entries)
+
+	entries, err = l.OffsetIndex(2)
+	require.NoError(t, err)
+	require.Equal(t, []IndexEntry{{Offset: 2, Pos: 0}, {Offset: 3, Pos: 31}}, entries)
+
+	_, err = l.OffsetIndex(1)
+	require.Error(t, err)
+}
+
+// test that corrupted records are reported without stopping verification
+func testVerify(t *testing.T, l *Log) {
+	for range 3 {
+		_, err := l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp})
+		require.NoError(t, err)
+	}
+	errs, err := l.Verify()
+	require.NoError(t, err)
+	require.Empty(t, errs)
+	require.NoError(t, l.Close())
+
+	// overwrite the data of the second record, which follows the 29 bytes of
+	// the first record and its own length prefix
+	f, err := os.OpenFile(segmentPath(l.Dir, 0, ".store"), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 29+lenWidth)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	n, err := NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	errs, err = n.Verify()
+	require.NoError(t, err)
+	require.Len(t, errs, 1)
+	require.Equal(t, uint64(1), errs[0].Offset)
+}
+
 func testInitExisting(t *testing.T, l *Log) {
 	record := &api.Record{Value: []byte("hello world")}
 
@@ -96,6 +751,67 @@ func testInitExisting(t *testing.T, l *Log) {
 	require.Equal(t, uint64(2), off)
 }
 
+// test that a segment missing its store or index fails to open with an error
+// naming the segment rather than being paired with another segment's file
+func testMissingSegmentFile(t *testing.T, l *Log) {
+	for range 5 {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	for _, ext := range []string{".index", ".store"} {
+		t.Run(ext, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.CopyFS(dir, os.DirFS(l.Dir)))
+			require.NoError(t, os.Remove(segmentPath(dir, 2, ext)))
+
+			_, err := NewLog(dir, l.Config)
+			require.ErrorIs(t, err, ErrIncompleteSegment)
+			require.ErrorContains(t, err, fmt.Sprintf("segment 2 in %s: %s file is missing", dir, ext[1:]))
+		})
+	}
+}
+
+// test that a record partly written before a crash is discarded on reopen
+func testRecoverPartialWrite(t *testing.T, l *Log) {
+	record := &api.Record{Value: []byte("hello world"), Timestamp: stamp}
+	for range 3 {
+		_, err := l.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// simulate a crash mid-append to the active segment: the last record's
+	// data is cut short and the index keeps the zero padding of its memory mapping
+	storeFile := segmentPath(l.Dir, 2, ".store")
+	fi, err := os.Stat(storeFile)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(storeFile, fi.Size()-3))
+	require.NoError(t, os.Truncate(segmentPath(l.Dir, 2, ".index"), int64(l.Config.Segment.MaxIndexBytes)))
+
+	n, err := NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	defer n.Close()
+
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	read, err := n.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, record.Value, read.Value)
+	_, err = n.Read(2)
+	require.Error(t, err)
+
+	// appends continue from the last good record
+	off, err = n.Append(&api.Record{Value: []byte("recovered")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	read, err = n.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("recovered"), read.Value)
+}
+
 // test that full log can be read as it is stored on disk
 func testReader(t *testing.T, l *Log) {
 	record := &api.Record{Value: []byte("hello world")}
@@ -118,6 +834,332 @@ func testReader(t *testing.T, l *Log) {
 	require.Equal(t, record.Value, read.Value)
 }
 
+// test that reading from an offset returns the records from it onwards,
+// whether the offset starts a segment or not
+func testReaderFrom(t *testing.T, l *Log) {
+	for i := range 7 {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	for _, from := range []uint64{0, 3, 4, 7} {
+		b, err := io.ReadAll(l.ReaderFrom(from))
+		require.NoError(t, err)
+		want := from
+		for len(b) > 0 {
+			n := enc.Uint64(b[:lenWidth])
+			read := &api.Record{}
+			require.NoError(t, decodeRecord(b[lenWidth:lenWidth+n], read))
+			require.Equal(t, want, read.Offset)
+			require.Equal(t, fmt.Sprintf("record %d", want), string(read.Value))
+			b = b[lenWidth+n:]
+			want++
+		}
+		require.Equal(t, uint64(7), want)
+	}
+
+	// closing a partly read reader closes every segment it opened
+	reader := l.ReaderFrom(3)
+	_, err := reader.Read(make([]byte, 1))
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	readers := reader.(*segmentsReader).readers
+	require.Greater(t, len(readers), 1)
+	for _, r := range readers {
+		require.True(t, r.(*originReader).closed)
+	}
+
+	_, err = io.ReadAll(l.ReaderFrom(8))
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+}
+
+// test that subscribers receive appended records in order until they
+// unsubscribe or fall behind
+func testSubscribe(t *testing.T, l *Log) {
+	records, unsubscribe := l.Subscribe()
+	slow, unsubscribeSlow := l.Subscribe()
+	defer unsubscribeSlow()
+
+	for i := range 3 {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	for i := range 3 {
+		record := <-records
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+
+	// no record is delivered after unsubscribing
+	unsubscribe()
+	_, err := l.Append(&api.Record{Value: []byte("unseen")})
+	require.NoError(t, err)
+	_, ok := <-records
+	require.False(t, ok)
+	unsubscribe()
+
+	// a subscriber that stops reading is dropped once its buffer is full
+	for range subscriberBuffer {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	received := 0
+	for range slow {
+		received++
+	}
+	require.Equal(t, subscriberBuffer, received)
+
+	// removing the oldest records doesn't affect later appends, so
+	// subscribers stay open
+	kept, unsubscribeKept := l.Subscribe()
+	defer unsubscribeKept()
+	require.NoError(t, l.Truncate(0))
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, ok = <-kept
+	require.True(t, ok)
+
+	// subscribers are closed out once records at the end are removed
+	removed, unsubscribeRemoved := l.Subscribe()
+	defer unsubscribeRemoved()
+	require.NoError(t, l.truncateFrom(1))
+	_, ok = <-removed
+	require.False(t, ok)
+
+	// and once the log is closed, ending subscribers ranging over records
+	ranging, unsubscribeRanging := l.Subscribe()
+	defer unsubscribeRanging()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range ranging {
+		}
+	}()
+	require.NoError(t, l.Close())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("subscriber still ranging after the log closed")
+	}
+}
+
+// test that the segment metadata follows the records appended to the log
+func testSegments(t *testing.T, l *Log) {
+	start := time.Now()
+	for range 5 {
+		_, err := l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp})
+		require.NoError(t, err)
+	}
+
+	// two records fit in a store. the first record is two bytes shorter as
+	// its offset is left out of the encoded record
+	segments := l.Segments()
+	require.Len(t, segments, 3)
+	for i, want := range []struct {
+		base, next, storeBytes uint64
+	}{
+		{0, 2, 29 + 31},
+		{2, 4, 31 + 31},
+		{4, 5, 31},
+	} {
+		info := segments[i]
+		require.Equal(t, want.base, info.BaseOffset)
+		require.Equal(t, want.next, info.NextOffset)
+		require.Equal(t, want.storeBytes, info.StoreBytes)
+		require.Equal(t, (want.next-want.base)*entWidth, info.IndexBytes)
+		require.Equal(t, i == 2, info.Active)
+		require.False(t, info.Newest.Before(start))
+		require.False(t, info.Newest.Before(info.Oldest))
+	}
+}
+
+// test that the next offset skips over the records removed from the log
+func testNextOffset(t *testing.T, l *Log) {
+	_, ok := l.NextOffset(0)
+	require.False(t, ok)
+	for range 5 {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Truncate(1))
+
+	for after, want := range map[uint64]uint64{0: 2, 2: 2, 3: 3, 4: 4} {
+		next, ok := l.NextOffset(after)
+		require.True(t, ok)
+		require.Equal(t, want, next)
+	}
+	_, ok = l.NextOffset(5)
+	require.False(t, ok)
+}
+
+func testOffsetBounds(t *testing.T, l *Log) {
+	lowest, next := l.OffsetBounds()
+	require.Equal(t, uint64(0), lowest)
+	require.Equal(t, uint64(0), next)
+	for range 5 {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	lowest, next = l.OffsetBounds()
+	require.Equal(t, uint64(0), lowest)
+	require.Equal(t, uint64(5), next)
+
+	require.NoError(t, l.Truncate(1))
+	lowest, next = l.OffsetBounds()
+	require.Equal(t, uint64(2), lowest)
+	require.Equal(t, uint64(5), next)
+
+	require.NoError(t, l.truncateFrom(3))
+	lowest, next = l.OffsetBounds()
+	require.Equal(t, uint64(2), lowest)
+	require.Equal(t, uint64(3), next)
+}
+
+func testAppendRecord(t *testing.T, l *Log) {
+	_, err := l.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	// the log stamps records without a timestamp
+	start := time.Now()
+	record, err := l.AppendRecord(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), record.Offset)
+	require.NotNil(t, record.Timestamp)
+	require.False(t, record.Timestamp.AsTime().Before(start))
+
+	read, err := l.Read(record.Offset)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(record, read))
+
+	// and keeps the timestamp of records that already have one
+	record, err = l.AppendRecord(&api.Record{Value: []byte("replicated"), Timestamp: stamp})
+	require.NoError(t, err)
+	read, err = l.Read(record.Offset)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(stamp, read.Timestamp))
+}
+
+func testClear(t *testing.T, l *Log) {
+	for range 5 {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(l.segments), 1)
+	before, err := os.Stat(l.Dir)
+	require.NoError(t, err)
+	// files that aren't segments are left alone
+	other := path.Join(l.Dir, "other")
+	require.NoError(t, os.WriteFile(other, []byte("other"), 0600))
+
+	l.Config.Segment.InitialOffset = 10
+	require.NoError(t, l.Clear())
+
+	after, err := os.Stat(l.Dir)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(before, after))
+	require.Equal(t, before.Mode(), after.Mode())
+	_, err = os.Stat(other)
+	require.NoError(t, err)
+	files, err := os.ReadDir(l.Dir)
+	require.NoError(t, err)
+	// the new segment's store and index, and the other file
+	require.Len(t, files, 3)
+
+	_, err = l.Read(0)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+}
+
+// test that a record larger than a store is written to a segment of its own
+func testOversizedRecord(t *testing.T, l *Log) {
+	small := &api.Record{Value: []byte("small")}
+	large := &api.Record{Value: bytes.Repeat([]byte("a"), 100)}
+	for _, record := range []*api.Record{small, large, small} {
+		_, err := l.Append(record)
+		require.NoError(t, err)
+	}
+	require.Len(t, l.segments, 3)
+	require.Equal(t, uint64(1), l.segments[1].baseOffset)
+	require.Equal(t, uint64(2), l.segments[1].nextOffset)
+	require.Equal(t, l.activeSegment, l.segments[2])
+
+	read, err := l.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, large.Value, read.Value)
+	read, err = l.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, small.Value, read.Value)
+}
+
+// test that reading segments concurrently returns the log in order
+func testParallelReader(t *testing.T, l *Log) {
+	for i := range 20 {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	want, err := io.ReadAll(l.Reader())
+	require.NoError(t, err)
+
+	for _, workers := range []int{1, 3, 50} {
+		reader := l.ParallelReader(workers)
+		b, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, want, b)
+	}
+
+	// closing the reader early stops reading ahead
+	reader := l.ParallelReader(2)
+	_, err = reader.Read(make([]byte, 1))
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+}
+
+// test that a reader keeps returning its snapshot while segments are truncated
+func testReaderTruncate(t *testing.T, l *Log) {
+	record := &api.Record{Value: []byte("hello world")}
+	count := 50
+	for range count {
+		_, err := l.Append(record)
+		require.NoError(t, err)
+	}
+	reader := l.Reader()
+
+	// remove all but the active segment while the reader is consumed
+	done := make(chan error)
+	go func() {
+		for i := range count - 1 {
+			if err := l.Truncate(uint64(i)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	var b []byte
+	p := make([]byte, 7)
+	for {
+		n, err := reader.Read(p)
+		b = append(b, p[:n]...)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	require.NoError(t, <-done)
+
+	// every record appended before the reader was created is returned
+	for i := range count {
+		size := enc.Uint64(b[:lenWidth])
+		read := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[lenWidth:lenWidth+size], read))
+		require.Equal(t, uint64(i), read.Offset)
+		b = b[lenWidth+size:]
+	}
+	require.Empty(t, b)
+}
+
 // test that unwanted log segments can be removed
 func testTruncate(t *testing.T, l *Log) {
 	record := &api.Record{Value: []byte("hello world")}
@@ -132,4 +1174,140 @@ func testTruncate(t *testing.T, l *Log) {
 	// read truncated part
 	_, err = l.Read(0)
 	require.Error(t, err)
+
+	// truncating up to the highest offset keeps the active segment
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.NoError(t, l.Truncate(highest))
+	require.Len(t, l.segments, 1)
+	require.Equal(t, l.activeSegment, l.segments[0])
+	off, err := l.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, highest+1, off)
+	read, err := l.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, record.Value, read.Value)
+}
+
+// test that the estimate of a truncate matches what it frees
+func testTruncateEstimate(t *testing.T, l *Log) {
+	for range 7 {
+		_, err := l.Append(&api.Record{Value: []byte("hello world"), Timestamp: stamp})
+		require.NoError(t, err)
+	}
+	// the active segment is never removed
+	segments, bytes := l.TruncateEstimate(100)
+	require.Equal(t, 3, segments)
+	require.Equal(t, uint64(29+31+31*4)+6*entWidth, bytes)
+
+	segments, bytes = l.TruncateEstimate(3)
+	require.Equal(t, 2, segments)
+	before := l.Stats()
+	require.NoError(t, l.Truncate(3))
+	after := l.Stats()
+	require.Equal(t, segments, before.Segments-after.Segments)
+	require.Equal(t, bytes, before.TotalBytes-after.TotalBytes)
+}
+
+// test that the active segment is rolled once it exceeds its max age
+func testRollExpired(t *testing.T, l *Log) {
+	l.Config.Segment.MaxAge = 10 * time.Millisecond
+	require.NoError(t, l.Reset())
+
+	record := &api.Record{Value: []byte("hello")}
+	_, err := l.Append(record)
+	require.NoError(t, err)
+	require.Len(t, l.segments, 1)
+
+	// wait for the segment to expire before appending again
+	time.Sleep(20 * time.Millisecond)
+	off, err := l.Append(record)
+	require.NoError(t, err)
+	require.Len(t, l.segments, 2)
+	require.Equal(t, off, l.activeSegment.baseOffset)
+}
+
+// test that a reopened segment keeps the age of its first record
+func testRollExpiredReopened(t *testing.T, l *Log) {
+	l.Config.Segment.MaxAge = time.Hour
+	require.NoError(t, l.Reset())
+
+	old := timestamppb.New(time.Now().Add(-2 * time.Hour))
+	_, err := l.Append(&api.Record{Value: []byte("hello"), Timestamp: old})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	n, err := NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	off, err := n.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	require.Len(t, n.segments, 2)
+	require.Equal(t, off, n.activeSegment.baseOffset)
+}
+
+// test that the stats reflect appends and truncation
+func testStats(t *testing.T, l *Log) {
+	stats := l.Stats()
+	require.Equal(t, 1, stats.Segments)
+	require.Equal(t, uint64(0), stats.Records)
+	require.Equal(t, uint64(0), stats.TotalBytes)
+
+	// two records fill a segment
+	record := &api.Record{Value: []byte("hello world"), Timestamp: stamp}
+	for range 3 {
+		_, err := l.Append(record)
+		require.NoError(t, err)
+	}
+	stats = l.Stats()
+	require.Equal(t, 2, stats.Segments)
+	require.Equal(t, uint64(3), stats.Records)
+	require.Equal(t, l.activeSegment.store.Size(), stats.ActiveSegmentBytes)
+	require.False(t, stats.Newest.Before(stats.Oldest))
+
+	// each record takes up its store entry and an index entry
+	recordWidth := func(off uint64) uint64 {
+		size := proto.Size(&api.Record{Value: record.Value, Offset: off, Timestamp: stamp})
+		return lenWidth + uint64(size) + entWidth
+	}
+	require.Equal(t, recordWidth(0)+recordWidth(1)+recordWidth(2), stats.TotalBytes)
+
+	require.NoError(t, l.Truncate(1))
+	stats = l.Stats()
+	require.Equal(t, 1, stats.Segments)
+	require.Equal(t, uint64(1), stats.Records)
+	require.Equal(t, recordWidth(2), stats.TotalBytes)
+}
+
+// compare reading a multi-segment log one segment at a time and concurrently
+func BenchmarkReader(b *testing.B) {
+	dir, err := os.MkdirTemp("", "log-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	l, err := NewLog(dir, c)
+	require.NoError(b, err)
+	defer l.Close()
+	record := &api.Record{Value: make([]byte, 1024)}
+	for range 16 << 10 {
+		_, err := l.Append(record)
+		require.NoError(b, err)
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		for range b.N {
+			_, err := io.Copy(io.Discard, l.Reader())
+			require.NoError(b, err)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		for range b.N {
+			reader := l.ParallelReader(4)
+			_, err := io.Copy(io.Discard, reader)
+			require.NoError(b, err)
+			reader.Close()
+		}
+	})
 }
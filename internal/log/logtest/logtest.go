@@ -0,0 +1,59 @@
+// Package logtest provides an in-memory commit log for testing the server's
+// handlers without touching disk
+package logtest
+
+import (
+	"sync"
+
+	api "github.com/mrshabel/gumlog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Log keeps records in memory, assigning them consecutive offsets from zero.
+// like the persistent log, reads of offsets it doesn't hold fail with
+// api.ErrOffsetOutOfRange
+type Log struct {
+	mu      sync.RWMutex
+	records []*api.Record
+}
+
+// NewLog creates an empty in-memory log
+func NewLog() *Log {
+	return &Log{}
+}
+
+// Append stores a copy of the record at the next offset, which it returns
+func (l *Log) Append(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	off := uint64(len(l.records))
+	record.Offset = off
+	l.records = append(l.records, proto.Clone(record).(*api.Record))
+	return off, nil
+}
+
+// Read returns a copy of the record at the given offset
+func (l *Log) Read(off uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if off >= uint64(len(l.records)) {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return proto.Clone(l.records[off]).(*api.Record), nil
+}
+
+// LowestOffset returns the offset of the first record, which is always zero
+func (l *Log) LowestOffset() (uint64, error) {
+	return 0, nil
+}
+
+// HighestOffset returns the offset of the latest record, or zero when the log
+// is empty
+func (l *Log) HighestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.records) == 0 {
+		return 0, nil
+	}
+	return uint64(len(l.records) - 1), nil
+}
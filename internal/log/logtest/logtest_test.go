@@ -0,0 +1,38 @@
+package logtest
+
+import (
+	"testing"
+
+	api "github.com/mrshabel/gumlog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	l := NewLog()
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Zero(t, highest)
+	_, err = l.Read(0)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+
+	for i := range 3 {
+		off, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	highest, err = l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+
+	// records read back are copies
+	record, err := l.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), record.Offset)
+	record.Value = []byte("changed")
+	record, err = l.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+
+	_, err = l.Read(3)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+}
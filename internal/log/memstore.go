@@ -0,0 +1,113 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+)
+
+// in-memory segment store. its contents live as long as the process
+type memoryStore struct {
+	mu   sync.Mutex
+	data []byte
+	// forgets the store in its opener
+	remove func()
+}
+
+var _ SegmentStore = (*memoryStore)(nil)
+
+// NewMemoryStoreOpener returns a StoreOpener keeping segment stores in memory.
+// stores outlive being closed so that segments can be reopened from the same
+// opener
+func NewMemoryStoreOpener() StoreOpener {
+	var mu sync.Mutex
+	stores := make(map[string]*memoryStore)
+	return func(dir string, baseOffset uint64, c Config) (SegmentStore, error) {
+		key := path.Join(dir, fmt.Sprint(baseOffset))
+		mu.Lock()
+		defer mu.Unlock()
+		s, ok := stores[key]
+		if !ok {
+			s = &memoryStore{remove: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				delete(stores, key)
+			}}
+			stores[key] = s
+		}
+		return s, nil
+	}
+}
+
+func (s *memoryStore) Append(p []byte) (n uint64, pos uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pos = uint64(len(s.data))
+	s.data = enc.AppendUint64(s.data, uint64(len(p)))
+	s.data = append(s.data, p...)
+	return uint64(len(p)) + lenWidth, pos, nil
+}
+
+// records are held in memory only, there is nothing to flush
+func (s *memoryStore) Flush() error {
+	return nil
+}
+
+func (s *memoryStore) Read(pos uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pos+lenWidth > uint64(len(s.data)) {
+		return nil, fmt.Errorf("%w at position %d: %w", ErrStoreRead, pos, io.EOF)
+	}
+	end := pos + lenWidth + enc.Uint64(s.data[pos:pos+lenWidth])
+	if end > uint64(len(s.data)) {
+		return nil, fmt.Errorf("%w at position %d: %w", ErrStoreRead, pos, io.ErrUnexpectedEOF)
+	}
+	return bytes.Clone(s.data[pos+lenWidth : end]), nil
+}
+
+func (s *memoryStore) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *memoryStore) Size() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uint64(len(s.data))
+}
+
+func (s *memoryStore) Truncate(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pos < uint64(len(s.data)) {
+		s.data = s.data[:pos]
+	}
+	return nil
+}
+
+// read a copy of the current contents
+func (s *memoryStore) Reader() (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(bytes.Clone(s.data))), nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) Remove() error {
+	s.remove()
+	return nil
+}
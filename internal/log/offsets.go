@@ -0,0 +1,87 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// OffsetStore durably keeps the offset each consumer group committed, so that
+// consumers resume where they left off. the offsets are kept apart from the
+// records in a single json file that is replaced on every commit
+type OffsetStore struct {
+	mu      sync.Mutex
+	path    string
+	offsets map[string]uint64
+}
+
+// NewOffsetStore opens the offsets committed to the file at path, which is
+// created on the first commit
+func NewOffsetStore(path string) (*OffsetStore, error) {
+	s := &OffsetStore{path: path, offsets: make(map[string]uint64)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.offsets); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CommitOffset records the offset of the group and persists it before
+// returning
+func (s *OffsetStore) CommitOffset(group string, offset uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.offsets[group]
+	s.offsets[group] = offset
+	if err := s.persist(); err != nil {
+		// keep the last offset that was persisted
+		if ok {
+			s.offsets[group] = prev
+		} else {
+			delete(s.offsets, group)
+		}
+		return err
+	}
+	return nil
+}
+
+// FetchCommittedOffset returns the offset last committed by the group. ok is
+// false when the group never committed one
+func (s *OffsetStore) FetchCommittedOffset(group string) (offset uint64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, ok = s.offsets[group]
+	return offset, ok
+}
+
+// write the offsets to a temporary file and rename it into place, so a crash
+// leaves either the previous or the new offsets behind
+func (s *OffsetStore) persist() error {
+	b, err := json.Marshal(s.offsets)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
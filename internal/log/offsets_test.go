@@ -0,0 +1,32 @@
+package log
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsetStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offsets.json")
+	s, err := NewOffsetStore(path)
+	require.NoError(t, err)
+
+	_, ok := s.FetchCommittedOffset("billing")
+	require.False(t, ok)
+	require.NoError(t, s.CommitOffset("billing", 3))
+	require.NoError(t, s.CommitOffset("billing", 7))
+	require.NoError(t, s.CommitOffset("audit", 0))
+
+	// committed offsets survive a restart
+	s, err = NewOffsetStore(path)
+	require.NoError(t, err)
+	off, ok := s.FetchCommittedOffset("billing")
+	require.True(t, ok)
+	require.Equal(t, uint64(7), off)
+	off, ok = s.FetchCommittedOffset("audit")
+	require.True(t, ok)
+	require.Equal(t, uint64(0), off)
+	_, ok = s.FetchCommittedOffset("search")
+	require.False(t, ok)
+}
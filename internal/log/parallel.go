@@ -0,0 +1,104 @@
+package log
+
+import (
+	"bytes"
+	"io"
+)
+
+// ParallelReader reads the entire log like Reader, but reads up to the given
+// number of segments concurrently into memory ahead of the caller. segments
+// are returned in order. closing the reader stops reading ahead
+func (l *Log) ParallelReader(workers int) io.ReadCloser {
+	readers, err := l.segmentReaders()
+	if err != nil {
+		return io.NopCloser(errReader{err})
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	p := &parallelReader{
+		results: make([]chan segmentRead, len(readers)),
+		slots:   make(chan struct{}, workers),
+		done:    make(chan struct{}),
+	}
+	for i := range p.results {
+		p.results[i] = make(chan segmentRead, 1)
+	}
+	go p.readAhead(readers)
+	return p
+}
+
+// contents of a segment read ahead of the caller
+type segmentRead struct {
+	b   []byte
+	err error
+}
+
+type parallelReader struct {
+	// contents of each segment, delivered once read
+	results []chan segmentRead
+	// bounds the segments being read or held in memory
+	slots chan struct{}
+	// closed to stop reading ahead
+	done chan struct{}
+	// index of the segment being returned and its remaining contents
+	cur int
+	buf *bytes.Reader
+	err error
+}
+
+// read segments in order as slots become available, each in its own goroutine
+func (p *parallelReader) readAhead(readers []io.ReadCloser) {
+	for i, r := range readers {
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.done:
+			// close the segments that won't be read
+			for _, r := range readers[i:] {
+				r.Close()
+			}
+			return
+		}
+		go func() {
+			defer r.Close()
+			// size the buffer up front when the segment's size is known
+			var buf bytes.Buffer
+			if o, ok := r.(*originReader); ok {
+				buf.Grow(int(o.size-o.off) + bytes.MinRead)
+			}
+			_, err := buf.ReadFrom(r)
+			p.results[i] <- segmentRead{b: buf.Bytes(), err: err}
+		}()
+	}
+}
+
+func (p *parallelReader) Read(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	for p.buf == nil || p.buf.Len() == 0 {
+		if p.cur == len(p.results) {
+			return 0, io.EOF
+		}
+		res := <-p.results[p.cur]
+		// the segment no longer takes up a slot once it is being returned
+		<-p.slots
+		p.cur++
+		if res.err != nil {
+			p.err = res.err
+			return 0, p.err
+		}
+		p.buf = bytes.NewReader(res.b)
+	}
+	return p.buf.Read(b)
+}
+
+// stop reading segments ahead of the caller
+func (p *parallelReader) Close() error {
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+	return nil
+}
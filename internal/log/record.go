@@ -0,0 +1,68 @@
+package log
+
+import (
+	"fmt"
+
+	api "github.com/mrshabel/gumlog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// records are stored in a versioned format. version 0 is a bare protobuf
+// encoded record. later versions start with a zero marker byte, which never
+// begins an encoded record as protobuf field numbers start at 1, followed by
+// the version byte and the record in that version's encoding
+const (
+	versionMarker = 0x00
+	// format records are written in
+	recordVersion = 0
+	// newest format records can be read from
+	maxRecordVersion = 0
+)
+
+// ErrUnsupportedRecordVersion is returned when reading a record stored in a
+// format newer than this version of the log understands
+type ErrUnsupportedRecordVersion struct {
+	Version byte
+}
+
+func (e ErrUnsupportedRecordVersion) Error() string {
+	return fmt.Sprintf(
+		"record stored in format version %d, newer than the supported version %d",
+		e.Version, maxRecordVersion,
+	)
+}
+
+// encode a record in the current storage format
+func encodeRecord(record *api.Record) ([]byte, error) {
+	p, err := proto.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if recordVersion == 0 {
+		return p, nil
+	}
+	return append([]byte{versionMarker, recordVersion}, p...), nil
+}
+
+// bytes an encoded record takes up in a store, including its length prefix
+func storedWidth(record *api.Record) uint64 {
+	n := proto.Size(record) + lenWidth
+	if recordVersion != 0 {
+		n += 2
+	}
+	return uint64(n)
+}
+
+// decode a stored record, refusing formats newer than the supported one
+func decodeRecord(p []byte, record *api.Record) error {
+	if len(p) > 0 && p[0] == versionMarker {
+		if len(p) < 2 {
+			return fmt.Errorf("record is missing its format version")
+		}
+		if version := p[1]; version > maxRecordVersion {
+			return ErrUnsupportedRecordVersion{Version: version}
+		}
+		p = p[2:]
+	}
+	return proto.Unmarshal(p, record)
+}
@@ -3,44 +3,127 @@ package log
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
 	"sync"
+	"time"
 
 	api "github.com/mrshabel/gumlog/api/v1"
+	"github.com/mrshabel/gumlog/internal/client"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
+var (
+	// tag holding the name of the server a replication measurement is for
+	peerKey = tag.MustNewKey("peer")
+	// number of records a server holds that haven't been replicated yet
+	replicationLag = stats.Int64("gumlog/replication_lag", "records not yet replicated from a server", stats.UnitDimensionless)
+	// ReplicationLagView reports the latest replication lag of every server.
+	// it is recorded whenever the lag is queried and must be registered to be
+	// exported
+	ReplicationLagView = &view.View{
+		Name:        "gumlog/replication_lag",
+		Measure:     replicationLag,
+		Description: "latest number of records not yet replicated from each server",
+		TagKeys:     []tag.Key{peerKey},
+		Aggregation: view.LastValue(),
+	}
+)
+
+// PeerStatus reports the replication progress from a server
+type PeerStatus struct {
+	Name string
+	Addr string
+	// next offset to replicate from the server
+	Offset uint64
+	// number of records the server holds that haven't been replicated
+	Lag uint64
+	// set when the lag couldn't be determined
+	Err error
+}
+
+// replication state of a server
+type peer struct {
+	addr string
+	// closed to stop replicating from the server
+	leave chan struct{}
+	// next offset to replicate. guarded by the replicator's mutex
+	offset uint64
+	// client of the server while connected. guarded by the replicator's mutex
+	client api.LogClient
+}
+
 type Replicator struct {
 	// grpc connection setup
 	DialOptions []grpc.DialOption
 	// server api
 	LocalServer api.LogClient
+	// bounds of the delay between reconnection attempts to a server.
+	// default to 100ms and 10s
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// logger for replication errors. defaults to the global logger
+	Logger *zap.Logger
 
 	logger *zap.Logger
 	mu     sync.Mutex
-	// servers is a map of all server addresses to channels that can be used to stop replicating data to that server
-	servers map[string]chan struct{}
+	// servers is a map of all server names to their replication state, including
+	// the channel used to stop replicating data from that server
+	servers map[string]*peer
 	// status of the replicator
 	closed bool
 	// close channel for the replicator
 	close chan struct{}
+	// whether the local server leads the cluster. while it does, nothing is
+	// replicated so that peers don't append each other's records in a loop.
+	// pause is closed on becoming the leader and resume on becoming a follower
+	leader bool
+	pause  chan struct{}
+	resume chan struct{}
 }
 
+// errLeader stops replication from a server while the local server leads
+var errLeader = errors.New("local server is the leader")
+
 // init sets up logger and replicator channels
 func (r *Replicator) init() {
 	if r.logger == nil {
-		r.logger = zap.L().Named("replicator")
+		logger := r.Logger
+		if logger == nil {
+			logger = zap.L()
+		}
+		r.logger = logger.Named("replicator")
 	}
 	if r.servers == nil {
-		r.servers = make(map[string]chan struct{})
+		r.servers = make(map[string]*peer)
 	}
 	if r.close == nil {
 		r.close = make(chan struct{})
 	}
+	// servers start out as followers
+	if r.pause == nil {
+		r.pause = make(chan struct{})
+		r.resume = make(chan struct{})
+		close(r.resume)
+	}
+	if r.MinBackoff == 0 {
+		r.MinBackoff = 100 * time.Millisecond
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = 10 * time.Second
+	}
 }
 
-// Join adds the server address to the list of servers to start replication
-func (r *Replicator) Join(name, addr string) error {
+// Join adds the server address to the list of servers to start replication.
+// voters and non-voters are replicated alike
+func (r *Replicator) Join(name, addr string, voter bool) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	// initialize replicator
@@ -55,50 +138,112 @@ func (r *Replicator) Join(name, addr string) error {
 		return nil
 	}
 
-	r.servers[name] = make(chan struct{})
+	p := &peer{addr: addr, leave: make(chan struct{})}
+	r.servers[name] = p
 
 	// begin replication in the background
-	go r.replicate(addr, r.servers[name])
+	go r.replicate(p)
 	return nil
 }
 
-// replicate creates a grpc client and open up a server stream to consume all logs on the server
-func (r *Replicator) replicate(addr string, leave chan struct{}) {
+// replicate consumes the remote server's log and writes its records to the
+// local server. on failures it reconnects with a jittered exponential backoff,
+// resuming after the last replicated record, until the remote server leaves or
+// the replicator is closed
+func (r *Replicator) replicate(p *peer) {
+	backoff := r.MinBackoff
+	for {
+		// wait until the local server is a follower
+		r.mu.Lock()
+		resume := r.resume
+		r.mu.Unlock()
+		select {
+		case <-r.close:
+			return
+		case <-p.leave:
+			return
+		case <-resume:
+		}
+
+		replicated, err := r.consume(p)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errLeader) {
+			backoff = r.MinBackoff
+			continue
+		}
+		// reset the backoff once the connection has made progress
+		if replicated {
+			backoff = r.MinBackoff
+		}
+		r.logError(err, "failed to replicate from server, retrying", p.addr)
+
+		// wait between half and the full backoff before reconnecting
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-r.close:
+			return
+		case <-p.leave:
+			return
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, r.MaxBackoff)
+	}
+}
+
+// consume opens a grpc stream to the server and produces every received record
+// to the local server, starting from the peer's offset which is advanced as
+// records are replicated. a nil error is returned when replication was stopped
+func (r *Replicator) consume(p *peer) (replicated bool, err error) {
 	// connect to server
-	cc, err := grpc.NewClient(addr, r.DialOptions...)
+	c, err := client.Dial(p.addr, r.DialOptions...)
 	if err != nil {
-		r.logError(err, "failed to dial remote leader  server", addr)
-		return
+		return false, err
 	}
-	defer cc.Close()
+	defer c.Close()
 
-	// create grpc api client
-	client := api.NewLogClient(cc)
+	// the api client is available for lag queries while connected
+	r.mu.Lock()
+	p.client = c.Log()
+	offset := p.offset
+	pause := r.pause
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		p.client = nil
+		r.mu.Unlock()
+	}()
 
-	// request for record stream from start of the log
-	ctx := context.Background()
-	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
-		Offset: 0,
-	})
+	// request for record stream from the next offset to replicate. cancelling
+	// the context stops the receiving goroutine
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tail, err := c.Tail(ctx, offset)
 	if err != nil {
-		r.logError(err, "failed to consume data from server", addr)
-		return
+		return false, err
 	}
+	defer tail.Close()
 
 	// store records
 	records := make(chan *api.Record)
+	errs := make(chan error, 1)
 
 	// consume stream in the background
 	go func() {
 		for {
-			recv, err := stream.Recv()
+			record, err := tail.Next()
 			if err != nil {
-				r.logError(err, "failed to receive data from server", addr)
+				errs <- err
 				return
 			}
 
 			// write received record to records channel
-			records <- recv.Record
+			select {
+			case records <- record:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -106,23 +251,56 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 		select {
 		// stop operations when replicator is closed
 		case <-r.close:
-			return
+			return replicated, nil
 			// stop operation when remote leader server leaves the replication cluster
-		case <-leave:
-			return
+		case <-p.leave:
+			return replicated, nil
+		// stop until the local server is a follower again
+		case <-pause:
+			return replicated, errLeader
+		case err := <-errs:
+			return replicated, err
 		// write copy of received record to the local server
 		case record := <-records:
-			_, err := r.LocalServer.Produce(ctx, &api.ProduceRequest{
+			next := record.Offset + 1
+			// trace the record under the request that originally produced it
+			produceCtx := metadata.AppendToOutgoingContext(ctx, api.ReplicatedKey, "true")
+			if record.RequestId != "" {
+				produceCtx = metadata.AppendToOutgoingContext(produceCtx, api.RequestIDKey, record.RequestId)
+			}
+			_, err := r.LocalServer.Produce(produceCtx, &api.ProduceRequest{
 				Record: record,
 			})
 			if err != nil {
-				r.logError(err, "failed to produce record to local server", addr)
-				return
+				return replicated, err
 			}
+			r.mu.Lock()
+			p.offset = next
+			r.mu.Unlock()
+			replicated = true
 		}
 	}
 }
 
+// SetLeader pauses replication from every server while the local server is
+// the leader and resumes it once the server is a follower again
+func (r *Replicator) SetLeader(leader bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+	if r.leader == leader {
+		return
+	}
+	r.leader = leader
+	if leader {
+		close(r.pause)
+		r.resume = make(chan struct{})
+	} else {
+		close(r.resume)
+		r.pause = make(chan struct{})
+	}
+}
+
 // Leave removes the server from the replication cluster and closes the server's associated channel while signaling the follower receiver in the "replicate" goroutine to stop replicating from that server
 func (r *Replicator) Leave(name string) error {
 	r.mu.Lock()
@@ -135,11 +313,80 @@ func (r *Replicator) Leave(name string) error {
 	}
 
 	// close current server channel and remove its entry
-	close(r.servers[name])
+	close(r.servers[name].leave)
 	delete(r.servers, name)
 	return nil
 }
 
+// Lag returns the number of records the named server holds beyond the ones
+// replicated from it. the server must currently be connected
+func (r *Replicator) Lag(name string) (uint64, error) {
+	r.mu.Lock()
+	r.init()
+	p, ok := r.servers[name]
+	var client api.LogClient
+	var offset uint64
+	if ok {
+		client, offset = p.client, p.offset
+	}
+	r.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("server %s is not being replicated", name)
+	}
+	if client == nil {
+		return 0, fmt.Errorf("server %s is not connected", name)
+	}
+
+	res, err := client.GetOffsets(context.Background(), &api.GetOffsetsRequest{
+		Position: api.OffsetPosition_LATEST,
+	})
+	if err != nil {
+		return 0, err
+	}
+	// an empty server has nothing to replicate
+	var lag uint64
+	if !res.Empty && res.Offset+1 > offset {
+		lag = res.Offset + 1 - offset
+	}
+
+	r.logger.Debug(
+		"replication lag",
+		zap.String("name", name),
+		zap.String("addr", p.addr),
+		zap.Uint64("offset", offset),
+		zap.Uint64("lag", lag),
+	)
+	ctx, err := tag.New(context.Background(), tag.Upsert(peerKey, name))
+	if err == nil {
+		stats.Record(ctx, replicationLag.M(int64(lag)))
+	}
+	return lag, nil
+}
+
+// Status returns the replication progress from every server
+func (r *Replicator) Status() []PeerStatus {
+	r.mu.Lock()
+	r.init()
+	statuses := make([]PeerStatus, 0, len(r.servers))
+	for name, p := range r.servers {
+		statuses = append(statuses, PeerStatus{Name: name, Addr: p.addr})
+	}
+	r.mu.Unlock()
+
+	for i := range statuses {
+		statuses[i].Lag, statuses[i].Err = r.Lag(statuses[i].Name)
+		r.mu.Lock()
+		if p, ok := r.servers[statuses[i].Name]; ok {
+			statuses[i].Offset = p.offset
+		}
+		r.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
 // Close closes the replicator and stops replicating to new and existing servers
 func (r *Replicator) Close() error {
 	r.mu.Lock()
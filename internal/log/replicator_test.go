@@ -0,0 +1,200 @@
+package log
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/mrshabel/gumlog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// remoteLog streams a fixed set of records from the requested offset
+type remoteLog struct {
+	api.UnimplementedLogServer
+	records []*api.Record
+}
+
+func (s *remoteLog) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	for _, record := range s.records[req.Offset:] {
+		if err := stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
+			return err
+		}
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func (s *remoteLog) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	if len(s.records) == 0 {
+		return &api.GetOffsetsResponse{Empty: true}, nil
+	}
+	return &api.GetOffsetsResponse{Offset: uint64(len(s.records) - 1)}, nil
+}
+
+// localLog records every produced value. when gate is set, each produce waits
+// to receive from it
+type localLog struct {
+	api.LogClient
+	mu     sync.Mutex
+	values []string
+	gate   chan struct{}
+}
+
+func (c *localLog) Produce(ctx context.Context, req *api.ProduceRequest, opts ...grpc.CallOption) (*api.ProduceResponse, error) {
+	if c.gate != nil {
+		select {
+		case <-c.gate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values = append(c.values, string(req.Record.Value))
+	return &api.ProduceResponse{Offset: uint64(len(c.values) - 1)}, nil
+}
+
+func (c *localLog) produced() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.values...)
+}
+
+func serveRemote(t *testing.T, addr string, values ...string) *grpc.Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	remote := &remoteLog{}
+	for i, value := range values {
+		remote.records = append(remote.records, &api.Record{Value: []byte(value), Offset: uint64(i)})
+	}
+	srv := grpc.NewServer()
+	api.RegisterLogServer(srv, remote)
+	go srv.Serve(ln)
+	return srv
+}
+
+func TestReplicatorReconnects(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	remote := serveRemote(t, addr, "first", "second")
+
+	local := &localLog{}
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		LocalServer: local,
+		MinBackoff:  10 * time.Millisecond,
+		MaxBackoff:  50 * time.Millisecond,
+	}
+	defer r.Close()
+	require.NoError(t, r.Join("remote", addr, true))
+
+	require.Eventually(t, func() bool {
+		return len(local.produced()) == 2
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// the remote server goes away for a while
+	remote.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	// replication resumes after the last replicated record once it is back
+	remote = serveRemote(t, addr, "first", "second", "third")
+	defer remote.Stop()
+	require.Eventually(t, func() bool {
+		return len(local.produced()) == 3
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"first", "second", "third"}, local.produced())
+}
+
+func TestReplicatorLag(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	remote := serveRemote(t, addr, "first", "second", "third")
+	defer remote.Stop()
+
+	local := &localLog{gate: make(chan struct{})}
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		LocalServer: local,
+	}
+	defer r.Close()
+	require.NoError(t, r.Join("remote", addr, true))
+
+	// let the follower catch up partway
+	local.gate <- struct{}{}
+	require.Eventually(t, func() bool {
+		lag, err := r.Lag("remote")
+		return err == nil && lag == 2
+	}, 3*time.Second, 10*time.Millisecond)
+
+	close(local.gate)
+	require.Eventually(t, func() bool {
+		lag, err := r.Lag("remote")
+		return err == nil && lag == 0
+	}, 3*time.Second, 10*time.Millisecond)
+
+	status := r.Status()
+	require.Len(t, status, 1)
+	require.Equal(t, "remote", status[0].Name)
+	require.Equal(t, uint64(3), status[0].Offset)
+	require.Zero(t, status[0].Lag)
+	require.NoError(t, status[0].Err)
+
+	_, err = r.Lag("unknown")
+	require.Error(t, err)
+}
+
+func TestReplicatorLeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	remote := serveRemote(t, addr, "first", "second")
+
+	local := &localLog{}
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		LocalServer: local,
+		MinBackoff:  10 * time.Millisecond,
+		MaxBackoff:  50 * time.Millisecond,
+	}
+	defer r.Close()
+
+	// a leader replicates nothing
+	r.SetLeader(true)
+	require.NoError(t, r.Join("remote", addr, true))
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, local.produced())
+
+	r.SetLeader(false)
+	require.Eventually(t, func() bool {
+		return len(local.produced()) == 2
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// records the remote server gains while the local server leads are only
+	// replicated once it follows again
+	r.SetLeader(true)
+	remote.Stop()
+	remote = serveRemote(t, addr, "first", "second", "third")
+	defer remote.Stop()
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, local.produced(), 2)
+
+	r.SetLeader(false)
+	require.Eventually(t, func() bool {
+		return len(local.produced()) == 3
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"first", "second", "third"}, local.produced())
+}
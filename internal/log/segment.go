@@ -1,23 +1,44 @@
 package log
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	api "github.com/mrshabel/gumlog/api/v1"
-	"google.golang.org/protobuf/proto"
 )
 
 // segment struct to hold store and index
 type segment struct {
-	store *store
+	store SegmentStore
 	index *index
 	// starting offset of this segment
 	baseOffset uint64
 	// next available offset for appending
 	nextOffset uint64
 	config     Config
+	// time the segment was created. reopened segments take the time their
+	// first record was stamped with
+	createdAt time.Time
+	// time of the latest append to the segment
+	appendedAt time.Time
+	// next offset as of the latest checkpoint. records before it are durable
+	checkpoint uint64
+}
+
+// return the path of a segment's file with the given extension. new files are
+// named by their zero-padded base offset so that they sort in offset order,
+// while files of segments created before padding keep their unpadded names
+func segmentPath(dir string, baseOffset uint64, ext string) string {
+	legacy := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy
+	}
+	return path.Join(dir, fmt.Sprintf("%020d%s", baseOffset, ext))
 }
 
 // create a new instance of a segment
@@ -25,24 +46,34 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
+		createdAt:  time.Now(),
 	}
-	// create/open file in append mode
-	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644,
-	)
-	if err != nil {
-		return nil, err
+	// open the store with the configured backend, defaulting to files
+	openStore := c.Segment.OpenStore
+	if openStore == nil {
+		openStore = openFileStore
 	}
-
-	// create instance of store and index file
-	if s.store, err = newStore(storeFile); err != nil {
+	var err error
+	if s.store, err = openStore(dir, baseOffset, c); err != nil {
 		return nil, err
 	}
+	// existing store files were last appended to when they were last modified
+	s.appendedAt = s.createdAt
+	if fs, ok := s.store.(*store); ok && fs.size > 0 {
+		fi, err := fs.Stat()
+		if err != nil {
+			return nil, err
+		}
+		s.appendedAt = fi.ModTime()
+	}
 
+	flag := os.O_RDWR | os.O_CREATE
+	if c.ReadOnly {
+		flag = os.O_RDONLY
+	}
 	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE,
+		segmentPath(dir, baseOffset, ".index"),
+		flag,
 		0644,
 	)
 	if err != nil {
@@ -52,6 +83,17 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
+	// discard any partially written record left behind by a crash
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+
+	if fs, ok := s.store.(*store); ok && c.Segment.Preallocate && !c.ReadOnly {
+		if err := fs.preallocate(c.Segment.MaxStoreBytes); err != nil {
+			return nil, err
+		}
+	}
+
 	// get next offset value. this attempts to retrieve the last entry in the
 	// index if present
 	if off, _, err := s.index.Read(-1); err != nil {
@@ -61,17 +103,135 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		// index with at least an element. nextOffset will be next position
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
+
+	// records past the checkpoint weren't known to be on disk when the
+	// segment was last flushed, so they may be incomplete after a crash
+	checkpoint, ok, err := readCheckpoint(s.checkpointPath())
+	if err != nil {
+		return nil, err
+	}
+	if ok && !c.ReadOnly {
+		if err := s.Truncate(checkpoint); err != nil {
+			return nil, err
+		}
+		s.checkpoint = checkpoint
+	}
+
+	// a reopened segment is as old as its first record. records without a
+	// timestamp were written before the store was last modified
+	if s.nextOffset > baseOffset {
+		if record, err := s.Read(baseOffset); err == nil && record.Timestamp != nil {
+			s.createdAt = record.Timestamp.AsTime()
+		} else {
+			s.createdAt = s.appendedAt
+		}
+	}
 	return s, nil
 }
 
+// checkpoints hold a single absolute offset
+const checkpointWidth = 8
+
+// read the next offset recorded in a checkpoint file. ok is false when the
+// segment has never been checkpointed
+func readCheckpoint(name string) (off uint64, ok bool, err error) {
+	p, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if len(p) != checkpointWidth {
+		return 0, false, fmt.Errorf("checkpoint %s is %d bytes, want %d", name, len(p), checkpointWidth)
+	}
+	return enc.Uint64(p), true, nil
+}
+
+// record the segment's next offset as durable. the checkpoint is written to a
+// temporary file and renamed into place so a crash never leaves it torn
+func (s *segment) writeCheckpoint() error {
+	if s.checkpoint == s.nextOffset {
+		return nil
+	}
+	name := s.checkpointPath()
+	p := make([]byte, checkpointWidth)
+	enc.PutUint64(p, s.nextOffset)
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(p); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	s.checkpoint = s.nextOffset
+	return nil
+}
+
+// path of the segment's checkpoint file, next to its index
+func (s *segment) checkpointPath() string {
+	return strings.TrimSuffix(s.index.Name(), ".index") + ".checkpoint"
+}
+
+// drop trailing index entries that don't point to a fully written record in
+// the store, then cut the store back to the end of the last complete record.
+// an unclean shutdown may leave the index zero padded or the store holding a
+// record whose data was only partly written
+func (s *segment) recover() error {
+	var end uint64
+	storeSize := s.store.Size()
+	for s.index.size > 0 {
+		rel := s.index.size/entWidth - 1
+		out, pos, err := s.index.Read(-1)
+		if err != nil {
+			return err
+		}
+		// entries are written in order so each one holds its own position
+		if uint64(out) == rel && pos+lenWidth <= storeSize {
+			size := make([]byte, lenWidth)
+			if _, err := s.store.ReadAt(size, int64(pos)); err != nil {
+				return err
+			}
+			if recEnd := pos + lenWidth + enc.Uint64(size); recEnd <= storeSize {
+				end = recEnd
+				break
+			}
+		}
+		s.index.Truncate(uint32(rel))
+	}
+	if end < storeSize {
+		return s.store.Truncate(end)
+	}
+	return nil
+}
+
 // append a new record to the segment
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	// get offset to append data
 	cur := s.nextOffset
+	// the index stores offsets relative to the base offset as uint32s
+	if cur-s.baseOffset > math.MaxUint32 {
+		return 0, fmt.Errorf("relative offset %d exceeds index offset range of segment with base offset %d", cur-s.baseOffset, s.baseOffset)
+	}
+	// avoid writing a record to the store that can't be indexed
+	if s.index.isFull() {
+		return 0, ErrIndexFull
+	}
 	record.Offset = cur
 
-	// marshal the record into a byte slice
-	p, err := proto.Marshal(record)
+	// marshal the record into a byte slice in the storage format
+	p, err := encodeRecord(record)
 	if err != nil {
 		return 0, err
 	}
@@ -87,6 +247,7 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	}
 	// update next offset
 	s.nextOffset++
+	s.appendedAt = time.Now()
 	return cur, nil
 }
 
@@ -106,34 +267,86 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 
 	// unmarshal byte slice into protobuf
 	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
+	err = decodeRecord(p, record)
 
 	return record, err
 }
 
+// discard all records in the segment from the given absolute offset onwards
+func (s *segment) Truncate(off uint64) error {
+	if off >= s.nextOffset {
+		return nil
+	}
+	// find the position of the first discarded record in the store
+	rel := uint32(off - s.baseOffset)
+	_, pos, err := s.index.Read(int64(rel))
+	if err != nil {
+		return err
+	}
+	if err := s.store.Truncate(pos); err != nil {
+		return err
+	}
+	s.index.Truncate(rel)
+	s.nextOffset = off
+	// later appends must not be taken as durable up to the old checkpoint
+	if s.checkpoint > off {
+		s.checkpoint = 0
+		if err := s.writeCheckpoint(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // check whether a segment has reached its maximum size or not.
 // the segment is maxed if its underlying store or index size has reached its
-// max bytes as specified in the configuration
+// max bytes as specified in the configuration, or it ran out of relative offsets
 func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes || s.index.size >= s.config.Segment.MaxIndexBytes
+	return s.store.Size() >= s.config.Segment.MaxStoreBytes || s.index.size >= s.config.Segment.MaxIndexBytes ||
+		// the next relative offset wouldn't fit in the index
+		s.nextOffset-s.baseOffset > math.MaxUint32
+}
+
+// check whether the segment has been open for longer than the configured
+// max age
+func (s *segment) IsExpired() bool {
+	maxAge := s.config.Segment.MaxAge
+	return maxAge > 0 && time.Since(s.createdAt) >= maxAge
 }
 
 // remove the segment and its associated store and index files
 func (s *segment) Remove() error {
-	if err := s.Close(); err != nil {
+	if err := s.index.Close(); err != nil {
 		return err
 	}
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := os.Remove(s.checkpointPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
-	return nil
+	return s.store.Remove()
 }
 
-// close the segment's store and index files
+// make the segment's records and their index entries durable, then checkpoint
+// the offset they run up to
+func (s *segment) Flush() error {
+	if err := s.store.Flush(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	return s.writeCheckpoint()
+}
+
+// flush and close the segment's store and index files
 func (s *segment) Close() error {
+	if !s.config.ReadOnly {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
 	if err := s.index.Close(); err != nil {
 		return err
 	}
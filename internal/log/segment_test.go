@@ -1,7 +1,7 @@
 package log
 
 import (
-	"io"
+	"math"
 	"os"
 	"testing"
 
@@ -10,6 +10,19 @@ import (
 )
 
 func TestSegment(t *testing.T) {
+	// run the segment suite against each store backend
+	table := map[string]StoreOpener{
+		"file":   nil,
+		"memory": NewMemoryStoreOpener(),
+	}
+	for scenario, openStore := range table {
+		t.Run(scenario, func(t *testing.T) {
+			testSegment(t, openStore)
+		})
+	}
+}
+
+func testSegment(t *testing.T, openStore StoreOpener) {
 	dir, err := os.MkdirTemp("", "segment-test")
 	require.NoError(t, err)
 	defer os.Remove(dir)
@@ -17,6 +30,7 @@ func TestSegment(t *testing.T) {
 	want := &api.Record{Value: []byte("hello world")}
 
 	c := Config{}
+	c.Segment.OpenStore = openStore
 	c.Segment.MaxStoreBytes = 1024
 	c.Segment.MaxIndexBytes = entWidth * 3
 
@@ -40,9 +54,9 @@ func TestSegment(t *testing.T) {
 		require.Equal(t, want.Value, got.Value)
 	}
 
-	// expect an end of file error since index is maxed out
+	// expect an index full error since index is maxed out
 	_, err = s.Append(want)
-	require.Equal(t, io.EOF, err)
+	require.Equal(t, ErrIndexFull, err)
 
 	// expect index to be maxed
 	require.True(t, s.IsMaxed())
@@ -67,3 +81,125 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentPreallocate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.Preallocate = true
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+
+	// the store file is sized up front while holding no records
+	fi, err := os.Stat(s.store.(*store).Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(c.Segment.MaxStoreBytes), fi.Size())
+	require.Equal(t, uint64(0), s.store.Size())
+
+	for i := uint64(0); i < 3; i++ {
+		off, err := s.Append(want)
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+	size := s.store.Size()
+
+	// closing trims the file to the stored records
+	require.NoError(t, s.Close())
+	fi, err = os.Stat(s.store.(*store).Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(size), fi.Size())
+
+	// a reopened segment appends after its existing records
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), s.nextOffset)
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	for i := uint64(0); i <= 3; i++ {
+		got, err := s.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, got.Offset)
+	}
+	require.NoError(t, s.Close())
+}
+
+func TestSegmentRelativeOffsetOverflow(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// force the segment to its last relative offset
+	s.nextOffset = s.baseOffset + math.MaxUint32
+	require.False(t, s.IsMaxed())
+	off, err := s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, s.baseOffset+math.MaxUint32, off)
+
+	// the segment must be rolled before another append
+	require.True(t, s.IsMaxed())
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.Error(t, err)
+}
+
+func TestSegmentCheckpoint(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+
+	want := &api.Record{Value: []byte("hello world")}
+	for range 3 {
+		_, err := s.Append(want)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Flush())
+	checkpoint, err := os.ReadFile(s.checkpointPath())
+	require.NoError(t, err)
+
+	// simulate a crash after two more records reached the files but before
+	// they were checkpointed
+	for range 2 {
+		_, err := s.Append(want)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+	require.NoError(t, os.WriteFile(s.checkpointPath(), checkpoint, 0644))
+
+	// recovery trims the segment back to the checkpoint
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, uint64(19), s.nextOffset)
+	_, err = s.Read(19)
+	require.Error(t, err)
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), off)
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+}
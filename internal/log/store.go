@@ -3,8 +3,10 @@
 package log
 
 import (
-	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"sync"
 )
@@ -14,33 +16,159 @@ var (
 	enc = binary.BigEndian
 )
 
+// ErrStoreRead wraps failures to read a record from a store
+var ErrStoreRead = errors.New("store read failed")
+
 const (
 	// number of bytes used to store record length
 	lenWidth = 8
 )
 
+// SegmentStore persists the length prefixed records of a segment. the index
+// locates records in it by their position
+type SegmentStore interface {
+	// append a record and return the bytes written and its position
+	Append(p []byte) (n uint64, pos uint64, err error)
+	// read the record at the given position
+	Read(pos uint64) ([]byte, error)
+	// read raw bytes beginning at the given offset
+	ReadAt(p []byte, off int64) (int, error)
+	// number of bytes held by the store
+	Size() uint64
+	// discard all data from the given position onwards
+	Truncate(pos uint64) error
+	// make every appended record durable
+	Flush() error
+	// read the current contents of the store. the reader stays usable after
+	// the store is closed or removed
+	Reader() (io.ReadCloser, error)
+	Close() error
+	// close the store and delete its data
+	Remove() error
+}
+
+// StoreOpener opens the store of the segment with the given base offset,
+// creating it if it doesn't exist
+type StoreOpener func(dir string, baseOffset uint64, c Config) (SegmentStore, error)
+
+// file backed store, the default segment store
 type store struct {
 	*os.File
 	mu   sync.Mutex
-	buf  *bufio.Writer
+	buf  *writeBuffer
 	size uint64
+	// whether the file was grown past its logical size ahead of appends
+	preallocated bool
+	// a read-only store hides truncated data instead of modifying the file
+	readOnly bool
+	// bytes read at once when reading a record. records that fit are read
+	// with their length prefix in a single read
+	readBufferSize int
+	// reads records from the file, swapped out in tests
+	reader io.ReaderAt
 }
 
-// create a new store from a given file. file could be new or existing
-func newStore(f *os.File) (*store, error) {
+var _ SegmentStore = (*store)(nil)
+
+// open the store file of a segment. appends are written from the end of the
+// stored records rather than the end of the file, which may be preallocated
+func openFileStore(dir string, baseOffset uint64, c Config) (SegmentStore, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if c.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(
+		segmentPath(dir, baseOffset, ".store"),
+		flag, 0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newStore(f, c.Segment.WriteBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	s.readOnly = c.ReadOnly
+	s.readBufferSize = c.Segment.ReadBufferSize
+	return s, nil
+}
+
+// create a new store from a given file. file could be new or existing.
+// appends are buffered in memory up to the given size, 4KB when unset
+func newStore(f *os.File, bufferSize int) (*store, error) {
 	fi, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
 	// get the file size
 	size := uint64(fi.Size())
+	// appends continue from the end of the existing records
+	if _, err := f.Seek(int64(size), io.SeekStart); err != nil {
+		return nil, err
+	}
 	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
+		File:   f,
+		size:   size,
+		buf:    newWriteBuffer(f, bufferSize),
+		reader: f,
 	}, nil
 }
 
+// writeBuffer buffers appended records in memory ahead of writing them to
+// the store file. unlike a bufio.Writer it exposes the buffered bytes, so that
+// records still in the buffer can be read without flushing it
+type writeBuffer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// buffer up to size bytes, 4KB when unset
+func newWriteBuffer(w io.Writer, size int) *writeBuffer {
+	if size <= 0 {
+		size = 4 << 10
+	}
+	return &writeBuffer{w: w, buf: make([]byte, 0, size)}
+}
+
+// buffer p, flushing the buffer first when p doesn't fit. writes larger than
+// the buffer go straight to the underlying writer
+func (b *writeBuffer) Write(p []byte) (int, error) {
+	if len(p) > cap(b.buf)-len(b.buf) {
+		if err := b.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) > cap(b.buf) {
+		n, err := b.w.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		return n, err
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// write the buffered bytes to the underlying writer. bytes that couldn't be
+// written stay buffered
+func (b *writeBuffer) Flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	n, err := b.w.Write(b.buf)
+	if err == nil && n < len(b.buf) {
+		err = io.ErrShortWrite
+	}
+	b.buf = b.buf[:copy(b.buf, b.buf[n:])]
+	return err
+}
+
+// bytes buffered but not written yet. they are only valid until the next
+// write or flush
+func (b *writeBuffer) Bytes() []byte {
+	return b.buf
+}
+
 // append a record to the underlying store.
 // returns the number of bytes written, position of record in the store, error
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
@@ -48,42 +176,51 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	defer s.mu.Unlock()
 	// get the underlying store size
 	pos = s.size
-	// write record length to buffer in binary format
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
-		return 0, 0, err
+	// prefix the data with its length in binary format. record becomes:
+	// `length-data`, written at once so a failed write never leaves a
+	// dangling length behind
+	record := make([]byte, lenWidth+len(p))
+	enc.PutUint64(record, uint64(len(p)))
+	copy(record[lenWidth:], p)
+	w, err := s.buf.Write(record)
+	if err == nil && w < len(record) {
+		err = io.ErrShortWrite
 	}
-	// write actual data to buffer. record now becomes: `length-data`
-	// length of every record is prefixed is used as prefix for its data
-	w, err := s.buf.Write(p)
 	if err != nil {
 		return 0, 0, err
 	}
 	// update store size for next operation
-	w += lenWidth
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
 
-// read a record from the underlying store with its position
+// read a record from the underlying store with its position. records still
+// in the write buffer are read from it without flushing it
 func (s *store) Read(pos uint64) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	// flush existing data on buffer
-	if err := s.buf.Flush(); err != nil {
-		return nil, err
-	}
 
-	// read prefixed length of current data needed
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	// read the length prefix together with as much of the data as fits in
+	// the read buffer, without reading past the stored records
+	window := lenWidth
+	if pos < s.size {
+		window = max(window, int(min(uint64(s.readBufferSize), s.size-pos)))
+	}
+	buf := make([]byte, window)
+	if _, err := s.readAt(buf, int64(pos)); err != nil {
+		return nil, fmt.Errorf("%w at position %d: %w", ErrStoreRead, pos, err)
+	}
+	size := enc.Uint64(buf)
+	if lenWidth+size <= uint64(window) {
+		return buf[lenWidth : lenWidth+size : lenWidth+size], nil
 	}
 
-	// read record by using its initial position and standard length as offset
-	// this will skip the prefixed length and only read the actual data
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
-		return nil, err
+	// read the rest of a record that doesn't fit in the read buffer. this
+	// skips the prefixed length and the data read so far
+	b := make([]byte, size)
+	n := copy(b, buf[lenWidth:])
+	if _, err := s.readAt(b[n:], int64(pos+lenWidth)+int64(n)); err != nil {
+		return nil, fmt.Errorf("%w at position %d: %w", ErrStoreRead, pos, err)
 	}
 	return b, nil
 }
@@ -92,10 +229,101 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.readAt(p, off)
+}
+
+// read from the file up to the bytes written to it and from the write buffer
+// past them
+func (s *store) readAt(p []byte, off int64) (int, error) {
+	buffered := s.buf.Bytes()
+	flushed := int64(s.size) - int64(len(buffered))
+	var n int
+	if off < flushed {
+		m := int(min(int64(len(p)), flushed-off))
+		var err error
+		if n, err = s.reader.ReadAt(p[:m], off); err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		start := off + int64(n) - flushed
+		if start < int64(len(buffered)) {
+			n += copy(p[n:], buffered[start:])
+		}
+		if n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// number of bytes held by the store, including buffered writes
+func (s *store) Size() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// flush buffered data and read the store through a separate handle to the
+// store file, up to its current size. the handle stays readable even if the
+// store is closed or removed
+func (s *store) Reader() (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &originReader{File: f, size: int64(s.size)}, nil
+}
+
+// discard all data in the store from the given position onwards
+func (s *store) Truncate(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		s.size = min(s.size, pos)
+		return nil
+	}
 	if err := s.buf.Flush(); err != nil {
-		return 0, err
+		return err
+	}
+	if err := s.File.Truncate(int64(pos)); err != nil {
+		return err
+	}
+	if _, err := s.File.Seek(int64(pos), io.SeekStart); err != nil {
+		return err
+	}
+	s.size = pos
+	return nil
+}
+
+// write buffered records to the file and commit them to disk
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
 	}
-	return s.File.ReadAt(p, off)
+	return s.File.Sync()
+}
+
+// grow the store file to the given size ahead of appends to reduce
+// fragmentation. the logical size of the store is unchanged
+func (s *store) preallocate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size <= s.size {
+		return nil
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.preallocated = true
+	return nil
 }
 
 // persist buffered data before closing the underlying file
@@ -105,5 +333,62 @@ func (s *store) Close() error {
 	if err := s.buf.Flush(); err != nil {
 		return err
 	}
+	// trim the preallocated space past the stored records
+	if s.preallocated {
+		if err := s.File.Truncate(int64(s.size)); err != nil {
+			return err
+		}
+	}
 	return s.File.Close()
 }
+
+// close the store and delete its file
+func (s *store) Remove() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return os.Remove(s.Name())
+}
+
+// originReader reads a store through its own file handle up to the store size
+// captured when the reader was created. removing the store afterwards does not
+// affect the reader
+type originReader struct {
+	*os.File
+	off  int64
+	size int64
+	// set once the file is closed, which happens as soon as it's read to
+	// the end or fails
+	closed bool
+}
+
+func (o *originReader) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		o.Close()
+		return 0, io.EOF
+	}
+	// never read past the snapshotted size
+	if remaining := o.size - o.off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := o.ReadAt(p, o.off)
+	o.off += int64(n)
+	if err == io.EOF && o.off < o.size {
+		// the store was cut short after the snapshot was taken
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		o.Close()
+		return n, err
+	}
+	return n, nil
+}
+
+// close the file unless it was already closed
+func (o *originReader) Close() error {
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	return o.File.Close()
+}
@@ -1,6 +1,9 @@
 package log
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"testing"
 
@@ -18,15 +21,22 @@ func TestStoreAppendRead(t *testing.T) {
 	defer os.Remove(f.Name())
 
 	// create instance of store
-	s, err := newStore(f)
+	s, err := newStore(f, 0)
 	require.NoError(t, err)
 
 	testAppend(t, s)
 	testRead(t, s)
 	testReadAt(t, s)
 
-	// create new store from same file and verify reads
-	s, err = newStore(f)
+	// reading past the stored records reports the underlying cause
+	_, err = s.Read(width * 3)
+	require.ErrorIs(t, err, ErrStoreRead)
+	require.ErrorIs(t, err, io.EOF)
+
+	// create new store from same file and verify reads. reads don't flush
+	// buffered records, so they are flushed first
+	require.NoError(t, s.Flush())
+	s, err = newStore(f, 0)
 	require.NoError(t, err)
 	testRead(t, s)
 }
@@ -83,7 +93,7 @@ func TestStoreClose(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
 	// create new instance of store
-	s, err := newStore(f)
+	s, err := newStore(f, 0)
 	require.NoError(t, err)
 	_, _, err = s.Append(write)
 	require.NoError(t, err)
@@ -101,6 +111,106 @@ func TestStoreClose(t *testing.T) {
 	require.True(t, afterSize > beforeSize)
 }
 
+// errDiskFull is returned by shortWriter after accepting part of a write
+var errDiskFull = errors.New("disk full")
+
+// shortWriter accepts only part of every write
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) {
+	return len(p) / 2, errDiskFull
+}
+
+func TestStoreAppendShortWrite(t *testing.T) {
+	f, err := os.CreateTemp("", "store_short_write_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f, 0)
+	require.NoError(t, err)
+
+	// records larger than the buffer go straight to the failing writer
+	s.buf = newWriteBuffer(shortWriter{}, 16)
+	_, _, err = s.Append(make([]byte, 64))
+	require.ErrorIs(t, err, errDiskFull)
+	require.Equal(t, uint64(0), s.size)
+}
+
+// test that records still in the write buffer are read without flushing it
+func TestStoreReadBuffered(t *testing.T) {
+	f, err := os.CreateTemp("", "store_read_buffered_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f, 0)
+	require.NoError(t, err)
+	defer s.Close()
+	// room for two and a half records
+	w := &countingWriter{Writer: f}
+	s.buf = newWriteBuffer(w, int(width)*5/2)
+
+	var positions []uint64
+	for i := range 2 {
+		_, pos, err := s.Append(write)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+		for _, pos := range positions {
+			data, err := s.Read(pos)
+			require.NoError(t, err)
+			require.Equal(t, write, data)
+		}
+		require.Zero(t, w.writes, "record %d", i)
+	}
+
+	// the third record doesn't fit, so the first two are flushed and reads
+	// span the file and the buffer
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	positions = append(positions, pos)
+	require.Equal(t, 1, w.writes)
+	for _, pos := range positions {
+		data, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, data)
+	}
+	p := make([]byte, 2*width)
+	n, err := s.ReadAt(p, int64(width))
+	require.NoError(t, err)
+	require.Equal(t, int(2*width), n)
+	require.Equal(t, write, p[lenWidth:width])
+	require.Equal(t, write, p[width+lenWidth:])
+	require.Equal(t, 1, w.writes)
+}
+
+// test that records are read whole whether they fit in the read buffer, span
+// past it or the buffer reaches past the stored records
+func TestStoreReadBuffer(t *testing.T) {
+	records := [][]byte{write, []byte(""), make([]byte, 100), write}
+	for _, size := range []int{0, lenWidth, int(width) - 1, int(width), 64, 4 << 10} {
+		t.Run(fmt.Sprintf("buffer %d", size), func(t *testing.T) {
+			f, err := os.CreateTemp("", "store_read_buffer_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+			s, err := newStore(f, 0)
+			require.NoError(t, err)
+			defer s.Close()
+			s.readBufferSize = size
+
+			var positions []uint64
+			for _, record := range records {
+				_, pos, err := s.Append(record)
+				require.NoError(t, err)
+				positions = append(positions, pos)
+			}
+			for i, pos := range positions {
+				data, err := s.Read(pos)
+				require.NoError(t, err)
+				require.Equal(t, records[i], data)
+			}
+			_, err = s.Read(s.size)
+			require.ErrorIs(t, err, io.EOF)
+		})
+	}
+}
+
 func openFile(name string) (file *os.File, size int64, err error) {
 	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
@@ -112,3 +222,82 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+// countingWriter counts the writes made to the underlying writer
+type countingWriter struct {
+	io.Writer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Writer.Write(p)
+}
+
+// compare the writes made to the store file for small records under
+// different write buffer sizes
+func BenchmarkStoreAppend(b *testing.B) {
+	for _, size := range []int{4 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("buffer %dKB", size>>10), func(b *testing.B) {
+			f, err := os.CreateTemp("", "store_append_bench")
+			require.NoError(b, err)
+			defer os.Remove(f.Name())
+			s, err := newStore(f, size)
+			require.NoError(b, err)
+			defer s.Close()
+			w := &countingWriter{Writer: f}
+			s.buf = newWriteBuffer(w, size)
+
+			b.ResetTimer()
+			for range b.N {
+				_, _, err := s.Append(write)
+				require.NoError(b, err)
+			}
+			require.NoError(b, s.buf.Flush())
+			b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// countingReader counts the reads made from the underlying reader
+type countingReader struct {
+	io.ReaderAt
+	reads int
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	r.reads++
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+// compare the reads made from the store file for small records with and
+// without a read buffer
+func BenchmarkStoreRead(b *testing.B) {
+	for _, size := range []int{0, 4 << 10} {
+		b.Run(fmt.Sprintf("buffer %dKB", size>>10), func(b *testing.B) {
+			f, err := os.CreateTemp("", "store_read_bench")
+			require.NoError(b, err)
+			defer os.Remove(f.Name())
+			s, err := newStore(f, 0)
+			require.NoError(b, err)
+			defer s.Close()
+			s.readBufferSize = size
+			r := &countingReader{ReaderAt: f}
+			s.reader = r
+
+			var positions []uint64
+			for range 1024 {
+				_, pos, err := s.Append(write)
+				require.NoError(b, err)
+				positions = append(positions, pos)
+			}
+
+			b.ResetTimer()
+			for i := range b.N {
+				_, err := s.Read(positions[i%len(positions)])
+				require.NoError(b, err)
+			}
+			b.ReportMetric(float64(r.reads)/float64(b.N), "reads/op")
+		})
+	}
+}
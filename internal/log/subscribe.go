@@ -0,0 +1,72 @@
+package log
+
+import (
+	api "github.com/mrshabel/gumlog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// number of appended records buffered for each subscriber
+const subscriberBuffer = 256
+
+// Subscribe delivers every record appended to the log from now on to the
+// returned channel, in offset order. appends never wait on subscribers: a
+// subscriber that falls more than the buffer behind is unsubscribed and its
+// channel closed, after which it can catch up by reading the log from the
+// offset after the last record it received. channels are closed the same
+// way when the log is closed, or when records at its end are removed or it is
+// cleared, as offsets already delivered may then be reused. removing the
+// oldest records with Truncate leaves subscribers be. records are shared
+// between subscribers and must not be modified. the returned function
+// unsubscribes and closes the channel
+func (l *Log) Subscribe() (<-chan *api.Record, func()) {
+	l.subsMu.Lock()
+	defer l.subsMu.Unlock()
+	if l.subscribers == nil {
+		l.subscribers = make(map[uint64]chan *api.Record)
+	}
+	id := l.nextSubID
+	l.nextSubID++
+	ch := make(chan *api.Record, subscriberBuffer)
+	l.subscribers[id] = ch
+	return ch, func() {
+		l.subsMu.Lock()
+		defer l.subsMu.Unlock()
+		l.unsubscribe(id)
+	}
+}
+
+// remove a subscriber and close its channel. callers hold subsMu
+func (l *Log) unsubscribe(id uint64) {
+	if ch, ok := l.subscribers[id]; ok {
+		delete(l.subscribers, id)
+		close(ch)
+	}
+}
+
+// unsubscribe every subscriber, which finds out from its closed channel
+func (l *Log) closeSubscribers() {
+	l.subsMu.Lock()
+	defer l.subsMu.Unlock()
+	for id := range l.subscribers {
+		l.unsubscribe(id)
+	}
+}
+
+// deliver an appended record to every subscriber. called with the log locked
+// so that records are delivered in offset order
+func (l *Log) publish(record *api.Record) {
+	l.subsMu.Lock()
+	defer l.subsMu.Unlock()
+	if len(l.subscribers) == 0 {
+		return
+	}
+	// the caller may reuse its record after the append
+	record = proto.Clone(record).(*api.Record)
+	for id, ch := range l.subscribers {
+		select {
+		case ch <- record:
+		default:
+			l.unsubscribe(id)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Package mux shares one listener between protocols, such as raft, grpc and
+// http, by matching the first bytes of each accepted connection
+package mux
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by the listeners of a closed mux
+var ErrClosed = errors.New("mux: listener closed")
+
+// Matcher reports whether a connection belongs to a listener from the first
+// bytes it sends. matchers peek at the reader without consuming it
+type Matcher func(r *bufio.Reader) bool
+
+// Byte matches connections whose first byte is b, such as the raft
+// connections marked by the stream layer
+func Byte(b byte) Matcher {
+	return Prefix([]byte{b})
+}
+
+// Prefix matches connections that start with the given bytes
+func Prefix(prefix []byte) Matcher {
+	return func(r *bufio.Reader) bool {
+		// peek a byte at a time so that a mismatch doesn't wait on the
+		// connection for bytes it may never send
+		for i := range prefix {
+			p, err := r.Peek(i + 1)
+			if err != nil || p[i] != prefix[i] {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// HTTP1 matches plaintext http/1 requests by their method
+func HTTP1() Matcher {
+	methods := []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH", "CONNECT", "TRACE"}
+	matchers := make([]Matcher, 0, len(methods))
+	for _, method := range methods {
+		matchers = append(matchers, Prefix([]byte(method+" ")))
+	}
+	return func(r *bufio.Reader) bool {
+		for _, match := range matchers {
+			if match(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Any matches every connection. it's registered last to catch the
+// connections no other listener matches
+func Any() Matcher {
+	return func(*bufio.Reader) bool { return true }
+}
+
+// how long a connection may take to send the bytes it's matched with
+const defaultMatchTimeout = 5 * time.Second
+
+// Mux hands the connections accepted by a listener to the first of its
+// listeners whose matcher they satisfy. connections matching none are closed
+type Mux struct {
+	ln net.Listener
+	// how long matching a connection may take. defaults to 5s
+	MatchTimeout time.Duration
+
+	mu        sync.Mutex
+	listeners []*listener
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates a mux over the given listener. listeners are registered with
+// Match before Serve is called
+func New(ln net.Listener) *Mux {
+	return &Mux{
+		ln:           ln,
+		MatchTimeout: defaultMatchTimeout,
+		done:         make(chan struct{}),
+	}
+}
+
+// Match returns a listener that accepts the connections satisfying the
+// matcher. listeners are tried in the order they're registered
+func (m *Mux) Match(match Matcher) net.Listener {
+	l := &listener{
+		mux:    m,
+		match:  match,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.listeners = append(m.listeners, l)
+	m.mu.Unlock()
+	return l
+}
+
+// Serve accepts connections until the underlying listener fails or the mux
+// is closed
+func (m *Mux) Serve() error {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			select {
+			case <-m.done:
+				return nil
+			default:
+			}
+			m.Close()
+			return err
+		}
+		go m.serve(conn)
+	}
+}
+
+// match a connection and hand it to its listener
+func (m *Mux) serve(conn net.Conn) {
+	c := &muxConn{Conn: conn, r: bufio.NewReader(conn)}
+	if err := conn.SetReadDeadline(time.Now().Add(m.MatchTimeout)); err != nil {
+		conn.Close()
+		return
+	}
+	m.mu.Lock()
+	listeners := m.listeners
+	m.mu.Unlock()
+	for _, l := range listeners {
+		if !l.match(c.r) {
+			continue
+		}
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			conn.Close()
+			return
+		}
+		select {
+		case l.conns <- c:
+		case <-l.closed:
+			conn.Close()
+		case <-m.done:
+			conn.Close()
+		}
+		return
+	}
+	conn.Close()
+}
+
+// Addr returns the address of the underlying listener
+func (m *Mux) Addr() net.Addr {
+	return m.ln.Addr()
+}
+
+// Close stops the mux and its listeners
+func (m *Mux) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		err = m.ln.Close()
+	})
+	return err
+}
+
+// listener accepts the connections of a mux satisfying its matcher
+type listener struct {
+	mux       *Mux
+	match     Matcher
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	case <-l.mux.done:
+		return nil, ErrClosed
+	}
+}
+
+// Close stops the listener. connections matching it are closed from then on
+// while the mux and its other listeners keep serving
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.mux.Addr()
+}
+
+// muxConn replays the bytes peeked while matching before reading from the
+// connection
+type muxConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *muxConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
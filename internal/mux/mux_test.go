@@ -0,0 +1,110 @@
+package mux_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/mrshabel/gumlog/internal/log"
+	"github.com/mrshabel/gumlog/internal/mux"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// test that raft, http and grpc connections are served on a single port
+func TestMux(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	m := mux.New(ln)
+	defer m.Close()
+
+	// raft connections are marked by the stream layer, so they're matched
+	// first and grpc takes whatever is left
+	streamLayer := log.NewStreamLayer(m.Match(mux.Byte(log.RaftRPC)), nil, nil)
+	httpLn := m.Match(mux.HTTP1())
+	grpcLn := m.Match(mux.Any())
+	go m.Serve()
+
+	gsrv := grpc.NewServer()
+	healthpb.RegisterHealthServer(gsrv, health.NewServer())
+	go gsrv.Serve(grpcLn)
+	defer gsrv.Stop()
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	hsrv := &http.Server{Handler: handler}
+	go hsrv.Serve(httpLn)
+	defer hsrv.Close()
+
+	addr := ln.Addr().String()
+
+	// grpc
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	// raft
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := streamLayer.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	raftConn, err := streamLayer.Dial(raft.ServerAddress(addr), time.Second)
+	require.NoError(t, err)
+	defer raftConn.Close()
+	_, err = raftConn.Write([]byte("append entries"))
+	require.NoError(t, err)
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		p := make([]byte, len("append entries"))
+		_, err = io.ReadFull(conn, p)
+		require.NoError(t, err)
+		require.Equal(t, "append entries", string(p))
+	case <-time.After(5 * time.Second):
+		t.Fatal("raft connection wasn't accepted")
+	}
+
+	// http
+	httpRes, err := http.Get("http://" + addr + "/healthz")
+	require.NoError(t, err)
+	defer httpRes.Body.Close()
+	body, err := io.ReadAll(httpRes.Body)
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(body))
+}
+
+// test that connections no listener matches are closed
+func TestMuxUnmatched(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	m := mux.New(ln)
+	defer m.Close()
+	m.Match(mux.Byte(log.RaftRPC))
+	go m.Serve()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,40 @@
+// this package places keyed records into partitions deterministically
+package partition
+
+import (
+	"hash/crc32"
+	"sync/atomic"
+)
+
+// HashFunc hashes a record key
+type HashFunc func(key []byte) uint32
+
+// Partitioner assigns records to partitions by a stable hash of their key.
+// records without a key are spread over the partitions round-robin
+type Partitioner struct {
+	hash HashFunc
+	// next partition for records without a key
+	next atomic.Uint64
+}
+
+// New creates a partitioner hashing keys with the given function, crc32 when
+// nil. the hash must be stable across processes for placement to be
+// deterministic
+func New(hash HashFunc) *Partitioner {
+	if hash == nil {
+		hash = crc32.ChecksumIEEE
+	}
+	return &Partitioner{hash: hash}
+}
+
+// Partition returns the index of the partition, between 0 and numPartitions,
+// the record with the given key belongs to
+func (p *Partitioner) Partition(key []byte, numPartitions int) int {
+	if numPartitions < 1 {
+		panic("partition: number of partitions must be positive")
+	}
+	if len(key) == 0 {
+		return int((p.next.Add(1) - 1) % uint64(numPartitions))
+	}
+	return int(p.hash(key) % uint32(numPartitions))
+}
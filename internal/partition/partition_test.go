@@ -0,0 +1,69 @@
+package partition
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartition(t *testing.T) {
+	table := map[string]func(t *testing.T, p *Partitioner){
+		"keys are placed stably":               testStable,
+		"random keys are spread evenly":        testDistribution,
+		"records without keys are round-robin": testRoundRobin,
+		"custom hash functions place the keys": testCustomHash,
+		"invalid partition count panics":       testInvalidCount,
+	}
+	for scenario, fn := range table {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t, New(nil))
+		})
+	}
+}
+
+func testStable(t *testing.T, p *Partitioner) {
+	// crc32 placements must not change between runs or versions
+	want := map[string]int{"user-1": 4, "user-2": 6, "orders": 6}
+	for key, partition := range want {
+		for range 3 {
+			require.Equal(t, partition, p.Partition([]byte(key), 8), key)
+		}
+		// a new partitioner places the key the same way
+		require.Equal(t, partition, New(nil).Partition([]byte(key), 8), key)
+	}
+}
+
+func testDistribution(t *testing.T, p *Partitioner) {
+	const partitions, keys = 8, 80000
+	counts := make([]int, partitions)
+	key := make([]byte, 16)
+	for range keys {
+		_, err := rand.Read(key)
+		require.NoError(t, err)
+		counts[p.Partition(key, partitions)]++
+	}
+	// every partition receives within 10% of its fair share
+	for _, count := range counts {
+		require.InDelta(t, keys/partitions, count, keys/partitions/10)
+	}
+}
+
+func testRoundRobin(t *testing.T, p *Partitioner) {
+	var got []int
+	for range 6 {
+		got = append(got, p.Partition(nil, 3))
+	}
+	require.Equal(t, []int{0, 1, 2, 0, 1, 2}, got)
+	require.Equal(t, 0, p.Partition([]byte{}, 1))
+}
+
+func testCustomHash(t *testing.T, _ *Partitioner) {
+	p := New(func(key []byte) uint32 { return uint32(len(key)) })
+	require.Equal(t, 3, p.Partition([]byte("abc"), 4))
+	require.Equal(t, 1, p.Partition([]byte("abcde"), 4))
+}
+
+func testInvalidCount(t *testing.T, p *Partitioner) {
+	require.Panics(t, func() { p.Partition([]byte("key"), 0) })
+}
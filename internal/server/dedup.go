@@ -0,0 +1,83 @@
+package server
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// default number of produced sequences remembered for deduplication
+const defaultDedupCacheSize = 1024
+
+// a produced record's identity as supplied by its producer
+type sequenceKey struct {
+	producerID string
+	sequence   uint64
+}
+
+// outcome of appending a produced record, returned again for its retries
+type produced struct {
+	offset uint64
+	// set once the record was flushed to disk
+	durable bool
+}
+
+// dedupCache remembers the offsets assigned to the most recent producer
+// sequences so that retried produce requests are not appended twice
+type dedupCache struct {
+	// guards the cache and the sequences being appended
+	mu    sync.Mutex
+	cache *lru.Cache
+	// sequences being appended, whose channel is closed once they're done.
+	// duplicates wait on it rather than racing the append
+	inflight map[sequenceKey]chan struct{}
+}
+
+func newDedupCache(size int) (*dedupCache, error) {
+	if size == 0 {
+		size = defaultDedupCacheSize
+	}
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &dedupCache{cache: cache, inflight: make(map[sequenceKey]chan struct{})}, nil
+}
+
+// produce returns how the producer's sequence was already appended, or
+// appends the record with the given function and remembers the outcome. only
+// appends of the same sequence wait on each other
+func (d *dedupCache) produce(producerID string, sequence uint64, appendFn func() (produced, error)) (produced, error) {
+	key := sequenceKey{producerID: producerID, sequence: sequence}
+	d.mu.Lock()
+	for {
+		if res, ok := d.cache.Get(key); ok {
+			d.mu.Unlock()
+			return res.(produced), nil
+		}
+		done, ok := d.inflight[key]
+		if !ok {
+			break
+		}
+		// check the cache again once the other append is done. a failed one
+		// leaves the sequence to be appended again
+		d.mu.Unlock()
+		<-done
+		d.mu.Lock()
+	}
+	done := make(chan struct{})
+	d.inflight[key] = done
+	d.mu.Unlock()
+
+	res, err := appendFn()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.inflight, key)
+	close(done)
+	if err != nil {
+		return produced{}, err
+	}
+	d.cache.Add(key, res)
+	return res, nil
+}
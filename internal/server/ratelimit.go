@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rateLimiter keeps a token bucket for every client subject so that a single
+// misbehaving client can not starve the others
+type rateLimiter struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*rate.Limiter
+}
+
+func newRateLimiter(limit float64, burst int) *rateLimiter {
+	// allow at least one request through when no burst is configured
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{
+		limit:    rate.Limit(limit),
+		burst:    burst,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// allow reports whether the subject has a token left for another request
+func (r *rateLimiter) allow(subject string) bool {
+	r.mu.Lock()
+	limiter, ok := r.limiters[subject]
+	if !ok {
+		limiter = rate.NewLimiter(r.limit, r.burst)
+		r.limiters[subject] = limiter
+	}
+	r.mu.Unlock()
+	return limiter.Allow()
+}
+
+// check returns a resource exhausted error once the subject is out of tokens
+func (r *rateLimiter) check(ctx context.Context) error {
+	sub := subject(ctx)
+	if !r.allow(sub) {
+		return status.Errorf(codes.ResourceExhausted, "rate limit exceeded for %q", sub)
+	}
+	return nil
+}
+
+// unaryInterceptor rate limits every unary request
+func (r *rateLimiter) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := r.check(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamInterceptor rate limits every message received on a stream
+func (r *rateLimiter) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &rateLimitedStream{ServerStream: ss, limiter: r})
+}
+
+type rateLimitedStream struct {
+	grpc.ServerStream
+	limiter *rateLimiter
+}
+
+func (s *rateLimitedStream) RecvMsg(m interface{}) error {
+	if err := s.limiter.check(s.Context()); err != nil {
+		return err
+	}
+	return s.ServerStream.RecvMsg(m)
+}
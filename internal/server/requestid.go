@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	api "github.com/mrshabel/gumlog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// unique context key of a request's id
+type requestIDContextKey struct{}
+
+// tag the request id is logged under
+const requestIDTag = "grpc.request_id"
+
+// take the request id from the incoming metadata or generate a new one, then
+// attach it to the context and the request's log fields. the id is sent back
+// in the response header
+func withRequestID(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(api.RequestIDKey); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	if id == "" {
+		id = newRequestID()
+	}
+	grpc_ctxtags.Extract(ctx).Set(requestIDTag, id)
+	grpc.SetHeader(ctx, metadata.Pairs(api.RequestIDKey, id))
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// random 16 byte hex encoded request id
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// the id of the request the context belongs to, empty outside of requests
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// requestIDUnaryInterceptor attaches a request id to every unary request
+func requestIDUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(withRequestID(ctx), req)
+}
+
+// requestIDStreamInterceptor attaches a request id to every stream
+func requestIDStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	wrapped := grpc_middleware.WrapServerStream(ss)
+	wrapped.WrappedContext = withRequestID(ss.Context())
+	return handler(srv, wrapped)
+}
@@ -2,9 +2,14 @@ package server
 
 import (
 	"context"
+	"errors"
+	"io"
+	"math"
+	"sync/atomic"
 	"time"
 
 	api "github.com/mrshabel/gumlog/api/v1"
+	"github.com/mrshabel/gumlog/internal/log"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
@@ -17,9 +22,10 @@ import (
 	"go.uber.org/zap/zapcore"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // a log interface that can be implemented as either an in-memory or persistent log
@@ -28,37 +34,197 @@ type CommitLog interface {
 	Read(uint64) (*api.Record, error)
 }
 
+// a commit log that gives up on operations whose context is done before they
+// start
+type ContextCommitLog interface {
+	AppendContext(context.Context, *api.Record) (uint64, error)
+	ReadContext(context.Context, uint64) (*api.Record, error)
+}
+
+// a replicated commit log that acknowledges appended records at different
+// levels of durability
+type AckingCommitLog interface {
+	AppendAcks(*api.Record, api.Acks) (uint64, error)
+}
+
+// a commit log that can read records by offsets counting back from its end
+type RelativeCommitLog interface {
+	ReadRelative(int64) (*api.Record, error)
+}
+
+// a commit log that can make the records appended to it durable by flushing
+// them to disk
+type DurableCommitLog interface {
+	Flush() error
+}
+
+// a commit log whose offsets may have gaps, such as after old records are
+// removed, that can point readers to the next offset holding a record
+type OffsetSeeker interface {
+	NextOffset(after uint64) (uint64, bool)
+}
+
+// a commit log that reports its offset bounds without locking, so that reads
+// clearly outside of them are turned away cheaply
+type BoundedCommitLog interface {
+	OffsetBounds() (lowest, next uint64)
+}
+
+// a replicated commit log that can snapshot its state on demand
+type Snapshotter interface {
+	Snapshot() error
+}
+
 type Config struct {
 	CommitLog CommitLog
-	// authorization enforcer with acl rules
+	// authorization enforcer with acl rules. optional when Insecure is set
 	Authorizer Authorizer
+	// serve clients without authenticating them, permitting every request
+	// unless an Authorizer is set. meant for local development without
+	// certificates and never for production
+	Insecure bool
+	// source of the log statistics served by GetStats
+	StatsGetter StatsGetter
+	// source of the log boundaries served by GetOffsets
+	OffsetGetter OffsetGetter
+	// source of the cluster members served by GetServers
+	ServerGetter ServerGetter
+	// durable store of the offsets committed by consumer groups
+	GroupOffsets GroupOffsets
+	// maximum size in bytes of a single message the server can receive or send.
+	// every record in a produce request, including each message on the produce
+	// stream, must fit within MaxRecvMsgSize together with its framing. requests
+	// above the limit are rejected with codes.ResourceExhausted
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+	// maximum size in bytes of a produced record's value, regardless of the
+	// message size. larger records are rejected with codes.InvalidArgument
+	// before reaching the log. zero leaves values unlimited
+	MaxRecordBytes int
+	// sustained number of requests per second allowed for each client subject
+	// and the number of requests a subject may burst above it. rate limiting is
+	// disabled when RateLimit is zero
+	RateLimit float64
+	RateBurst int
+	// duration a consume stream may go without sending a record before it is
+	// closed with codes.DeadlineExceeded. zero keeps idle streams open
+	StreamIdleTimeout time.Duration
+	// interval at which a following consume stream sends heartbeat messages
+	// while no records are sent, letting clients detect dead connections.
+	// zero disables heartbeats
+	StreamHeartbeatInterval time.Duration
+	// number of producer sequences remembered to deduplicate retried produce
+	// requests. defaults to 1024
+	DedupCacheSize int
+	// number of records a produce stream receives ahead of appending them.
+	// once reached, the server stops receiving so that clients producing
+	// faster than the log appends are slowed down by flow control. defaults
+	// to 64
+	ProduceStreamInFlight int
+	// connections idle for KeepaliveTime are pinged and closed when the ping
+	// isn't acknowledged within KeepaliveTimeout, so dead clients behind NATs
+	// and load balancers are detected. default to 30s and 10s
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// shortest interval clients may ping the server at, with or without open
+	// streams. clients pinging more often are sent a GOAWAY and disconnected.
+	// defaults to 10s
+	KeepaliveMinTime time.Duration
+	// logger requests and server events are logged to. defaults to the
+	// global logger
+	Logger *zap.Logger
+	// store produced records with the id of the request that produced them,
+	// so that servers replicating them log the same id. off by default as
+	// the id is chosen by the client
+	RecordRequestIDs bool
 }
 
+// the server's named logger
+func serverLogger(config *Config) *zap.Logger {
+	logger := config.Logger
+	if logger == nil {
+		logger = zap.L()
+	}
+	return logger.Named("server")
+}
+
+// default message size limits, matching grpc's own defaults
+const (
+	defaultMaxRecvMsgSize = 4 << 20
+	defaultMaxSendMsgSize = math.MaxInt32
+)
+
+// default number of records a produce stream receives ahead of appending them
+const defaultProduceStreamInFlight = 64
+
+// how long a consume stream waits before reading a record again that the
+// server's raft log holds but hasn't applied yet
+const notReplicatedRetryInterval = 10 * time.Millisecond
+
+// default keepalive parameters
+const (
+	defaultKeepaliveTime    = 30 * time.Second
+	defaultKeepaliveTimeout = 10 * time.Second
+	defaultKeepaliveMinTime = 10 * time.Second
+)
+
 // access control constants
 const (
-	objectWildCard = "*"
-	produceAction  = "produce"
-	consumeAction  = "consume"
+	objectWildCard  = "*"
+	produceAction   = "produce"
+	consumeAction   = "consume"
+	snapshotAction  = "snapshot"
+	replicateAction = "replicate"
 )
 
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
 
+// permits every request of insecure servers
+type permitAll struct{}
+
+func (permitAll) Authorize(subject, object, action string) error {
+	return nil
+}
+
+// a log that can report statistics about its contents
+type StatsGetter interface {
+	Stats() log.Stats
+}
+
+// a log that can report the range of offsets it holds
+type OffsetGetter interface {
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+}
+
+// a source of the members of the cluster
+type ServerGetter interface {
+	GetServers() ([]*api.Server, error)
+}
+
+// a store of the offsets consumer groups committed
+type GroupOffsets interface {
+	CommitOffset(group string, offset uint64) error
+	FetchCommittedOffset(group string) (uint64, bool)
+}
+
 // unique context key
 type subjectContextKey struct{}
 
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	dedup *dedupCache
 }
 
 // grpc server stub implementation
 var _ api.LogServer = (*grpcServer)(nil)
 
 func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
-	// create a global named logger for the server with configurations
-	logger := zap.L().Named("server")
+	// create a named logger for the server with configurations
+	logger := serverLogger(config)
 	// record duration of request in log
 	zapOpts := []grpc_zap.Option{
 		grpc_zap.WithDurationField(
@@ -89,20 +255,62 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 
 	// hook unary and streaming interceptor/middleware into the grpc request
 	// the authentication interceptor is registered on the middleware chain
-	opts = append(opts, grpc.StreamInterceptor(
-		grpc_middleware.ChainStreamServer(
-			// record traces and logs
-			grpc_ctxtags.StreamServerInterceptor(),
-			grpc_zap.StreamServerInterceptor(logger, zapOpts...),
-			grpc_auth.StreamServerInterceptor(authenticate),
-		)), grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
+	subjects, err := newSubjectCache(defaultSubjectCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		// record traces and logs
+		grpc_ctxtags.StreamServerInterceptor(),
+		requestIDStreamInterceptor,
+		grpc_zap.StreamServerInterceptor(logger, zapOpts...),
+		grpc_auth.StreamServerInterceptor(subjects.authenticate),
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
 		grpc_ctxtags.UnaryServerInterceptor(),
+		requestIDUnaryInterceptor,
 		grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
-		grpc_auth.UnaryServerInterceptor(authenticate),
-	)))
+		grpc_auth.UnaryServerInterceptor(subjects.authenticate),
+	}
+	// rate limit clients after authentication so that the subject is known
+	if config.RateLimit > 0 {
+		limiter := newRateLimiter(config.RateLimit, config.RateBurst)
+		streamInterceptors = append(streamInterceptors, limiter.streamInterceptor)
+		unaryInterceptors = append(unaryInterceptors, limiter.unaryInterceptor)
+	}
+	opts = append(opts,
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryInterceptors...)),
+	)
 	// attach opencensus stat handler to record stats
 	opts = append(opts, grpc.StatsHandler(&ocgrpc.ServerHandler{}))
 
+	// bound the size of messages exchanged with clients
+	maxRecvMsgSize, maxSendMsgSize := config.MaxRecvMsgSize, config.MaxSendMsgSize
+	if maxRecvMsgSize == 0 {
+		maxRecvMsgSize = defaultMaxRecvMsgSize
+	}
+	if maxSendMsgSize == 0 {
+		maxSendMsgSize = defaultMaxSendMsgSize
+	}
+	opts = append(opts, grpc.MaxRecvMsgSize(maxRecvMsgSize), grpc.MaxSendMsgSize(maxSendMsgSize))
+
+	// keep idle connections alive and stop clients from pinging too often
+	keepaliveTime, keepaliveTimeout, keepaliveMinTime := config.KeepaliveTime, config.KeepaliveTimeout, config.KeepaliveMinTime
+	if keepaliveTime == 0 {
+		keepaliveTime = defaultKeepaliveTime
+	}
+	if keepaliveTimeout == 0 {
+		keepaliveTimeout = defaultKeepaliveTimeout
+	}
+	if keepaliveMinTime == 0 {
+		keepaliveMinTime = defaultKeepaliveMinTime
+	}
+	opts = append(opts,
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: keepaliveTime, Timeout: keepaliveTimeout}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: keepaliveMinTime, PermitWithoutStream: true}),
+	)
+
 	// create a new grpc server and register the service with telemetry options
 	gsrv := grpc.NewServer(opts...)
 	srv, err := newGRPCServer(config)
@@ -114,7 +322,22 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 }
 
 func newGRPCServer(config *Config) (srv *grpcServer, err error) {
-	return &grpcServer{Config: config}, nil
+	if config.Insecure {
+		serverLogger(config).Warn(
+			"running in INSECURE mode: clients are not authenticated and every request is permitted. never use this in production",
+		)
+		if config.Authorizer == nil {
+			config.Authorizer = permitAll{}
+		}
+	}
+	if config.Authorizer == nil {
+		return nil, errors.New("an authorizer is required unless the server is insecure")
+	}
+	dedup, err := newDedupCache(config.DedupCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcServer{Config: config, dedup: dedup}, nil
 }
 
 // server handlers
@@ -125,14 +348,85 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, produceAction); err != nil {
 		return nil, err
 	}
+	if n := len(req.Record.GetValue()); s.MaxRecordBytes > 0 && n > s.MaxRecordBytes {
+		return nil, status.Errorf(codes.InvalidArgument, "record value of %d bytes exceeds the limit of %d bytes", n, s.MaxRecordBytes)
+	}
+	// compressed values are stored verbatim, so the codec must be one
+	// consumers know how to decompress
+	if c := req.Record.GetCompression(); api.Compression_name[int32(c)] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown compression: %v", c)
+	}
+
+	// records are stamped before they're replicated so that every server
+	// stores the same time and, when enabled, the same request id. only
+	// records replicated from another server keep what they were stamped with
+	if req.Record != nil {
+		replicated := s.replicated(ctx)
+		if !replicated {
+			req.Record.RequestId = ""
+			if s.RecordRequestIDs {
+				req.Record.RequestId = requestID(ctx)
+			}
+		}
+		if !replicated || req.Record.Timestamp == nil {
+			req.Record.Timestamp = timestamppb.Now()
+		}
+	}
 
-	// append the record to the log
-	offset, err := s.CommitLog.Append(req.Record)
+	// append the record to the log. sequenced records are appended at most
+	// once, which takes the offset they were assigned
+	durableLog, waitDurable := s.CommitLog.(DurableCommitLog)
+	waitDurable = waitDurable && req.WaitDurable
+	_, acking := s.CommitLog.(AckingCommitLog)
+	unknown := acking && req.Acks == api.Acks_NONE
+	if unknown && waitDurable {
+		return nil, status.Error(codes.InvalidArgument, "durable records need acks LEADER or ALL")
+	}
+	appended := false
+	appendFn := func() (produced, error) {
+		appended = true
+		off, err := s.append(ctx, req.Record, req.Acks)
+		if err != nil || !waitDurable {
+			return produced{offset: off}, err
+		}
+		return produced{offset: off, durable: true}, durableLog.Flush()
+	}
+	var res produced
+	var err error
+	if req.ProducerId != "" {
+		if unknown {
+			return nil, status.Error(codes.InvalidArgument, "sequenced records need acks LEADER or ALL")
+		}
+		res, err = s.dedup.produce(req.ProducerId, req.Sequence, appendFn)
+	} else {
+		res, err = appendFn()
+	}
 	if err != nil {
 		return nil, err
 	}
+	// a retry waiting for durability may find its record appended by a
+	// request that didn't wait
+	if waitDurable && !res.durable {
+		if err := durableLog.Flush(); err != nil {
+			return nil, err
+		}
+		res.durable = true
+	}
 
-	return &api.ProduceResponse{Offset: offset}, nil
+	// duplicates of a sequenced record read back the time of the record
+	// appended first
+	timestamp := req.Record.GetTimestamp()
+	if !appended {
+		if record, err := s.CommitLog.Read(res.offset); err == nil {
+			timestamp = record.Timestamp
+		}
+	}
+	return &api.ProduceResponse{
+		Offset:        res.offset,
+		Durable:       res.durable,
+		Timestamp:     timestamp,
+		OffsetUnknown: unknown,
+	}, nil
 }
 
 // retrieve a record from the commit log
@@ -142,7 +436,17 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 		return nil, err
 	}
 
-	record, err := s.CommitLog.Read(req.Offset)
+	if req.RelativeOffset < 0 {
+		record, err := s.readRelative(ctx, req.RelativeOffset)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ConsumeResponse{Record: record}, nil
+	}
+	if err := s.checkBounds(req.Offset); err != nil {
+		return nil, err
+	}
+	record, err := s.read(ctx, req.Offset)
 	if err != nil {
 		return nil, err
 	}
@@ -150,34 +454,373 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+// retrieve the records at a set of offsets in request order. offsets that
+// can't be read are reported in their own result instead of failing the rest
+func (s *grpcServer) ConsumeMany(ctx context.Context, req *api.ConsumeManyRequest) (*api.ConsumeManyResponse, error) {
+	// permit only allowed clients
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	results := make([]*api.ConsumeResult, 0, len(req.Offsets))
+	for _, off := range req.Offsets {
+		result := &api.ConsumeResult{Offset: off}
+		record, err := s.read(ctx, off)
+		if err != nil {
+			// the remaining reads would fail the same way
+			if status.Code(err) == codes.Canceled || status.Code(err) == codes.DeadlineExceeded {
+				return nil, err
+			}
+			st := status.Convert(err)
+			result.Code = int32(st.Code())
+			result.Error = st.Message()
+		}
+		result.Record = record
+		results = append(results, result)
+	}
+	return &api.ConsumeManyResponse{Results: results}, nil
+}
+
+// read the record at an offset counting back from the latest record, where
+// -1 is the latest record
+func (s *grpcServer) readRelative(ctx context.Context, rel int64) (*api.Record, error) {
+	l, ok := s.CommitLog.(RelativeCommitLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "relative offsets are not supported")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+	return l.ReadRelative(rel)
+}
+
+// append to the commit log unless the request's context is done first.
+// records appended to a local log are stored once appended, satisfying every
+// acknowledgement level
+func (s *grpcServer) append(ctx context.Context, record *api.Record, acks api.Acks) (uint64, error) {
+	if l, ok := s.CommitLog.(AckingCommitLog); ok && acks != api.Acks_LEADER {
+		if err := ctx.Err(); err != nil {
+			return 0, contextError(err)
+		}
+		return l.AppendAcks(record, acks)
+	}
+	if l, ok := s.CommitLog.(ContextCommitLog); ok {
+		off, err := l.AppendContext(ctx, record)
+		return off, contextError(err)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, contextError(err)
+	}
+	return s.CommitLog.Append(record)
+}
+
+// reject offsets outside of the commit log's cached bounds. the bounds may lag
+// concurrent appends, so the offset being appended next is left to the log
+func (s *grpcServer) checkBounds(off uint64) error {
+	l, ok := s.CommitLog.(BoundedCommitLog)
+	if !ok {
+		return nil
+	}
+	if lowest, next := l.OffsetBounds(); off < lowest || off > next {
+		return api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return nil
+}
+
+// read from the commit log unless the request's context is done first
+func (s *grpcServer) read(ctx context.Context, off uint64) (*api.Record, error) {
+	if l, ok := s.CommitLog.(ContextCommitLog); ok {
+		record, err := l.ReadContext(ctx, off)
+		return record, contextError(err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+	return s.CommitLog.Read(off)
+}
+
+// convert context errors into their grpc status and pass others through
+func contextError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return err
+}
+
+// retrieve the size and content statistics of the commit log
+func (s *grpcServer) GetStats(ctx context.Context, req *api.GetStatsRequest) (*api.GetStatsResponse, error) {
+	// permit only allowed clients
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, consumeAction); err != nil {
+		return nil, err
+	}
+	if s.StatsGetter == nil {
+		return nil, status.Error(codes.Unimplemented, "stats are not available")
+	}
+
+	stats := s.StatsGetter.Stats()
+	return &api.GetStatsResponse{
+		Segments:           uint64(stats.Segments),
+		TotalBytes:         stats.TotalBytes,
+		Records:            stats.Records,
+		ActiveSegmentBytes: stats.ActiveSegmentBytes,
+		Oldest:             timestamppb.New(stats.Oldest),
+		Newest:             timestamppb.New(stats.Newest),
+	}, nil
+}
+
+// retrieve the earliest or latest offset in the commit log
+func (s *grpcServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	// permit only allowed clients
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, consumeAction); err != nil {
+		return nil, err
+	}
+	if s.OffsetGetter == nil {
+		return nil, status.Error(codes.Unimplemented, "offsets are not available")
+	}
+
+	lowest, err := s.OffsetGetter.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := s.OffsetGetter.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+	empty, err := s.isEmpty(highest)
+	if err != nil {
+		return nil, err
+	}
+	if empty {
+		return &api.GetOffsetsResponse{Offset: lowest, Empty: true}, nil
+	}
+
+	switch req.Position {
+	case api.OffsetPosition_EARLIEST:
+		return &api.GetOffsetsResponse{Offset: lowest}, nil
+	case api.OffsetPosition_LATEST:
+		return &api.GetOffsetsResponse{Offset: highest}, nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown offset position: %v", req.Position)
+	}
+}
+
+// retrieve the members of the cluster
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	// permit only allowed clients
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, consumeAction); err != nil {
+		return nil, err
+	}
+	if s.ServerGetter == nil {
+		return nil, status.Error(codes.Unimplemented, "servers are not available")
+	}
+
+	servers, err := s.ServerGetter.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+// snapshot the commit log, such as ahead of maintenance
+func (s *grpcServer) Snapshot(ctx context.Context, req *api.SnapshotRequest) (*api.SnapshotResponse, error) {
+	// permit only allowed clients
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, snapshotAction); err != nil {
+		return nil, err
+	}
+	snapshotter, ok := s.CommitLog.(Snapshotter)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "snapshots are not available")
+	}
+	if err := snapshotter.Snapshot(); err != nil {
+		return nil, err
+	}
+	return &api.SnapshotResponse{}, nil
+}
+
+// commit the offset a consumer group resumes from
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	// permit only allowed clients
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, consumeAction); err != nil {
+		return nil, err
+	}
+	if s.GroupOffsets == nil {
+		return nil, status.Error(codes.Unimplemented, "group offsets are not available")
+	}
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "group is required")
+	}
+	if err := s.GroupOffsets.CommitOffset(req.Group, req.Offset); err != nil {
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+// retrieve the offset a consumer group last committed
+func (s *grpcServer) FetchCommittedOffset(ctx context.Context, req *api.FetchCommittedOffsetRequest) (*api.FetchCommittedOffsetResponse, error) {
+	// permit only allowed clients
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, consumeAction); err != nil {
+		return nil, err
+	}
+	if s.GroupOffsets == nil {
+		return nil, status.Error(codes.Unimplemented, "group offsets are not available")
+	}
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "group is required")
+	}
+	offset, found := s.GroupOffsets.FetchCommittedOffset(req.Group)
+	return &api.FetchCommittedOffsetResponse{Offset: offset, Found: found}, nil
+}
+
+// report whether the log holds no records given its highest offset. the
+// highest offset of an empty log holds no record
+func (s *grpcServer) isEmpty(highest uint64) (bool, error) {
+	_, err := s.CommitLog.Read(highest)
+	if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+		return true, nil
+	}
+	return false, err
+}
+
+// resolve the offset of the first of the latest n records, or of the first
+// record when the log holds fewer. an empty log starts at its next record
+func (s *grpcServer) tailOffset(n uint64) (uint64, error) {
+	if s.OffsetGetter == nil {
+		return 0, status.Error(codes.Unimplemented, "offsets are not available")
+	}
+	lowest, err := s.OffsetGetter.LowestOffset()
+	if err != nil {
+		return 0, err
+	}
+	highest, err := s.OffsetGetter.HighestOffset()
+	if err != nil {
+		return 0, err
+	}
+	empty, err := s.isEmpty(highest)
+	if err != nil || empty {
+		return lowest, err
+	}
+	if n >= highest-lowest+1 {
+		return lowest, nil
+	}
+	return highest + 1 - n, nil
+}
+
 // streaming logs
 
 // bidirectional streaming for clients to send data stream into the server's
 // log with live responses
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
-	for {
-		req, err := stream.Recv()
-		if err != nil {
-			return err
+	inFlight := s.ProduceStreamInFlight
+	if inFlight <= 0 {
+		inFlight = defaultProduceStreamInFlight
+	}
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	// receive requests while earlier ones are appended. a slot is taken
+	// before each receive and freed once its record is appended, bounding
+	// the records held in memory
+	slots := make(chan struct{}, inFlight)
+	reqs := make(chan *api.ProduceRequest, inFlight)
+	recvErr := make(chan error, 1)
+	go func() {
+		defer close(reqs)
+		for {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				recvErr <- ctx.Err()
+				return
+			}
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			reqs <- req
 		}
-		// add record to log and stream response to client
-		res, err := s.Produce(stream.Context(), req)
+	}()
+
+	// add records to the log in order and stream responses to the client
+	var committed uint64
+	for req := range reqs {
+		res, err := s.Produce(ctx, req)
+		<-slots
 		if err != nil {
-			return err
+			return api.ErrProduceStreamAborted{Committed: committed, Err: err}
 		}
+		committed++
 		if err = stream.Send(res); err != nil {
 			return err
 		}
 	}
+	if err := <-recvErr; err != io.EOF {
+		return err
+	}
+	return nil
 }
 
-// stream data to client from current offset until the last offset
+// stream data to client from current offset until the last offset. in follow
+// mode the stream keeps waiting for new records, otherwise it ends after the
+// latest offset when the stream was opened. tail mode starts with the latest
+// records and then follows
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	if req.Mode == api.ConsumeMode_TAIL {
+		start, err := s.tailOffset(req.Tail)
+		if err != nil {
+			return err
+		}
+		req.Offset = start
+		req.RelativeOffset = 0
+	}
+	follow := req.Mode == api.ConsumeMode_FOLLOW || req.Mode == api.ConsumeMode_TAIL
+	var end uint64
+	if req.Mode == api.ConsumeMode_UNTIL_LATEST {
+		if s.OffsetGetter == nil {
+			return status.Error(codes.Unimplemented, "offsets are not available")
+		}
+		highest, err := s.OffsetGetter.HighestOffset()
+		if err != nil {
+			return err
+		}
+		empty, err := s.isEmpty(highest)
+		if err != nil || empty {
+			return err
+		}
+		end = highest
+	}
+	// close streams that go idle. the timer restarts after every sent record
+	var idle <-chan time.Time
+	var timer *time.Timer
+	if s.StreamIdleTimeout > 0 {
+		timer = time.NewTimer(s.StreamIdleTimeout)
+		defer timer.Stop()
+		idle = timer.C
+	}
+	// following streams send heartbeats once no record has been sent for the
+	// heartbeat interval
+	var heartbeat <-chan time.Time
+	var heartbeatTimer *time.Timer
+	if s.StreamHeartbeatInterval > 0 && follow {
+		heartbeatTimer = time.NewTimer(s.StreamHeartbeatInterval)
+		defer heartbeatTimer.Stop()
+		heartbeat = heartbeatTimer.C
+	}
 	for {
+		if req.Mode == api.ConsumeMode_UNTIL_LATEST && req.Offset > end {
+			return nil
+		}
 		select {
 		// wait on done channel
 		case <-stream.Context().Done():
 			return nil
+		case <-idle:
+			return status.Errorf(codes.DeadlineExceeded, "no records sent for %s", s.StreamIdleTimeout)
+		case <-heartbeat:
+			if err := stream.Send(&api.ConsumeResponse{Heartbeat: true}); err != nil {
+				return err
+			}
+			heartbeatTimer.Reset(s.StreamHeartbeatInterval)
 		default:
 			// consume client request
 			res, err := s.Consume(stream.Context(), req)
@@ -185,6 +828,20 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				// skip over records removed from the log
+				if seeker, ok := s.CommitLog.(OffsetSeeker); ok {
+					if next, found := seeker.NextOffset(req.Offset); found {
+						req.Offset = next
+					}
+				}
+				continue
+			case api.ErrNotReplicatedYet:
+				// the record is committed, so wait for it to be applied
+				select {
+				case <-stream.Context().Done():
+					return nil
+				case <-time.After(notReplicatedRetryInterval):
+				}
 				continue
 			default:
 				return err
@@ -194,34 +851,126 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 			if err = stream.Send(res); err != nil {
 				return err
 			}
-			// proceed to next offset
-			req.Offset++
+			if timer != nil {
+				timer.Reset(s.StreamIdleTimeout)
+			}
+			if heartbeatTimer != nil {
+				heartbeatTimer.Reset(s.StreamHeartbeatInterval)
+			}
+			// proceed to the offset after the record sent
+			req.Offset = res.Record.Offset + 1
 		}
 	}
 }
 
-// read the subject information of a connected client certificate and write it to the server context using an interceptor(middleware)
-func authenticate(ctx context.Context) (context.Context, error) {
-	// get the peer information from the given context
-	peer, ok := peer.FromContext(ctx)
-	if !ok {
-		return ctx, status.New(
-			codes.Unknown, "couldn't get peer info",
-		).Err()
+// stream records to a consumer group from the offset it committed. the client
+// acks processed records on the same stream to advance the group's offset, so
+// records sent but not acked before a disconnect are sent again by the next
+// stream of the group
+func (s *grpcServer) ConsumeGroupStream(stream api.Log_ConsumeGroupStreamServer) error {
+	// permit only allowed clients
+	if err := s.Authorizer.Authorize(subject(stream.Context()), objectWildCard, consumeAction); err != nil {
+		return err
+	}
+	if s.GroupOffsets == nil {
+		return status.Error(codes.Unimplemented, "group offsets are not available")
+	}
+	// the first message names the group
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if req.Group == "" {
+		return status.Error(codes.InvalidArgument, "group is required")
+	}
+	group := req.Group
+	start, _ := s.GroupOffsets.FetchCommittedOffset(group)
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	gs := &groupStream{Log_ConsumeGroupStreamServer: stream, ctx: ctx}
+	gs.next.Store(start)
+
+	// commit acks while records are streamed. the stream ends once the client
+	// closes its side or an ack fails
+	ackErr := make(chan error, 1)
+	go func() {
+		defer cancel()
+		committed := start
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				ackErr <- err
+				return
+			}
+			// the group resumes after the acked record
+			next := req.Ack + 1
+			if next > gs.next.Load() {
+				ackErr <- status.Errorf(codes.InvalidArgument, "offset %d was not sent", req.Ack)
+				return
+			}
+			// acks never move the group back
+			if next <= committed {
+				continue
+			}
+			if err := s.GroupOffsets.CommitOffset(group, next); err != nil {
+				ackErr <- err
+				return
+			}
+			committed = next
+		}
+	}()
+
+	err = s.ConsumeStream(&api.ConsumeRequest{Offset: start}, gs)
+	// reads fail once the stream is canceled, so the acks decide how a
+	// canceled stream ends
+	if ctx.Err() != nil {
+		return <-ackErr
 	}
-	// extract the authentication information
-	if peer.AuthInfo == nil {
-		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	return err
+}
+
+// groupStream is a group stream seen as a consume stream. it ends with the
+// handler's context and tracks the offset after the last record sent
+type groupStream struct {
+	api.Log_ConsumeGroupStreamServer
+	ctx  context.Context
+	next atomic.Uint64
+}
+
+func (s *groupStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *groupStream) Send(res *api.ConsumeResponse) error {
+	// track the record before sending it, as the client may ack it as soon
+	// as it's received
+	if res.Record != nil {
+		s.next.Store(res.Record.Offset + 1)
 	}
-	// cast peer info as tls credential and extract subject common name as specified in the CA certificate
-	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
-	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
-	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
+	return s.Log_ConsumeGroupStreamServer.Send(res)
+}
 
-	return ctx, nil
+// report whether the request produces records replicated from another
+// server. requests from subjects not allowed to replicate are produced like
+// any other, so their records are stamped again
+func (s *grpcServer) replicated(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if len(md.Get(api.ReplicatedKey)) == 0 {
+		return false
+	}
+	return s.Authorizer.Authorize(subject(ctx), objectWildCard, replicateAction) == nil
 }
 
-// extract the subject information from a given context tree
+// extract the subject information from a given context tree. an empty subject
+// is returned when the context was not authenticated
 func subject(ctx context.Context) string {
-	return ctx.Value(subjectContextKey{}).(string)
+	subject, _ := ctx.Value(subjectContextKey{}).(string)
+	return subject
 }
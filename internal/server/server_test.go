@@ -1,10 +1,19 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"flag"
+	"fmt"
+	"io"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,13 +21,22 @@ import (
 	"github.com/mrshabel/gumlog/internal/auth"
 	"github.com/mrshabel/gumlog/internal/config"
 	"github.com/mrshabel/gumlog/internal/log"
+	"github.com/mrshabel/gumlog/internal/log/logtest"
 	"github.com/stretchr/testify/require"
 	"go.opencensus.io/examples/exporter"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/net/http2"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var debug = flag.Bool("debug", false, "Enable observability for debugging")
@@ -50,13 +68,28 @@ func TestServer(t *testing.T) {
 		"produce/consume a message to/from the log succeeds": testProduceConsume,
 		"produce/consume stream succeeds":                    testProduceConsumeStream,
 		"consume past log boundary fails":                    testConsumePastBoundary,
+		"produce/consume record headers succeeds":            testProduceConsumeHeaders,
+		"get stats succeeds":                                 testGetStats,
+		"produce duplicate sequence appends once":            testProduceIdempotent,
+		"get earliest/latest offsets succeeds":               testGetOffsets,
+		"consume stream until latest offset ends":            testConsumeStreamUntilLatest,
+		"consume stream tail follows new records":            testConsumeStreamTail,
+		"produce compressed batch round trips":               testProduceCompressed,
+		"snapshot needs a replicated log":                    testSnapshot,
+		"produce waiting for durability syncs the record":    testProduceDurable,
+		"produce returns the record's timestamp":             testProduceTimestamp,
+		"produce keeps only replicated timestamps":           testProduceReplicatedTimestamp,
+		"produce propagates the request id":                  testRequestID,
+		"consume stream skips removed offsets":               testConsumeStreamSkipsRemoved,
+		"consume relative offset succeeds":                   testConsumeRelative,
+		"consume many offsets succeeds per offset":           testConsumeMany,
 		"unauthorized client fails":                          testUnauthorized,
 	}
 
 	for scenario, fn := range table {
 		t.Run(scenario, func(t *testing.T) {
 			// setup a fresh testing environment with clean state
-			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
+			rootClient, nobodyClient, config, _, teardown := setupTest(t, nil)
 			defer teardown()
 			// run test case. only authorized clients will be used for now
 			fn(t, rootClient, nobodyClient, config)
@@ -65,19 +98,750 @@ func TestServer(t *testing.T) {
 
 }
 
+// test that consumer groups resume from the offsets they committed
+func TestServerGroupOffsets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "group-offsets.json")
+	groupOffsets, err := log.NewOffsetStore(path)
+	require.NoError(t, err)
+	client, nobody, _, _, teardown := setupTest(t, func(c *Config) {
+		c.GroupOffsets = groupOffsets
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	fetch, err := client.FetchCommittedOffset(ctx, &api.FetchCommittedOffsetRequest{Group: "billing"})
+	require.NoError(t, err)
+	require.False(t, fetch.Found)
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Offset: 5})
+	require.NoError(t, err)
+	fetch, err = client.FetchCommittedOffset(ctx, &api.FetchCommittedOffsetRequest{Group: "billing"})
+	require.NoError(t, err)
+	require.True(t, fetch.Found)
+	require.Equal(t, uint64(5), fetch.Offset)
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Offset: 5})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = nobody.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Offset: 6})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// test that a group stream resumes from the last record acked, sending again
+// the records received but not acked before the client disconnected
+func TestServerConsumeGroupStream(t *testing.T) {
+	groupOffsets, err := log.NewOffsetStore(filepath.Join(t.TempDir(), "group-offsets.json"))
+	require.NoError(t, err)
+	client, nobody, _, _, teardown := setupTest(t, func(c *Config) {
+		c.GroupOffsets = groupOffsets
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+	}
+
+	// receive a batch of three records, ack the first two and disconnect
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := client.ConsumeGroupStream(streamCtx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ConsumeGroupRequest{Group: "billing"}))
+	for i := uint64(0); i < 3; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, res.Record.Offset)
+	}
+	require.NoError(t, stream.Send(&api.ConsumeGroupRequest{Ack: 0}))
+	require.NoError(t, stream.Send(&api.ConsumeGroupRequest{Ack: 1}))
+	require.Eventually(t, func() bool {
+		offset, _ := groupOffsets.FetchCommittedOffset("billing")
+		return offset == 2
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+
+	// the next stream starts with the record that wasn't acked
+	stream, err = client.ConsumeGroupStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ConsumeGroupRequest{Group: "billing"}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Record.Offset)
+
+	// acks of records not sent yet end the stream
+	require.NoError(t, stream.Send(&api.ConsumeGroupRequest{Ack: 10}))
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err = nobody.ConsumeGroupStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ConsumeGroupRequest{Group: "billing"}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// ackingLog stands in for a replicated log, returning before records sent
+// with acks NONE are assigned an offset
+type ackingLog struct {
+	*log.Log
+}
+
+func (l *ackingLog) AppendAcks(record *api.Record, acks api.Acks) (uint64, error) {
+	off, err := l.Log.Append(record)
+	if acks == api.Acks_NONE {
+		return 0, err
+	}
+	return off, err
+}
+
+// test that records produced with acks NONE report their offset as unknown,
+// and that they can't be sequenced as the offset can't be deduplicated
+func TestServerProduceAcksNone(t *testing.T) {
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = &ackingLog{Log: c.CommitLog.(*log.Log)}
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	record := &api.Record{Value: []byte("hello world")}
+	res, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+	require.False(t, res.OffsetUnknown)
+
+	res, err = client.Produce(ctx, &api.ProduceRequest{Record: record, Acks: api.Acks_NONE})
+	require.NoError(t, err)
+	require.True(t, res.OffsetUnknown)
+	require.Zero(t, res.Offset)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:     record,
+		Acks:       api.Acks_NONE,
+		ProducerId: "fire-and-forget",
+		Sequence:   1,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: record, Acks: api.Acks_NONE, WaitDurable: true})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// wrappingLog wraps the errors of its reads
+type wrappingLog struct {
+	*log.Log
+}
+
+func (l *wrappingLog) Read(off uint64) (*api.Record, error) {
+	record, err := l.Log.Read(off)
+	if err != nil {
+		return nil, fmt.Errorf("read offset %d: %w", off, err)
+	}
+	return record, nil
+}
+
+// test that an empty log is detected from wrapped out of range errors
+func TestServerEmptyLogWrappedError(t *testing.T) {
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = &wrappingLog{Log: c.CommitLog.(*log.Log)}
+	})
+	defer teardown()
+
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{Mode: api.ConsumeMode_UNTIL_LATEST})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+// laggingLog acts as a follower whose log holds committed records it hasn't
+// applied yet, up to the applied offset
+type laggingLog struct {
+	*log.Log
+	applied atomic.Uint64
+	retries atomic.Int32
+}
+
+func (l *laggingLog) ReadContext(ctx context.Context, off uint64) (*api.Record, error) {
+	if off >= l.applied.Load() {
+		l.retries.Add(1)
+		return nil, api.ErrNotReplicatedYet{Offset: off}
+	}
+	return l.Log.ReadContext(ctx, off)
+}
+
+// test that a following stream waits for committed records to be applied
+// rather than failing
+func TestServerConsumeStreamNotReplicatedYet(t *testing.T) {
+	var lagging *laggingLog
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		lagging = &laggingLog{Log: c.CommitLog.(*log.Log)}
+		lagging.applied.Store(1)
+		c.CommitLog = lagging
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	for range 3 {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+	}
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Mode: api.ConsumeMode_FOLLOW})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+
+	// the stream keeps retrying until the remaining records are applied
+	require.Eventually(t, func() bool {
+		return lagging.retries.Load() > 1
+	}, time.Second, 10*time.Millisecond)
+	lagging.applied.Store(3)
+	for i := uint64(1); i < 3; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, res.Record.Offset)
+	}
+}
+
+// countingLog counts the reads that reach the log
+type countingLog struct {
+	*log.Log
+	reads atomic.Int32
+}
+
+func (l *countingLog) ReadContext(ctx context.Context, off uint64) (*api.Record, error) {
+	l.reads.Add(1)
+	return l.Log.ReadContext(ctx, off)
+}
+
+// test that offsets clearly outside the log are rejected before reading it,
+// while the offset being appended next is still read
+func TestServerConsumeOutOfRange(t *testing.T) {
+	var counting *countingLog
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		counting = &countingLog{Log: c.CommitLog.(*log.Log)}
+		c.CommitLog = counting
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: math.MaxUint64})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	require.Zero(t, counting.reads.Load())
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	require.Equal(t, int32(1), counting.reads.Load())
+}
+
+// test that records are stored with the id of the request that produced
+// them once enabled, which clients can't set on the record
+func TestServerRecordRequestIDs(t *testing.T) {
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		c.RecordRequestIDs = true
+	})
+	defer teardown()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), api.RequestIDKey, "request")
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world"), RequestId: "forged"},
+	})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, "request", consume.Record.RequestId)
+
+	// records replicated from another server keep the id they were stored with
+	ctx = metadata.AppendToOutgoingContext(ctx, api.ReplicatedKey, "true")
+	produce, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world"), RequestId: "original"},
+	})
+	require.NoError(t, err)
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, "original", consume.Record.RequestId)
+}
+
+// test that record values are accepted up to the configured record size
+// limit, and that a stream stops at the first record above it
+func TestServerMaxRecordBytes(t *testing.T) {
+	client, _, config, _, teardown := setupTest(t, func(c *Config) {
+		c.MaxRecordBytes = 16
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: bytes.Repeat([]byte("a"), 16)}})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: bytes.Repeat([]byte("a"), 17)}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	for _, size := range []int{1, 17, 1} {
+		err := stream.Send(&api.ProduceRequest{Record: &api.Record{Value: bytes.Repeat([]byte("a"), size)}})
+		require.NoError(t, err)
+	}
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	committed, ok := api.ProduceStreamCommitted(err)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), committed)
+
+	// the oversized record and those after it never reached the log
+	_, next := config.CommitLog.(*log.Log).OffsetBounds()
+	require.Equal(t, uint64(2), next)
+}
+
+// test that requests are accepted up to the configured message size limit
+func TestServerMaxRecvMsgSize(t *testing.T) {
+	maxRecvMsgSize := 1024
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		c.MaxRecvMsgSize = maxRecvMsgSize
+	})
+	defer teardown()
+
+	// build a produce request whose encoded size is exactly the given size
+	request := func(size int) *api.ProduceRequest {
+		req := &api.ProduceRequest{Record: &api.Record{}}
+		req.Record.Value = make([]byte, size-proto.Size(req)-4)
+		for proto.Size(req) < size {
+			req.Record.Value = append(req.Record.Value, 0)
+		}
+		require.Equal(t, size, proto.Size(req))
+		return req
+	}
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, request(maxRecvMsgSize))
+	require.NoError(t, err)
+
+	_, err = client.Produce(ctx, request(maxRecvMsgSize+1))
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+// test that a following consume stream is closed once it sends no records for
+// the idle timeout
+func TestServerStreamIdleTimeout(t *testing.T) {
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		c.StreamIdleTimeout = 200 * time.Millisecond
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+
+	// no further records are appended
+	start := time.Now()
+	_, err = stream.Recv()
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+// test that an idle following stream sends heartbeats, which give way to
+// records once they are appended
+func TestServerStreamHeartbeat(t *testing.T) {
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		c.StreamHeartbeatInterval = 200 * time.Millisecond
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for range 2 {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.True(t, res.Heartbeat)
+		require.Nil(t, res.Record)
+	}
+
+	for range 3 {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+	}
+	// a heartbeat may have been sent before the records were appended, but
+	// none is sent in between them as they are appended well within the
+	// heartbeat interval
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	for res.Heartbeat {
+		res, err = stream.Recv()
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(0), res.Record.Offset)
+	for i := uint64(1); i < 3; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.False(t, res.Heartbeat)
+		require.Equal(t, i, res.Record.Offset)
+	}
+}
+
+// test that an explicitly insecure server serves clients without tls
+func TestServerInsecure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	clientLog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clientLog.Close()
+
+	// an authorizer is required unless the server is insecure
+	_, err = NewGRPCServer(&Config{CommitLog: clientLog})
+	require.Error(t, err)
+
+	server, err := NewGRPCServer(&Config{CommitLog: clientLog, Insecure: true})
+	require.NoError(t, err)
+	go server.Serve(l)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+}
+
+// slowLog appends records slowly, tracking the most records a produce stream
+// held at once, and fails once failAt records are appended
+type slowLog struct {
+	CommitLog
+	delay       time.Duration
+	failAt      int64
+	received    atomic.Int64
+	appended    atomic.Int64
+	maxInFlight int64
+}
+
+func (l *slowLog) Append(record *api.Record) (uint64, error) {
+	// records received and not yet appended, including this one
+	l.maxInFlight = max(l.maxInFlight, l.received.Load()-l.appended.Load())
+	time.Sleep(l.delay)
+	if l.appended.Load() == l.failAt {
+		return 0, status.Error(codes.Unavailable, "disk unavailable")
+	}
+	defer l.appended.Add(1)
+	return l.CommitLog.Append(record)
+}
+
+// countingStream counts the messages received on a stream
+type countingStream struct {
+	grpc.ServerStream
+	received *atomic.Int64
+}
+
+func (s countingStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	s.received.Add(1)
+	return nil
+}
+
+// test that a produce stream holds no more than its in-flight limit of records
+// when the log appends slower than the client produces, and that a failure
+// reports how many records were committed
+func TestServerProduceStreamBackpressure(t *testing.T) {
+	slow := &slowLog{delay: time.Millisecond, failAt: 100}
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		slow.CommitLog = c.CommitLog
+		c.CommitLog = slow
+		c.ProduceStreamInFlight = 4
+	}, grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, countingStream{ServerStream: ss, received: &slow.received})
+	}))
+	defer teardown()
+
+	stream, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+
+	// produce without waiting on responses
+	go func() {
+		for i := range 1000 {
+			record := &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}
+			if err := stream.Send(&api.ProduceRequest{Record: record}); err != nil {
+				return
+			}
+		}
+		stream.CloseSend()
+	}()
+
+	var responses uint64
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			require.Equal(t, codes.Unavailable, status.Code(err))
+			committed, ok := api.ProduceStreamCommitted(err)
+			require.True(t, ok)
+			require.Equal(t, responses, committed)
+			break
+		}
+		require.Equal(t, responses, res.Offset)
+		responses++
+	}
+	require.Equal(t, uint64(100), responses)
+	require.LessOrEqual(t, slow.maxInFlight, int64(4))
+}
+
+// test the produce and consume flow against the in-memory log
+func TestServerMemoryLog(t *testing.T) {
+	memLog := logtest.NewLog()
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = memLog
+		c.OffsetGetter = memLog
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	for i := range 3 {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), produce.Offset)
+	}
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 1"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 3})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	latest, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{Position: api.OffsetPosition_LATEST})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), latest.Offset)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Mode: api.ConsumeMode_UNTIL_LATEST})
+	require.NoError(t, err)
+	for i := range 3 {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+// test that clients pinging more often than the keepalive policy permits are
+// sent a GOAWAY while others have their pings acknowledged
+func TestServerKeepalivePolicy(t *testing.T) {
+	table := map[string]struct {
+		minTime time.Duration
+		goAway  bool
+	}{
+		"pings too often": {minTime: time.Minute, goAway: true},
+		"pings permitted": {minTime: time.Nanosecond},
+	}
+	for scenario, tc := range table {
+		t.Run(scenario, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			clientLog, err := log.NewLog(t.TempDir(), log.Config{})
+			require.NoError(t, err)
+			defer clientLog.Close()
+			server, err := NewGRPCServer(&Config{CommitLog: clientLog, Insecure: true, KeepaliveMinTime: tc.minTime})
+			require.NoError(t, err)
+			go server.Serve(l)
+			defer server.Stop()
+
+			// grpc clients never ping this often, so speak http2 directly
+			conn, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+			_, err = conn.Write([]byte(http2.ClientPreface))
+			require.NoError(t, err)
+			framer := http2.NewFramer(conn, conn)
+			require.NoError(t, framer.WriteSettings())
+			pings := 5
+			for i := range pings {
+				require.NoError(t, framer.WritePing(false, [8]byte{byte(i)}))
+			}
+
+			for acks := 0; acks < pings; {
+				frame, err := framer.ReadFrame()
+				require.NoError(t, err)
+				switch frame := frame.(type) {
+				case *http2.GoAwayFrame:
+					require.True(t, tc.goAway, "unexpected goaway")
+					require.Equal(t, http2.ErrCodeEnhanceYourCalm, frame.ErrCode)
+					require.Equal(t, "too_many_pings", string(frame.DebugData()))
+					return
+				case *http2.PingFrame:
+					if frame.IsAck() {
+						acks++
+					}
+				}
+			}
+			require.False(t, tc.goAway, "expected goaway")
+		})
+	}
+}
+
+// test that request logs go to the injected logger rather than the global one
+func TestServerLogger(t *testing.T) {
+	globalCore, globalLogs := observer.New(zapcore.DebugLevel)
+	defer zap.ReplaceGlobals(zap.New(globalCore))()
+	core, logs := observer.New(zapcore.DebugLevel)
+
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Logger = zap.New(core)
+	})
+	defer teardown()
+	_, err := client.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+
+	entries := logs.FilterField(zap.String("grpc.method", "Produce")).AllUntimed()
+	require.Len(t, entries, 1)
+	require.Equal(t, "server", entries[0].LoggerName)
+	require.Zero(t, globalLogs.Filter(func(e observer.LoggedEntry) bool {
+		return e.LoggerName == "server"
+	}).Len())
+}
+
+// a context of a tls connection from the address with the given chains
+func peerContext(addr string, chains ...[]*x509.Certificate) context.Context {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	state := tls.ConnectionState{VerifiedChains: chains}
+	if len(chains) > 0 {
+		state.PeerCertificates = chains[0]
+	}
+	info := credentials.TLSInfo{State: state}
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: tcpAddr, AuthInfo: info})
+}
+
+func TestAuthenticate(t *testing.T) {
+	subjects, err := newSubjectCache(defaultSubjectCacheSize)
+	require.NoError(t, err)
+
+	// connections without a certificate are anonymous
+	ctx, err := subjects.authenticate(peerContext("127.0.0.1:1000"))
+	require.NoError(t, err)
+	require.Equal(t, "", subject(ctx))
+
+	// certificates without a verified chain are rejected rather than panicking
+	unverified := peerContext("127.0.0.1:1000")
+	p, _ := peer.FromContext(unverified)
+	p.AuthInfo = credentials.TLSInfo{State: tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "root"}}},
+	}}
+	_, err = subjects.authenticate(unverified)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	root := &x509.Certificate{Subject: pkix.Name{CommonName: "root"}}
+	ctx, err = subjects.authenticate(peerContext("127.0.0.1:1000", []*x509.Certificate{root}))
+	require.NoError(t, err)
+	require.Equal(t, "root", subject(ctx))
+
+	// a new connection reusing the address is authenticated again
+	nobody := &x509.Certificate{Subject: pkix.Name{CommonName: "nobody"}}
+	ctx, err = subjects.authenticate(peerContext("127.0.0.1:1000", []*x509.Certificate{nobody}))
+	require.NoError(t, err)
+	require.Equal(t, "nobody", subject(ctx))
+}
+
+func BenchmarkAuthenticate(b *testing.B) {
+	subjects, err := newSubjectCache(defaultSubjectCacheSize)
+	require.NoError(b, err)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "root"}}
+	ctx := peerContext("127.0.0.1:1000", []*x509.Certificate{cert})
+	b.ResetTimer()
+	for range b.N {
+		if _, err := subjects.authenticate(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// test that servers with optional client certificates let clients without one
+// connect anonymously, leaving the acl to decide what they may do
+func TestServerOptionalClientCert(t *testing.T) {
+	files, err := config.Files()
+	require.NoError(t, err)
+
+	// anonymous clients have an empty subject, which may only consume
+	policyFile := filepath.Join(t.TempDir(), "policy.csv")
+	require.NoError(t, os.WriteFile(policyFile, []byte("p, root, *, produce\np, , *, consume\n"), 0644))
+	authorizer, err := auth.New(files.ACLModelFile, policyFile)
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:           files.ServerCertFile,
+		KeyFile:            files.ServerKeyFile,
+		CAFile:             files.CAFile,
+		Server:             true,
+		ClientCertOptional: true,
+	})
+	require.NoError(t, err)
+	root, _, _, addr, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = authorizer
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	defer teardown()
+
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{CAFile: files.CAFile})
+	require.NoError(t, err)
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(clientTLSConfig)))
+	require.NoError(t, err)
+	defer conn.Close()
+	anonymous := api.NewLogClient(conn)
+
+	ctx := context.Background()
+	produce, err := root.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+
+	consume, err := anonymous.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+	_, err = anonymous.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// test that handlers called without an authenticated subject are denied rather than panicking
+func TestServerMissingSubject(t *testing.T) {
+	_, _, cfg, _, teardown := setupTest(t, nil)
+	defer teardown()
+
+	srv, err := newGRPCServer(cfg)
+	require.NoError(t, err)
+	require.NotPanics(t, func() {
+		_, err = srv.Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
 // a helper function to create an insecure connection to the grpc server on any random port. The listening grpc server is run in a separate goroutine to avoid blocking the main goroutine
-func setupTest(t *testing.T, fn func(*Config)) (rootClient, nobodyClient api.LogClient, cfg *Config, teardown func()) {
+func setupTest(t *testing.T, fn func(*Config), opts ...grpc.ServerOption) (rootClient, nobodyClient api.LogClient, cfg *Config, addr string, teardown func()) {
 	t.Helper()
 	// 0 picks up any arbitrary port
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
+	files, err := config.Files()
+	require.NoError(t, err)
 
 	// helper function to create new grpc client with credentials and different permission levels
 	newClient := func(crtPath, keyPath string) (*grpc.ClientConn, api.LogClient, grpc.DialOption) {
 		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
 			CertFile: crtPath,
 			KeyFile:  keyPath,
-			CAFile:   config.CAFile,
+			CAFile:   files.CAFile,
 			Server:   false,
 		})
 		require.NoError(t, err)
@@ -94,37 +858,36 @@ func setupTest(t *testing.T, fn func(*Config)) (rootClient, nobodyClient api.Log
 
 	var rootConn *grpc.ClientConn
 	rootConn, rootClient, _ = newClient(
-		config.RootClientCertFile,
-		config.RootClientKeyFile,
+		files.RootClientCertFile,
+		files.RootClientKeyFile,
 	)
 	var nobodyConn *grpc.ClientConn
 	nobodyConn, nobodyClient, _ = newClient(
-		config.NobodyClientCertFile,
-		config.NobodyClientKeyFile,
+		files.NobodyClientCertFile,
+		files.NobodyClientKeyFile,
 	)
 
 	// configure server tls
 	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		CertFile:      config.ServerCertFile,
-		KeyFile:       config.ServerKeyFile,
-		CAFile:        config.CAFile,
+		CertFile:      files.ServerCertFile,
+		KeyFile:       files.ServerKeyFile,
+		CAFile:        files.CAFile,
 		ServerAddress: l.Addr().String(),
 		Server:        true,
 	})
 	require.NoError(t, err)
 	serverCreds := credentials.NewTLS(serverTLSConfig)
 
-	// temporal directory to store the log files
-	dir, err := os.MkdirTemp("", "server-test")
-	require.NoError(t, err)
-	defer os.RemoveAll(dir)
+	// temporal directory to store the log files, removed once the test ends
+	dir := t.TempDir()
 
 	// create new instance of the log
 	clientLog, err := log.NewLog(dir, log.Config{})
 	require.NoError(t, err)
 
 	// add ACL authorizer
-	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	authorizer, err := auth.New(files.ACLModelFile, files.ACLPolicyFile)
+	require.NoError(t, err)
 
 	// setup and start telemetry exporter to send logs into a file
 	var telemetryExporter *exporter.LogExporter
@@ -151,11 +914,17 @@ func setupTest(t *testing.T, fn func(*Config)) (rootClient, nobodyClient api.Log
 	}
 
 	// execute the test function with the log configuration
-	cfg = &Config{CommitLog: clientLog, Authorizer: authorizer}
+	cfg = &Config{
+		CommitLog:    clientLog,
+		Authorizer:   authorizer,
+		StatsGetter:  clientLog,
+		OffsetGetter: clientLog,
+	}
 	if fn != nil {
 		fn(cfg)
 	}
-	server, err := NewGRPCServer(cfg, grpc.Creds(serverCreds))
+	// options given by the test override the defaults, such as the credentials
+	server, err := NewGRPCServer(cfg, append([]grpc.ServerOption{grpc.Creds(serverCreds)}, opts...)...)
 	require.NoError(t, err)
 
 	// expose and serve grpc server in the background
@@ -181,7 +950,7 @@ func setupTest(t *testing.T, fn func(*Config)) (rootClient, nobodyClient api.Log
 		}
 	}
 
-	return rootClient, nobodyClient, cfg, teardown
+	return rootClient, nobodyClient, cfg, l.Addr().String(), teardown
 }
 
 func testProduceConsume(t *testing.T, client, _ api.LogClient, config *Config) {
@@ -199,6 +968,171 @@ func testProduceConsume(t *testing.T, client, _ api.LogClient, config *Config) {
 	require.Equal(t, want.Offset, consume.Record.Offset)
 }
 
+// test that clients exceeding their rate limit are rejected until their quota refills
+func TestServerRateLimit(t *testing.T) {
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		c.RateLimit = 5
+		c.RateBurst = 2
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+	var rejected int
+	for range 10 {
+		_, err := client.Produce(ctx, req)
+		if err != nil {
+			require.Equal(t, codes.ResourceExhausted, status.Code(err))
+			rejected++
+		}
+	}
+	require.NotZero(t, rejected)
+
+	// wait for the subject's bucket to refill
+	time.Sleep(500 * time.Millisecond)
+	_, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+}
+
+// test that record headers survive the produce/consume round trip
+func testProduceConsumeHeaders(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	tests := []map[string]string{
+		{"trace-id": "abc123", "content-type": "application/json"},
+		{},
+	}
+	for _, headers := range tests {
+		want := &api.Record{Value: []byte("hello world"), Headers: headers}
+		produce, err := client.Produce(ctx, &api.ProduceRequest{Record: want})
+		require.NoError(t, err)
+
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+		require.NoError(t, err)
+		require.Equal(t, want.Value, consume.Record.Value)
+		// empty maps are not encoded on the wire so compare by length first
+		require.Len(t, consume.Record.Headers, len(headers))
+		for k, v := range headers {
+			require.Equal(t, v, consume.Record.Headers[k])
+		}
+	}
+}
+
+// test that a sequence being appended only holds up its own duplicates, which
+// take its outcome rather than appending again
+func TestDedupCache(t *testing.T) {
+	d, err := newDedupCache(0)
+	require.NoError(t, err)
+
+	var appends atomic.Int32
+	release := make(chan struct{})
+	first := make(chan produced)
+	go func() {
+		res, _ := d.produce("producer", 1, func() (produced, error) {
+			appends.Add(1)
+			<-release
+			return produced{offset: 7}, nil
+		})
+		first <- res
+	}()
+	require.Eventually(t, func() bool { return appends.Load() == 1 }, time.Second, time.Millisecond)
+
+	// other sequences are appended while the first one is in flight
+	res, err := d.produce("producer", 2, func() (produced, error) {
+		return produced{offset: 8}, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), res.offset)
+
+	duplicate := make(chan produced)
+	go func() {
+		res, _ := d.produce("producer", 1, func() (produced, error) {
+			appends.Add(1)
+			return produced{}, nil
+		})
+		duplicate <- res
+	}()
+	close(release)
+	require.Equal(t, uint64(7), (<-first).offset)
+	require.Equal(t, uint64(7), (<-duplicate).offset)
+	require.Equal(t, int32(1), appends.Load())
+}
+
+// test that retried produce requests with the same producer sequence are only appended once
+func testProduceIdempotent(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	req := &api.ProduceRequest{
+		Record:     &api.Record{Value: []byte("hello world")},
+		ProducerId: "producer-1",
+		Sequence:   1,
+	}
+	first, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	retry, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset, retry.Offset)
+
+	// the next sequence is appended after the deduplicated record
+	req.Sequence = 2
+	next, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset+1, next.Offset)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: next.Offset + 1})
+	require.Error(t, err)
+}
+
+// test that the earliest and latest offsets track appends to the log
+func testGetOffsets(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	getOffsets := func(position api.OffsetPosition) *api.GetOffsetsResponse {
+		res, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{Position: position})
+		require.NoError(t, err)
+		return res
+	}
+
+	// an empty log reports where the first record will be written
+	for _, position := range []api.OffsetPosition{api.OffsetPosition_EARLIEST, api.OffsetPosition_LATEST} {
+		res := getOffsets(position)
+		require.True(t, res.Empty)
+		require.Equal(t, uint64(0), res.Offset)
+	}
+
+	for range 3 {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	earliest := getOffsets(api.OffsetPosition_EARLIEST)
+	require.False(t, earliest.Empty)
+	require.Equal(t, uint64(0), earliest.Offset)
+	latest := getOffsets(api.OffsetPosition_LATEST)
+	require.False(t, latest.Empty)
+	require.Equal(t, uint64(2), latest.Offset)
+}
+
+// test that the log statistics are served to authorized clients
+func testGetStats(t *testing.T, client, nobody api.LogClient, config *Config) {
+	ctx := context.Background()
+	for range 2 {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	stats, err := client.GetStats(ctx, &api.GetStatsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), stats.Segments)
+	require.Equal(t, uint64(2), stats.Records)
+	require.NotZero(t, stats.TotalBytes)
+	// the store bytes plus two 12-byte index entries
+	require.Equal(t, stats.ActiveSegmentBytes+2*12, stats.TotalBytes)
+
+	_, err = nobody.GetStats(ctx, &api.GetStatsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
 // test that the server returns an error when a record's offset exceeds the highest offset of the log
 func testConsumePastBoundary(t *testing.T, client, _ api.LogClient, config *Config) {
 	ctx := context.Background()
@@ -259,13 +1193,338 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Con
 		// receive stream and check that it matches current record
 		res, err := cStream.Recv()
 		require.NoError(t, err)
+		require.NotNil(t, res.Record.Timestamp)
 		require.Equal(t, res.Record, &api.Record{
-			Value:  record.Value,
-			Offset: uint64(i),
+			Value:     record.Value,
+			Offset:    uint64(i),
+			Timestamp: res.Record.Timestamp,
 		})
 	}
 }
 
+// test that each requested offset is read or fails on its own, in the
+// requested order
+func testConsumeMany(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	for i := range 3 {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}})
+		require.NoError(t, err)
+	}
+
+	res, err := client.ConsumeMany(ctx, &api.ConsumeManyRequest{Offsets: []uint64{2, 5, 0, 2}})
+	require.NoError(t, err)
+	require.Len(t, res.Results, 4)
+	for i, want := range []uint64{2, 5, 0, 2} {
+		result := res.Results[i]
+		require.Equal(t, want, result.Offset)
+		if want == 5 {
+			require.Nil(t, result.Record)
+			require.Equal(t, int32(codes.NotFound), result.Code)
+			require.Contains(t, result.Error, "offset out of range: 5")
+			continue
+		}
+		require.Equal(t, int32(codes.OK), result.Code)
+		require.Empty(t, result.Error)
+		require.Equal(t, fmt.Sprintf("record %d", want), string(result.Record.Value))
+	}
+}
+
+// test that a consume stream skips the offsets of removed records
+func testConsumeStreamSkipsRemoved(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	// records larger than a store get a segment each
+	value := bytes.Repeat([]byte("a"), 2048)
+	for range 4 {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: value}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, config.CommitLog.(*log.Log).Truncate(1))
+
+	// a consumer starting at a removed offset resumes at the next record
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for _, want := range []uint64{2, 3} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Record.Offset)
+	}
+}
+
+// test that an until latest stream ends once it sent the records the log
+// held when it was opened
+func testConsumeStreamUntilLatest(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	request := &api.ConsumeRequest{Mode: api.ConsumeMode_UNTIL_LATEST}
+
+	// an empty log ends the stream straight away
+	stream, err := client.ConsumeStream(ctx, request)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	n := 5
+	for i := range n {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err = client.ConsumeStream(ctx, request)
+	require.NoError(t, err)
+	for i := range n {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+func testConsumeStreamTail(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	produce := func(i int) {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+	for i := range 10 {
+		produce(i)
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Mode: api.ConsumeMode_TAIL, Tail: 3})
+	require.NoError(t, err)
+	for i := 7; i < 10; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+	}
+
+	// the stream waits for the next record instead of ending
+	recv := make(chan *api.ConsumeResponse)
+	go func() {
+		res, err := stream.Recv()
+		if err == nil {
+			recv <- res
+		}
+		close(recv)
+	}()
+	select {
+	case res := <-recv:
+		t.Fatalf("unexpected record: %v", res)
+	case <-time.After(100 * time.Millisecond):
+	}
+	produce(10)
+	res, ok := <-recv
+	require.True(t, ok)
+	require.Equal(t, uint64(10), res.Record.Offset)
+
+	// a tail longer than the log starts at the first record
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Mode: api.ConsumeMode_TAIL, Tail: 100})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+}
+
+func testProduceCompressed(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	batch := snappyBlock([]byte("record 0\nrecord 1\nrecord 2\n"))
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: batch, Compression: api.Compression_SNAPPY},
+	})
+	require.NoError(t, err)
+
+	// the value comes back as produced, with its codec
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, batch, consume.Record.Value)
+	require.Equal(t, api.Compression_SNAPPY, consume.Record.Compression)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: batch, Compression: api.Compression(100)},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testProduceDurable(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("buffered")},
+	})
+	require.NoError(t, err)
+	require.False(t, produce.Durable)
+
+	value := []byte("durable")
+	produce, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:      &api.Record{Value: value},
+		WaitDurable: true,
+	})
+	require.NoError(t, err)
+	require.True(t, produce.Durable)
+
+	// the record is in the store file without the log being flushed or closed
+	stores, err := filepath.Glob(filepath.Join(config.CommitLog.(*log.Log).Dir, "*.store"))
+	require.NoError(t, err)
+	require.Len(t, stores, 1)
+	p, err := os.ReadFile(stores[0])
+	require.NoError(t, err)
+	require.True(t, bytes.Contains(p, value))
+
+	// retries report the durability of the record appended first, which a
+	// retry waiting for it provides
+	req := &api.ProduceRequest{
+		Record:      &api.Record{Value: value},
+		ProducerId:  "durable",
+		Sequence:    1,
+		WaitDurable: true,
+	}
+	produce, err = client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.True(t, produce.Durable)
+	req.WaitDurable = false
+	retry, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset, retry.Offset)
+	require.True(t, retry.Durable)
+
+	req.Sequence = 2
+	produce, err = client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.False(t, produce.Durable)
+	req.WaitDurable = true
+	retry, err = client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset, retry.Offset)
+	require.True(t, retry.Durable)
+}
+
+func testProduceTimestamp(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	req := &api.ProduceRequest{
+		Record:     &api.Record{Value: []byte("hello world")},
+		ProducerId: "stamper",
+		Sequence:   1,
+	}
+	produce, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.NotZero(t, produce.Timestamp.AsTime())
+
+	// the response carries the time stored with the record
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.True(t, proto.Equal(produce.Timestamp, consume.Record.Timestamp))
+
+	// a duplicate returns the time of the record appended first
+	dup, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset, dup.Offset)
+	require.True(t, proto.Equal(produce.Timestamp, dup.Timestamp))
+}
+
+// test that clients can't set the time a record is stored with unless they
+// replicate it from another server
+func testProduceReplicatedTimestamp(t *testing.T, client, _ api.LogClient, config *Config) {
+	past := timestamppb.New(time.Unix(1700000000, 0))
+	record := &api.Record{Value: []byte("hello world"), Timestamp: past}
+	produce, err := client.Produce(context.Background(), &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+	require.False(t, proto.Equal(past, produce.Timestamp))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), api.ReplicatedKey, "true")
+	produce, err = client.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+	require.True(t, proto.Equal(past, produce.Timestamp))
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.True(t, proto.Equal(past, consume.Record.Timestamp))
+}
+
+// test that replicated produce requests from clients not allowed to replicate
+// are produced like any other rather than rejected
+func TestServerReplicateUnauthorized(t *testing.T) {
+	files, err := config.Files()
+	require.NoError(t, err)
+	policyFile := filepath.Join(t.TempDir(), "policy.csv")
+	require.NoError(t, os.WriteFile(policyFile, []byte("p, root, *, produce\np, root, *, consume\n"), 0644))
+	authorizer, err := auth.New(files.ACLModelFile, policyFile)
+	require.NoError(t, err)
+	client, _, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = authorizer
+	})
+	defer teardown()
+
+	past := timestamppb.New(time.Unix(1700000000, 0))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), api.ReplicatedKey, "true")
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world"), Timestamp: past}})
+	require.NoError(t, err)
+	require.False(t, proto.Equal(past, produce.Timestamp))
+}
+
+// encode p as a snappy block made of a single literal
+func snappyBlock(p []byte) []byte {
+	if len(p) == 0 || len(p) > 60 {
+		panic("snappy literal length must be between 1 and 60")
+	}
+	return append([]byte{byte(len(p)), byte(len(p)-1) << 2}, p...)
+}
+
+func testSnapshot(t *testing.T, client, nobody api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := nobody.Snapshot(ctx, &api.SnapshotRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.Snapshot(ctx, &api.SnapshotRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func testRequestID(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	// a request id is generated for requests without one
+	var header metadata.MD
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	}, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Len(t, header.Get(api.RequestIDKey), 1)
+
+	// and propagated from the metadata otherwise
+	ctx = metadata.AppendToOutgoingContext(ctx, api.RequestIDKey, "request")
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world"), RequestId: "forged"},
+	}, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Equal(t, []string{"request"}, header.Get(api.RequestIDKey))
+
+	// records aren't stored with request ids unless enabled
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset + 1})
+	require.NoError(t, err)
+	require.Empty(t, consume.Record.RequestId)
+}
+
+func testConsumeRelative(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	for i := range 3 {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := client.Consume(ctx, &api.ConsumeRequest{RelativeOffset: -1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Record.Offset)
+
+	res, err = client.Consume(ctx, &api.ConsumeRequest{RelativeOffset: -3})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{RelativeOffset: -4})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
 // connect to the server as an authorized client
 func testUnauthorized(t *testing.T, _, client api.LogClient, config *Config) {
 	ctx := context.Background()
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+
+	lru "github.com/hashicorp/golang-lru"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// default number of connections whose subject is remembered
+const defaultSubjectCacheSize = 1024
+
+// a connection's client certificate and the subject read from it
+type cachedSubject struct {
+	cert    *x509.Certificate
+	subject string
+}
+
+// subjectCache remembers the subject of every connection so that it is read
+// from the client certificate once per connection rather than per request
+type subjectCache struct {
+	cache *lru.Cache
+}
+
+func newSubjectCache(size int) (*subjectCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &subjectCache{cache: cache}, nil
+}
+
+// read the subject information of a connected client certificate and write it to the server context using an interceptor(middleware)
+func (c *subjectCache) authenticate(ctx context.Context) (context.Context, error) {
+	// get the peer information from the given context
+	peer, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx, status.New(
+			codes.Unknown, "couldn't get peer info",
+		).Err()
+	}
+	// extract the authentication information
+	if peer.AuthInfo == nil {
+		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	}
+	tlsInfo, ok := peer.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ctx, status.Errorf(codes.Unauthenticated, "unsupported auth type %q", peer.AuthInfo.AuthType())
+	}
+	// clients of servers with optional client certificates may connect
+	// without one. they are anonymous and have an empty subject
+	if len(tlsInfo.State.PeerCertificates) == 0 {
+		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	}
+	chains := tlsInfo.State.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return ctx, status.Error(codes.Unauthenticated, "no verified client certificate")
+	}
+	cert := chains[0][0]
+
+	// connections are told apart by their remote address. the certificate is
+	// compared too, as the address of a closed connection may be reused
+	key := peer.Addr.String()
+	if cached, ok := c.cache.Get(key); ok && cached.(cachedSubject).cert == cert {
+		return context.WithValue(ctx, subjectContextKey{}, cached.(cachedSubject).subject), nil
+	}
+	// extract subject common name as specified in the CA certificate
+	subject := cert.Subject.CommonName
+	c.cache.Add(key, cachedSubject{cert: cert, subject: subject})
+	return context.WithValue(ctx, subjectContextKey{}, subject), nil
+}